@@ -20,6 +20,7 @@ import (
 	"github.com/barnybug/gohome/services/cheerlights"
 	"github.com/barnybug/gohome/services/currentcost"
 	"github.com/barnybug/gohome/services/datalogger"
+	"github.com/barnybug/gohome/services/devicestate"
 	"github.com/barnybug/gohome/services/energenie"
 	"github.com/barnybug/gohome/services/espeaker"
 	"github.com/barnybug/gohome/services/googlehome"
@@ -70,6 +71,7 @@ func registerServices() {
 	services.Register(&cheerlights.Service{})
 	services.Register(&currentcost.Service{})
 	services.Register(&datalogger.Service{})
+	services.Register(&devicestate.Service{})
 	services.Register(&energenie.Service{})
 	services.Register(&espeaker.Service{})
 	services.Register(&googlehome.Service{})
@@ -116,8 +118,15 @@ func usage() {
 	fmt.Println("   start   [service]       Start a service")
 	fmt.Println("   status  [service]       Get service status")
 	fmt.Println("   stop    [service]       Stop a process")
+	fmt.Println("   switch  target command  Switch a device, group:, location: or cap:")
 	fmt.Println("   query   ...             Query services")
 	fmt.Println()
+	fmt.Println("Environment:")
+	fmt.Println("   GOHOME_API              api url, eg http://localhost:8723")
+	fmt.Println("   GOHOME_API_TOKEN        api bearer token")
+	fmt.Println("   GOHOME_API_USER         api user/password, for basic auth")
+	fmt.Println("   GOHOME_API_PASSWORD")
+	fmt.Println()
 }
 
 var emptyParams = url.Values{}
@@ -53,13 +53,26 @@ func request(path string, params url.Values) (*http.Response, error) {
 	if os.Getenv("GOHOME_API") == "" {
 		fmtFatalf("Set GOHOME_API to the gohome api url.")
 	}
-	// add http auth
 	api := os.Getenv("GOHOME_API")
 	uri := fmt.Sprintf("%s/%s", api, path)
 	if len(params) > 0 {
 		uri += "?" + params.Encode()
 	}
-	resp, err := http.Get(uri)
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	// add http auth
+	if token := os.Getenv("GOHOME_API_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else if user := os.Getenv("GOHOME_API_USER"); user != "" {
+		req.SetBasicAuth(user, os.Getenv("GOHOME_API_PASSWORD"))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized {
+		resp.Body.Close()
+		fmtFatalf("Unauthorized: set GOHOME_API_TOKEN, or GOHOME_API_USER and GOHOME_API_PASSWORD\n")
+	}
 	return resp, err
 }
 
@@ -15,6 +15,35 @@ import (
 	"github.com/barnybug/gohome/util"
 )
 
+type ApiUserConf struct {
+	Token    string   // bearer token
+	Password string   // basic auth password
+	Role     string   // read, control or admin
+	Groups   []string // device groups control is limited to, empty for all
+}
+
+// HookConf is an inbound webhook, POST /hooks/<name>, mapping the payload to
+// an event.
+type HookConf struct {
+	Secret    string            // shared secret, as the X-Hook-Secret header or secret parameter
+	Hmac      string            // HMAC-SHA256 key to verify the body signature
+	Signature string            // header with the hex signature (default X-Hub-Signature-256)
+	Open      bool              // allow without a secret or hmac, eg on a private network
+	Topic     string            // event topic (default hook)
+	Source    string            // event source (default hook.<name>)
+	Fields    map[string]string // event fields: $.path into the payload, a template, or a constant
+	Rate      int               // maximum requests per period, 0 for unlimited
+	Period    Duration          // rate limit period (default 1m)
+}
+
+type ApiConf struct {
+	Users map[string]ApiUserConf // api users, by name. None disables auth.
+	Hooks map[string]HookConf    // inbound webhooks, by name
+	// origins allowed cross-origin requests (eg https://dash.example.com).
+	// None allows any while auth is disabled, otherwise none.
+	Origins []string
+}
+
 type BillConf struct {
 	Electricity struct {
 		Primary_Rate    float64
@@ -62,6 +91,11 @@ func (d DeviceConf) IsSwitchable() bool {
 	return d.Cap["switch"]
 }
 
+// IsControllable returns true if the device accepts on/off commands.
+func (d DeviceConf) IsControllable() bool {
+	return d.Cap["switch"] || d.Cap["light"] || d.Cap["dimmer"] || d.Cap["ct"] || d.Cap["colourtemp"] || d.Cap["colour"]
+}
+
 func (d DeviceConf) Prefix() string {
 	ps := strings.SplitN(d.Id, ".", 2)
 	return ps[0]
@@ -72,6 +106,14 @@ func (d DeviceConf) Minor() string {
 	return ps[1]
 }
 
+func (d DeviceConf) Protocol() string {
+	i := strings.Index(d.Source, ".")
+	if i != -1 {
+		return d.Source[:i]
+	}
+	return ""
+}
+
 func (d DeviceConf) SourceId() string {
 	i := strings.Index(d.Source, ".")
 	if i != -1 {
@@ -84,6 +126,15 @@ type DataloggerConf struct {
 	Path string
 }
 
+type DevicestateProtocolConf struct {
+	Reconcile      Duration // interval to re-issue desired state, 0 to disable
+	Unacknowledged bool     // acks only confirm transmission, keep re-issuing
+}
+
+type DevicestateConf struct {
+	Protocols map[string]DevicestateProtocolConf
+}
+
 type EarthConf struct {
 	Latitude  float64
 	Longitude float64
@@ -110,6 +161,7 @@ type GeneralEmailConf struct {
 type GeneralConf struct {
 	Email   GeneralEmailConf
 	Scripts string
+	Stagger Duration // delay between rf commands fanned out to several devices
 }
 
 type GooglehomeConf struct {
@@ -125,9 +177,41 @@ type GraphiteConf struct {
 
 type ScheduleConf map[string][]map[string]float64
 
+type HysteresisConf struct {
+	On  float64 // switch on below target - on
+	Off float64 // switch off at target + off
+}
+
 type ZoneConf struct {
-	Sensor   string
-	Schedule ScheduleConf
+	Sensor     string
+	Schedule   ScheduleConf
+	Profiles   map[string]ScheduleConf // alternative named schedules
+	Hysteresis *HysteresisConf         // defaults to switching off at target + slop
+	Window     string                  // window/door contact device
+	Fallback   FallbackConf
+	Heaters    []string // zone heat devices, instead of the boiler
+	Valves     []string // zone valves, opened with the boiler
+	Trvs       []string // trvs set to the zone target
+}
+
+type FallbackConf struct {
+	Sensor string  // second sensor used while the zone sensor is stale
+	Mode   string  // otherwise: duty (fixed duty cycle) or trv (hold the trv at target, within a duty cycle)
+	Duty   float64 // duty cycle 0-1, defaults to that learnt (trv: 0.5 if not)
+}
+
+type WindowConf struct {
+	Drop    float64  // temperature drop (°C/min) to detect an open window, 0 disables
+	Suspend Duration // time to suspend heating the zone for (default 30m)
+	Alert   string   // alert target
+}
+
+type CompensationConf struct {
+	Reference float64  // outside temperature the schedule targets are for
+	Factor    float64  // target increase per °C outside is below reference
+	Max       float64  // maximum adjustment +/- (°C), 0 for no limit
+	Summer    *float64 // outside temperature above which heating is off
+	Frost     *float64 // outside temperature below which an empty house is kept at minimum
 }
 
 type HeatingConf struct {
@@ -136,6 +220,19 @@ type HeatingConf struct {
 	Slop       float64
 	Minimum    float64
 	Unoccupied float64
+	Preheat    Duration // maximum lead to start heating early, 0 disables
+	Min_On     Duration // minimum boiler on time
+	Min_Off    Duration // minimum boiler off time
+	Window     WindowConf
+	Weather    CompensationConf
+}
+
+// IntentConf is a custom voice and chat command, see lib/intent.
+type IntentConf struct {
+	Name     string
+	Patterns []string // regexps matched against the lowercased text, with {slot}s
+	Query    string   // query sent, with {slot}s substituted
+	Priority int      // higher matches first
 }
 
 type IrrigationConf struct {
@@ -174,6 +271,23 @@ type ProcessConf struct {
 	Path string
 }
 
+type SceneCommandConf struct {
+	Device  string
+	Command string
+	Fields  map[string]interface{} `yaml:",inline"`
+}
+
+type SceneConf struct {
+	Name     string
+	Group    string
+	Location string
+	Restore  bool
+	Timeout  Duration
+	Commands []SceneCommandConf
+}
+
+type ScenesConf map[string]SceneConf
+
 type SMSConf struct {
 	Device    string
 	Telephone string
@@ -201,6 +315,8 @@ type TelegramConf struct {
 	Chat_id int64
 }
 
+// VoiceConf maps voice regexps to queries, with $1 expansions. Matched before
+// the built in intents.
 type VoiceConf map[string]string
 
 type WeatherConf struct {
@@ -229,23 +345,27 @@ type Config struct {
 	// yaml fields
 	Devices      map[string]DeviceConf
 	Endpoints    EndpointsConf
+	Api          ApiConf
 	Bill         BillConf
 	Camera       CameraConf
 	Caps         CapsConf
 	Currentcost  CurrentcostConf
 	Datalogger   DataloggerConf
+	Devicestate  DevicestateConf
 	Earth        EarthConf
 	Espeak       EspeakConf
 	General      GeneralConf
 	Googlehome   GooglehomeConf
 	Graphite     GraphiteConf
 	Heating      HeatingConf
+	Intents      []IntentConf
 	Irrigation   IrrigationConf
 	Jabber       JabberConf
 	Orvibo       OrviboConf
 	Presence     PresenceConf
 	Pushbullet   PushbulletConf
 	Rfid         RfidConf
+	Scenes       ScenesConf
 	Slack        SlackConf
 	SMS          SMSConf
 	Telegram     TelegramConf
@@ -356,6 +476,38 @@ func OpenRaw(data []byte) (*Config, error) {
 		}
 	}
 
+	if len(config.Scenes) > 0 && config.Devices == nil {
+		config.Devices = map[string]DeviceConf{}
+	}
+	for name, scene := range config.Scenes {
+		// scenes are devices too, so they can be controlled like any other
+		id := "scene." + name
+		if _, ok := config.Devices[id]; ok {
+			continue
+		}
+		device := DeviceConf{
+			Id:       id,
+			Name:     scene.Name,
+			Group:    scene.Group,
+			Location: scene.Location,
+			Caps:     []string{"scene"},
+		}
+		if device.Name == "" {
+			device.Name = strings.Title(name)
+		}
+		if device.Group == "" {
+			device.Group = "scenes"
+		}
+		if scene.Restore {
+			device.Caps = append(device.Caps, "reversible")
+		}
+		device.Cap = map[string]bool{}
+		for _, c := range device.Caps {
+			device.Cap[c] = true
+		}
+		config.Devices[id] = device
+	}
+
 	return config, nil
 }
 
@@ -382,6 +534,26 @@ func (self *Config) LookupDeviceProtocol(device string, protocol string) (string
 	return "", false
 }
 
+// DeviceProtocol returns the protocol a device is controlled by: its
+// source's, or for a thermostat.X without a source, that of trv.X, which its
+// targets are sent to.
+func (self *Config) DeviceProtocol(device string) string {
+	if protocol := self.Devices[device].Protocol(); protocol != "" {
+		return protocol
+	}
+	if strings.HasPrefix(device, "thermostat.") {
+		return self.Devices["trv."+device[len("thermostat."):]].Protocol()
+	}
+	return ""
+}
+
+// Reconciled returns the devicestate conf of the device's protocol, and true
+// if devicestate re-issues the device's desired state.
+func (self *Config) Reconciled(device string) (DevicestateProtocolConf, bool) {
+	conf, ok := self.Devicestate.Protocols[self.DeviceProtocol(device)]
+	return conf, ok && conf.Reconcile.Duration > 0
+}
+
 func (self *Config) DevicesByProtocol(protocol string) []DeviceConf {
 	var ret []DeviceConf
 	protocol += "."
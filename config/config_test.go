@@ -71,3 +71,107 @@ func ExampleDevicesByProtocol() {
 	// Output:
 	// light.kitchen
 }
+
+func ExampleOpenRaw_scenes() {
+	scene := ExampleConfig.Scenes["movie"]
+	fmt.Println(scene.Commands[0].Device, scene.Commands[0].Command, scene.Commands[0].Fields)
+	device := ExampleConfig.Devices["scene.movie"]
+	fmt.Println(device.Name, device.Group, device.Caps)
+	// Output:
+	// light.glowworm on map[level:20]
+	// Movie scenes [scene reversible]
+}
+
+var heatingYml = `# heating
+heating:
+  device: heater.boiler
+  zones:
+    hallway:
+      sensor: temp.hallway
+      # weekends only
+      schedule:
+        Saturday,Sunday:
+        - '9:00': 15.5
+        - '22:30': 10
+    # the living room
+    living:
+      sensor: temp.living
+  minimum: 10
+weather:
+  windy: 3.2
+`
+
+func ExampleReplaceKey() {
+	schedule := ScheduleConf{"All": {{"8:00": 18}}}
+	out, _ := ReplaceKey([]byte(heatingYml), []string{"heating", "zones", "hallway", "schedule"}, schedule)
+	fmt.Print(string(out))
+	// Output:
+	// # heating
+	// heating:
+	//   device: heater.boiler
+	//   zones:
+	//     hallway:
+	//       sensor: temp.hallway
+	//       # weekends only
+	//       schedule:
+	//         All:
+	//         - "8:00": 18
+	//     # the living room
+	//     living:
+	//       sensor: temp.living
+	//   minimum: 10
+	// weather:
+	//   windy: 3.2
+}
+
+func ExampleReplaceKey_insert() {
+	schedule := ScheduleConf{"All": {{"8:00": 18}}}
+	out, _ := ReplaceKey([]byte(heatingYml), []string{"heating", "zones", "living", "schedule"}, schedule)
+	fmt.Print(string(out))
+	_, err := ReplaceKey([]byte(heatingYml), []string{"heating", "zones", "office", "schedule"}, schedule)
+	fmt.Println(err)
+	// Output:
+	// # heating
+	// heating:
+	//   device: heater.boiler
+	//   zones:
+	//     hallway:
+	//       sensor: temp.hallway
+	//       # weekends only
+	//       schedule:
+	//         Saturday,Sunday:
+	//         - '9:00': 15.5
+	//         - '22:30': 10
+	//     # the living room
+	//     living:
+	//       sensor: temp.living
+	//       schedule:
+	//         All:
+	//         - "8:00": 18
+	//   minimum: 10
+	// weather:
+	//   windy: 3.2
+	// heating.zones.office not found
+}
+
+func ExampleReplaceKey_unsupported() {
+	schedule := ScheduleConf{"All": {{"8:00": 18}}}
+	path := []string{"heating", "zones", "living", "schedule"}
+	for _, doc := range []string{
+		// flow mapping
+		"heating:\n  zones:\n    living: {sensor: temp.living}\n",
+		"heating: {zones: {living: {}}}\n",
+		// alias
+		"base: &base\n  sensor: temp.living\nheating:\n  zones:\n    living: *base\n",
+		// tab indented
+		"heating:\n\tzones:\n\t\tliving:\n",
+	} {
+		_, err := ReplaceKey([]byte(doc), path, schedule)
+		fmt.Println(err)
+	}
+	// Output:
+	// heating.zones.living is not a block mapping
+	// heating is not a block mapping
+	// heating.zones.living is not a block mapping
+	// heating.zones not found
+}
@@ -0,0 +1,172 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+var reYamlKey = regexp.MustCompile(`^(['"]?)(.*?)['"]?\s*:(\s|$)`)
+
+func yamlIndent(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+func yamlContent(line string) bool {
+	s := strings.TrimSpace(line)
+	return s != "" && !strings.HasPrefix(s, "#")
+}
+
+func yamlKey(line string) string {
+	if m := reYamlKey.FindStringSubmatch(strings.TrimSpace(line)); m != nil {
+		return m[2]
+	}
+	return ""
+}
+
+// yamlBlockEnd returns the end of the value of the key at line i, excluding
+// any trailing blank lines or comments (which belong to what follows).
+func yamlBlockEnd(lines []string, i, end int) int {
+	indent := yamlIndent(lines[i])
+	j := i + 1
+	last := j
+	for ; j < end; j++ {
+		if !yamlContent(lines[j]) {
+			continue
+		}
+		in := yamlIndent(lines[j])
+		// block sequences may be indented at the same level as their key
+		if in < indent || in == indent && !strings.HasPrefix(strings.TrimSpace(lines[j]), "-") {
+			break
+		}
+		last = j + 1
+	}
+	return last
+}
+
+// yamlInline is whether the key at line has its value on the same line (eg
+// a flow mapping "zone: {}"), rather than in an indented block.
+func yamlInline(line string) bool {
+	m := reYamlKey.FindStringSubmatch(strings.TrimSpace(line))
+	rest := strings.TrimSpace(strings.TrimSpace(line)[len(m[0]):])
+	return rest != "" && !strings.HasPrefix(rest, "#")
+}
+
+// ReplaceKey replaces the value at a path of mapping keys in a yaml document,
+// preserving the rest of the document, including comments, as is. The last
+// key is added if it does not exist, but its parents must.
+//
+// This is a line-based editor, rather than a yaml round-trip (which would
+// lose the comments), so only supports a subset of yaml: the parents must be
+// block mappings with a key per line, indented with spaces, and the document
+// must not use anchors, multi-line keys or several documents. Anything else
+// is an error, checked by parsing the result and comparing the value at the
+// path.
+func ReplaceKey(data []byte, path []string, value interface{}) ([]byte, error) {
+	out, err := replaceKey(data, path, value)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkKey(out, path, value); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// checkKey checks the value at path in data is value.
+func checkKey(data []byte, path []string, value interface{}) error {
+	var doc interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("unsupported yaml: %s", err)
+	}
+	for _, key := range path {
+		m, ok := doc.(map[interface{}]interface{})
+		if !ok {
+			return fmt.Errorf("unsupported yaml: %s not replaced", strings.Join(path, "."))
+		}
+		doc = m[key]
+	}
+	// compare the yaml of both, as numbers etc. decode differently
+	expected, err := yaml.Marshal(value)
+	if err != nil {
+		return err
+	}
+	actual, err := yaml.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	if string(expected) != string(actual) {
+		return fmt.Errorf("unsupported yaml: %s not replaced", strings.Join(path, "."))
+	}
+	return nil
+}
+
+func replaceKey(data []byte, path []string, value interface{}) ([]byte, error) {
+	lines := strings.Split(string(data), "\n")
+	start, end := 0, len(lines)
+	indent := -1 // of the parent
+	for n, key := range path {
+		// children are at the indent of the first content line
+		child := -1
+		found := -1
+		for i := start; i < end; i++ {
+			if !yamlContent(lines[i]) {
+				continue
+			}
+			in := yamlIndent(lines[i])
+			if child == -1 {
+				if in <= indent {
+					break
+				}
+				child = in
+			}
+			if in == child && yamlKey(lines[i]) == key {
+				found = i
+				break
+			}
+		}
+
+		if found != -1 && n < len(path)-1 && yamlInline(lines[found]) {
+			return nil, fmt.Errorf("%s is not a block mapping", strings.Join(path[:n+1], "."))
+		}
+		if found == -1 {
+			if n < len(path)-1 {
+				return nil, fmt.Errorf("%s not found", strings.Join(path[:n+1], "."))
+			}
+			// insert at the end of the parent
+			if child == -1 {
+				child = indent + 2
+			}
+			if start > 0 {
+				end = yamlBlockEnd(lines, start-1, end)
+			}
+			return spliceYaml(lines, end, end, child, key, value)
+		}
+		if n == len(path)-1 {
+			return spliceYaml(lines, found, yamlBlockEnd(lines, found, end), child, key, value)
+		}
+		indent = child
+		end = yamlBlockEnd(lines, found, end)
+		start = found + 1
+	}
+	return nil, fmt.Errorf("empty path")
+}
+
+func spliceYaml(lines []string, from, to, indent int, key string, value interface{}) ([]byte, error) {
+	out, err := yaml.Marshal(map[string]interface{}{key: value})
+	if err != nil {
+		return nil, err
+	}
+	var block []string
+	prefix := strings.Repeat(" ", indent)
+	for _, line := range strings.Split(strings.TrimRight(string(out), "\n"), "\n") {
+		block = append(block, prefix+line)
+	}
+	var ret []string
+	ret = append(ret, lines[:from]...)
+	ret = append(ret, block...)
+	ret = append(ret, lines[to:]...)
+	return []byte(strings.Join(ret, "\n")), nil
+}
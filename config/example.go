@@ -92,6 +92,16 @@ irrigation:
 jabber:
   jid: myjabberid@gmail.com/gohome
   pass: password
+scenes:
+  movie:
+    name: Movie
+    restore: true
+    commands:
+    - device: light.glowworm
+      command: on
+      level: 20
+    - device: light.kitchen
+      command: off
 sms:
   telephone: '+441234567890'
 twitter:
@@ -119,7 +129,7 @@ watchdog:
     temp.outside: 20m
     wind.outside: 20m
 weather:
-  outside:
+  sensors:
     rain: rain.outside
     temp: temp.garden
     wind: wind.outside
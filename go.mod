@@ -1,6 +1,6 @@
 module github.com/barnybug/gohome
 
-go 1.13
+go 1.16
 
 require (
 	github.com/Knetic/govaluate v3.0.0+incompatible
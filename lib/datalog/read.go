@@ -0,0 +1,251 @@
+// Package datalog reads the events logged by the datalogger service: one
+// event per line, appended to data.log (rotated to data.log.1) under a
+// directory per topic.
+//
+// Reads are bounded by time, and each log is bisected to the start of the
+// range, so only the events queried are parsed, and streamed rather than
+// held in memory.
+package datalog
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/barnybug/gohome/pubsub"
+)
+
+// Log files of a topic, oldest first.
+var logFiles = []string{"data.log.1", "data.log"}
+
+// Bisecting stops within this many bytes of the start of the range.
+const seekGranularity = 64 * 1024
+
+// Longest event line read.
+const maxLine = 1024 * 1024
+
+// Query for logged events, on the given topics, between From (inclusive) and
+// To. Empty Device matches all.
+type Query struct {
+	Topics []string
+	Device string
+	From   time.Time
+	To     time.Time
+}
+
+func (self Query) validate() error {
+	if len(self.Topics) == 0 {
+		return errors.New("topic required")
+	}
+	for _, topic := range self.Topics {
+		if topic == "" || strings.Contains(topic, "/") || strings.HasPrefix(topic, ".") {
+			return fmt.Errorf("invalid topic: %s", topic)
+		}
+	}
+	if self.From.IsZero() || self.To.IsZero() {
+		return errors.New("from and to required")
+	}
+	if !self.From.Before(self.To) {
+		return errors.New("from must be before to")
+	}
+	return nil
+}
+
+func (self Query) match(ev *pubsub.Event) bool {
+	if self.Device != "" && ev.Device() != self.Device {
+		return false
+	}
+	return !ev.Timestamp.Before(self.From) && ev.Timestamp.Before(self.To)
+}
+
+// lineTime returns the timestamp of the first whole line starting after
+// offset (or at it, for the start of the file).
+func lineTime(file *os.File, offset int64) (time.Time, bool) {
+	buf := make([]byte, seekGranularity)
+	n, err := file.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return time.Time{}, false
+	}
+	buf = buf[:n]
+	if offset > 0 {
+		i := bytes.IndexByte(buf, '\n')
+		if i == -1 {
+			return time.Time{}, false
+		}
+		buf = buf[i+1:]
+	}
+	if i := bytes.IndexByte(buf, '\n'); i != -1 {
+		buf = buf[:i]
+	}
+	ev := pubsub.Parse(string(buf), "")
+	if ev == nil {
+		return time.Time{}, false
+	}
+	return ev.Timestamp, true
+}
+
+// seek positions the file at the start of a line shortly before the first
+// event at or after from, by bisecting on the timestamps of the lines.
+func seek(file *os.File, size int64, from time.Time) error {
+	lo, hi := int64(0), size
+	for hi-lo > seekGranularity {
+		mid := (lo + hi) / 2
+		if at, ok := lineTime(file, mid); ok && at.Before(from) {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	if lo > 0 {
+		// skip the partial line
+		buf := make([]byte, seekGranularity)
+		n, err := file.ReadAt(buf, lo)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if i := bytes.IndexByte(buf[:n], '\n'); i != -1 {
+			lo += int64(i + 1)
+		}
+	}
+	_, err := file.Seek(lo, io.SeekStart)
+	return err
+}
+
+// cursor reads a topic's logs in order.
+type cursor struct {
+	q       Query
+	files   []string // still to read
+	file    *os.File
+	scanner *bufio.Scanner
+	next    *pubsub.Event // next matching event, nil when done
+}
+
+func (self *cursor) open() error {
+	for len(self.files) > 0 {
+		p := self.files[0]
+		self.files = self.files[1:]
+		file, err := os.Open(p)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return err
+		}
+		if info.ModTime().Before(self.q.From) {
+			// last written before the range
+			file.Close()
+			continue
+		}
+		if err := seek(file, info.Size(), self.q.From); err != nil {
+			file.Close()
+			return err
+		}
+		self.file = file
+		self.scanner = bufio.NewScanner(file)
+		self.scanner.Buffer(make([]byte, 64*1024), maxLine)
+		return nil
+	}
+	return nil
+}
+
+func (self *cursor) close() {
+	if self.file != nil {
+		self.file.Close()
+		self.file, self.scanner = nil, nil
+	}
+}
+
+// advance to the next matching event.
+func (self *cursor) advance() error {
+	self.next = nil
+	device := []byte(self.q.Device)
+	for {
+		if self.scanner == nil {
+			if err := self.open(); err != nil {
+				return err
+			}
+			if self.scanner == nil {
+				return nil
+			}
+		}
+		for self.scanner.Scan() {
+			line := self.scanner.Bytes()
+			if !bytes.Contains(line, device) {
+				// cheaply skip other devices' events
+				continue
+			}
+			ev := pubsub.Parse(string(line), "")
+			if ev == nil {
+				continue
+			}
+			if !ev.Timestamp.Before(self.q.To) {
+				// logs are in time order, so done
+				self.close()
+				self.files = nil
+				return nil
+			}
+			if self.q.match(ev) {
+				self.next = ev
+				return nil
+			}
+		}
+		err := self.scanner.Err()
+		self.close()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Read calls fn with the events logged under dir matching the query, in time
+// order, until fn returns false.
+func Read(dir string, q Query, fn func(ev *pubsub.Event) bool) error {
+	if err := q.validate(); err != nil {
+		return err
+	}
+	var cursors []*cursor
+	defer func() {
+		for _, c := range cursors {
+			c.close()
+		}
+	}()
+	for _, topic := range q.Topics {
+		c := &cursor{q: q}
+		for _, name := range logFiles {
+			c.files = append(c.files, path.Join(dir, topic, name))
+		}
+		cursors = append(cursors, c)
+		if err := c.advance(); err != nil {
+			return err
+		}
+	}
+
+	for {
+		// merge the topics by time
+		var first *cursor
+		for _, c := range cursors {
+			if c.next != nil && (first == nil || c.next.Timestamp.Before(first.next.Timestamp)) {
+				first = c
+			}
+		}
+		if first == nil {
+			return nil
+		}
+		if !fn(first.next) {
+			return nil
+		}
+		if err := first.advance(); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package datalog
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/barnybug/gohome/pubsub"
+)
+
+var start = time.Date(2014, 1, 4, 0, 0, 0, 0, time.UTC)
+
+// writeLog writes an event a minute for each device, from start.
+func writeLog(t *testing.T, dir, topic, name string, from, n int, devices ...string) {
+	os.MkdirAll(path.Join(dir, topic), 0755)
+	var lines []string
+	for i := from; i < from+n; i++ {
+		for _, device := range devices {
+			at := start.Add(time.Duration(i) * time.Minute).Format("2006-01-02 15:04:05.000")
+			lines = append(lines, fmt.Sprintf(`{"topic":"%s","device":"%s","value":%d,"timestamp":"%s"}`, topic, device, i, at))
+		}
+	}
+	err := ioutil.WriteFile(path.Join(dir, topic, name), []byte(strings.Join(lines, "\n")+"\n"), 0644)
+	require.NoError(t, err)
+}
+
+func readAll(t *testing.T, dir string, q Query) []*pubsub.Event {
+	var evs []*pubsub.Event
+	err := Read(dir, q, func(ev *pubsub.Event) bool {
+		evs = append(evs, ev)
+		return true
+	})
+	require.NoError(t, err)
+	return evs
+}
+
+func TestRead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "datalog")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	// large enough to bisect
+	writeLog(t, dir, "temp", "data.log.1", 0, 5000, "temp.hallway", "temp.living")
+	writeLog(t, dir, "temp", "data.log", 5000, 5000, "temp.hallway", "temp.living")
+	writeLog(t, dir, "humidity", "data.log", 0, 10000, "temp.hallway")
+
+	q := Query{
+		Topics: []string{"temp", "humidity"},
+		Device: "temp.hallway",
+		From:   start.Add(4990 * time.Minute),
+		To:     start.Add(5010 * time.Minute),
+	}
+	evs := readAll(t, dir, q)
+	require.Equal(t, 40, len(evs))
+	for i, ev := range evs {
+		assert.Equal(t, "temp.hallway", ev.Device())
+		assert.Equal(t, start.Add(time.Duration(4990+i/2)*time.Minute), ev.Timestamp)
+	}
+	// spans the rotated log
+	assert.Equal(t, 4990.0, evs[0].Fields["value"])
+	assert.Equal(t, 5009.0, evs[39].Fields["value"])
+
+	// stops when asked
+	n := 0
+	err = Read(dir, q, func(ev *pubsub.Event) bool {
+		n++
+		return n < 5
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 5, n)
+
+	// missing topic
+	q.Topics = []string{"power"}
+	assert.Empty(t, readAll(t, dir, q))
+}
+
+func TestReadInvalid(t *testing.T) {
+	to := start.Add(time.Hour)
+	for _, q := range []Query{
+		{From: start, To: to},
+		{Topics: []string{"../etc"}, From: start, To: to},
+		{Topics: []string{".hidden"}, From: start, To: to},
+		{Topics: []string{"temp"}, To: to},
+		{Topics: []string{"temp"}, From: to, To: start},
+	} {
+		err := Read("/unused", q, func(ev *pubsub.Event) bool { return true })
+		assert.Error(t, err, "%+v", q)
+	}
+}
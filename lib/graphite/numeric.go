@@ -0,0 +1,71 @@
+package graphite
+
+import (
+	"github.com/barnybug/gohome/pubsub"
+)
+
+var ignoredFields = map[string]bool{
+	"topic":     true,
+	"timestamp": true,
+	"source":    true,
+	"sensor":    true,
+	"origin":    true,
+	"device":    true,
+	"repeat":    true,
+}
+
+// NumericValue converts a field value to a float: numbers, bools and on/off
+// strings. Other values are not numeric.
+func NumericValue(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	case int:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case int8:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	case string:
+		if v == "off" {
+			return 0, true
+		} else if v == "on" {
+			return 1, true
+		}
+	}
+	return 0, false
+}
+
+// NumericFields returns the event's numeric fields, excluding the metadata
+// fields (device, source, etc).
+func NumericFields(ev *pubsub.Event) map[string]float64 {
+	ret := map[string]float64{}
+	for field, value := range ev.Fields {
+		if ignoredFields[field] {
+			continue
+		}
+		if f, ok := NumericValue(value); ok {
+			ret[field] = f
+		}
+	}
+	return ret
+}
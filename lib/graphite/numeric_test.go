@@ -0,0 +1,21 @@
+package graphite
+
+import (
+	"fmt"
+
+	"github.com/barnybug/gohome/pubsub"
+)
+
+func ExampleNumericFields() {
+	ev := pubsub.NewEvent("temp", pubsub.Fields{
+		"device":  "temp.hallway",
+		"source":  "ff01",
+		"temp":    20.5,
+		"battery": 3,
+		"low":     false,
+		"state":   "on",
+		"name":    "Hallway",
+	})
+	fmt.Println(NumericFields(ev))
+	// Output: map[battery:3 low:0 state:1 temp:20.5]
+}
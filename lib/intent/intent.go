@@ -0,0 +1,300 @@
+// Package intent matches free text, from voice assistants and chat bots, to
+// gohome queries.
+//
+// An intent has patterns: regular expressions matched against the whole of
+// the normalised text (lowercase, punctuation removed), with {slot}
+// placeholders resolved against the config:
+//
+//	{target} - a controllable device, group, location or type, by id, name or alias
+//	{device} - any device, by id, name or alias
+//	{zone}   - a heating zone, by name or its thermostat or sensor's name or location
+//	{sensor} - a temperature sensor, by name, alias, location or heating zone
+//	{state}  - on or off
+//	{number} - a number
+//	{text}   - any text (as is any other slot name)
+//
+// Names are matched fuzzily, so "kitchen lights" or "glowworm" still
+// resolve, though a {target} matching several devices equally doesn't. Where several intents match, the highest priority wins, then the
+// best scoring, then custom intents over built in ones, then the first
+// declared, so matching is deterministic.
+package intent
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/barnybug/gohome/config"
+)
+
+// Minimum similarity of text to a name for a slot to resolve.
+const Threshold = 0.75
+
+// Slots switching devices, where a tie between names isn't resolved, as it
+// could switch the wrong device.
+var unambiguous = map[string]bool{"target": true}
+
+// Penalty for resolving a slot with a "light(s)" or "lamp(s)" suffix dropped.
+const suffixPenalty = 0.95
+
+// Intent maps text patterns to a query.
+type Intent struct {
+	Name     string
+	Patterns []string
+	Query    string // query sent, with {slot}s substituted
+	Priority int    // higher matches first
+	// Regex patterns are plain regexps matched against the original text,
+	// with $1 expansions in Query (the voice config).
+	Regex   bool
+	Builtin bool
+}
+
+// Builtin intents.
+var Builtin = []Intent{
+	{
+		Name: "switch",
+		Patterns: []string{
+			`(switch|turn|put) {state} (the )?{target}`,
+			`(switch|turn|put) (the )?{target} {state}`,
+			`{target} {state}`,
+		},
+		Query: "switch {target} {state}",
+	},
+	{
+		Name: "heating",
+		Patterns: []string{
+			`set (the )?heating (in|for) (the )?{zone} to {number}` + degrees,
+			`set (the )?{zone} (heating )?to {number}` + degrees,
+			`(heat|warm) (up )?(the )?{zone} to {number}` + degrees,
+		},
+		Query: "heating/party {zone} {number}",
+	},
+	{
+		Name: "heating all",
+		Patterns: []string{
+			`set (the )?heating to {number}` + degrees,
+		},
+		Query: "heating/party all {number}",
+	},
+	{
+		Name: "temperature",
+		Patterns: []string{
+			`(whats|what is) the (temp|temperature) (in|of) (the )?{sensor}`,
+			`how (warm|cold|hot) is (it in )?(the )?{sensor}`,
+			`(whats|what is) (the )?{sensor} (temp|temperature)`,
+			`{sensor} (temp|temperature)`,
+		},
+		Query: "api/temperature {sensor}",
+	},
+	{
+		Name: "presence",
+		Patterns: []string{
+			`is (anyone|any one|anybody|someone|somebody) (at )?home`,
+			`(whos|who is) (at )?home`,
+		},
+		Query: "api/presence",
+	},
+}
+
+const degrees = `( degrees?)?( c| celsius)?`
+
+// Match is an intent matched.
+type Match struct {
+	Intent string
+	Query  string
+	Slots  map[string]string
+	Score  float64
+
+	priority int
+	builtin  bool
+	order    int
+}
+
+type pattern struct {
+	re    *regexp.Regexp
+	order int
+}
+
+type compiled struct {
+	Intent
+	patterns []pattern
+}
+
+// Matcher matches text against intents.
+type Matcher struct {
+	intents []compiled
+	tables  map[string]table
+}
+
+var reSlot = regexp.MustCompile(`\{(\w+)\}`)
+
+func slotRegexp(name string) string {
+	switch name {
+	case "state":
+		return `(?P<state>on|off)`
+	case "number":
+		return `(?P<number>-?\d+(?:\.\d+)?)`
+	}
+	return fmt.Sprintf(`(?P<%s>.+?)`, name)
+}
+
+func compilePattern(p string) (*regexp.Regexp, error) {
+	p = reSlot.ReplaceAllStringFunc(strings.ToLower(p), func(s string) string {
+		return slotRegexp(s[1 : len(s)-1])
+	})
+	return regexp.Compile("^" + p + "$")
+}
+
+// New creates a matcher for the config's custom intents, then the voice
+// config, then the built in intents.
+func New(conf *config.Config) (*Matcher, error) {
+	intents := []Intent{}
+	for _, ic := range conf.Intents {
+		intents = append(intents, Intent{Name: ic.Name, Patterns: ic.Patterns, Query: ic.Query, Priority: ic.Priority})
+	}
+	var keys []string
+	for key := range conf.Voice {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		intents = append(intents, Intent{Name: "voice", Patterns: []string{key}, Query: conf.Voice[key], Regex: true})
+	}
+	for _, in := range Builtin {
+		in.Builtin = true
+		intents = append(intents, in)
+	}
+
+	self := &Matcher{tables: buildTables(conf)}
+	order := 0
+	for _, in := range intents {
+		c := compiled{Intent: in}
+		for _, p := range in.Patterns {
+			var re *regexp.Regexp
+			var err error
+			if in.Regex {
+				re, err = regexp.Compile(p)
+			} else {
+				re, err = compilePattern(p)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("intent %s: %s", in.Name, err)
+			}
+			c.patterns = append(c.patterns, pattern{re, order})
+			order++
+		}
+		self.intents = append(self.intents, c)
+	}
+	return self, nil
+}
+
+// Match returns the best intent matching text, or nil if none.
+func (self *Matcher) Match(text string) *Match {
+	matches := self.MatchAll(text)
+	if len(matches) == 0 {
+		return nil
+	}
+	return matches[0]
+}
+
+// MatchAll returns all intents matching text, best first.
+func (self *Matcher) MatchAll(text string) []*Match {
+	norm := Normalise(text)
+	matches := []*Match{}
+	for _, in := range self.intents {
+		for _, p := range in.patterns {
+			var m *Match
+			if in.Regex {
+				m = matchRegex(in.Intent, p.re, strings.TrimSpace(text))
+			} else {
+				m = self.matchPattern(in.Intent, p.re, norm)
+			}
+			if m != nil {
+				m.order = p.order
+				matches = append(matches, m)
+			}
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		a, b := matches[i], matches[j]
+		if a.priority != b.priority {
+			return a.priority > b.priority
+		}
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		if a.builtin != b.builtin {
+			return !a.builtin
+		}
+		return a.order < b.order
+	})
+	return matches
+}
+
+func matchRegex(in Intent, re *regexp.Regexp, text string) *Match {
+	match := re.FindStringSubmatchIndex(text)
+	if match == nil {
+		return nil
+	}
+	query := string(re.ExpandString(nil, in.Query, text, match))
+	return &Match{Intent: in.Name, Query: query, Slots: map[string]string{}, Score: 1, priority: in.Priority, builtin: in.Builtin}
+}
+
+func (self *Matcher) matchPattern(in Intent, re *regexp.Regexp, text string) *Match {
+	values := re.FindStringSubmatch(text)
+	if values == nil {
+		return nil
+	}
+	slots := map[string]string{}
+	score := 1.0
+	for i, name := range re.SubexpNames() {
+		if name == "" {
+			continue
+		}
+		value := values[i]
+		if t, ok := self.tables[name]; ok {
+			resolved, s, ambiguous := t.resolve(value)
+			if resolved == "" || ambiguous && unambiguous[name] {
+				return nil
+			}
+			value = resolved
+			score *= s
+		}
+		slots[name] = value
+	}
+	query := reSlot.ReplaceAllStringFunc(in.Query, func(s string) string {
+		if value, ok := slots[s[1:len(s)-1]]; ok {
+			return value
+		}
+		return s
+	})
+	return &Match{Intent: in.Name, Query: query, Slots: slots, Score: score, priority: in.Priority, builtin: in.Builtin}
+}
+
+// Normalise lowercases text, dropping apostrophes ("what's" is "whats"),
+// punctuation and "please".
+func Normalise(text string) string {
+	rs := []rune(strings.ToLower(text))
+	var b strings.Builder
+	for i, r := range rs {
+		switch {
+		case r == '\'' || r == '’':
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			b.WriteRune(r)
+		case r == '.' && i > 0 && i+1 < len(rs) && unicode.IsDigit(rs[i-1]) && unicode.IsDigit(rs[i+1]):
+			// decimal point
+			b.WriteRune(r)
+		default:
+			b.WriteRune(' ')
+		}
+	}
+	words := []string{}
+	for _, word := range strings.Fields(b.String()) {
+		if word != "please" {
+			words = append(words, word)
+		}
+	}
+	return strings.Join(words, " ")
+}
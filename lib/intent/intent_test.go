@@ -0,0 +1,183 @@
+package intent
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/barnybug/gohome/config"
+)
+
+var testYaml = `
+devices:
+  light.kitchen:
+    group: downstairs
+    name: Kitchen
+    caps: [switch]
+  light.glowworm:
+    group: downstairs
+    name: Glowworm
+    caps: [light, dimmer]
+    aliases: [glow worm]
+  light.lounge:
+    name: Standard lamp
+    location: Living Room
+    caps: [light]
+  thermostat.living:
+    name: Living room thermostat
+    location: Living Room
+  temp.hallway:
+    name: Hallway
+  person.alice:
+    name: Alice
+    caps: [presence]
+heating:
+  zones:
+    living: {}
+    hallway:
+      sensor: temp.hallway
+scenes:
+  movie:
+    name: Movie night
+intents:
+- name: goodnight
+  patterns: ['good ?night']
+  query: script/goodnight
+- name: lights
+  patterns: ['{target} on full']
+  query: switch {target} on level=100
+  priority: 1
+voice:
+  'lights? on':
+    switch living on
+  'blanket (on|off)':
+    switch blanket $1
+`
+
+func testMatcher(t *testing.T) *Matcher {
+	conf := config.Must(config.OpenRaw([]byte(testYaml)))
+	m, err := New(conf)
+	require.NoError(t, err)
+	return m
+}
+
+func TestBuiltin(t *testing.T) {
+	m := testMatcher(t)
+	for text, query := range map[string]string{
+		"Switch on the kitchen light":                           "switch light.kitchen on",
+		"turn the glow worm off.":                               "switch light.glowworm off",
+		"Turn off the glowworm please":                          "switch light.glowworm off",
+		"turn on the kitchen lights":                            "switch light.kitchen on",
+		"switch off the downstairs lights":                      "switch group:downstairs off",
+		"turn off all the lights":                               "switch cap:light off",
+		"turn on the living room lights":                        "switch location:Living Room on",
+		"standard lamp off":                                     "switch light.lounge off",
+		"switch on movie night":                                 "switch scene.movie on",
+		"Set the heating in the living room to 21":              "heating/party living 21",
+		"set hallway heating to 19.5 degrees":                   "heating/party hallway 19.5",
+		"set the heating to 20°C":                               "heating/party all 20",
+		"What's the temperature in the hallway?":                "api/temperature temp.hallway",
+		"how warm is it in the living room":                     "api/temperature thermostat.living",
+		"what is the temperature of the living room thermostat": "api/temperature thermostat.living",
+		"Is anyone home?":                                       "api/presence",
+		"who's at home":                                         "api/presence",
+	} {
+		match := m.Match(text)
+		if assert.NotNil(t, match, text) {
+			assert.Equal(t, query, match.Query, text)
+		}
+	}
+}
+
+func TestNotUnderstood(t *testing.T) {
+	m := testMatcher(t)
+	for _, text := range []string{
+		"",
+		"make me a sandwich",
+		"switch on the toaster",
+		"what's the temperature in the garage",
+		"set the heating in the attic to 20",
+	} {
+		assert.Nil(t, m.Match(text), text)
+	}
+}
+
+func TestCustom(t *testing.T) {
+	m := testMatcher(t)
+	match := m.Match("Goodnight!")
+	require.NotNil(t, match)
+	assert.Equal(t, "goodnight", match.Intent)
+	assert.Equal(t, "script/goodnight", match.Query)
+
+	// voice config, matched against the original text
+	match = m.Match("blanket off")
+	require.NotNil(t, match)
+	assert.Equal(t, "voice", match.Intent)
+	assert.Equal(t, "switch blanket off", match.Query)
+
+	// priority over the builtin
+	match = m.Match("kitchen on full")
+	require.NotNil(t, match)
+	assert.Equal(t, "lights", match.Intent)
+	assert.Equal(t, "switch light.kitchen on level=100", match.Query)
+	assert.Equal(t, map[string]string{"target": "light.kitchen"}, match.Slots)
+}
+
+func TestPriorities(t *testing.T) {
+	m := testMatcher(t)
+	// "lights on" matches both the voice config and the builtin switch
+	// intent: custom wins on an equal score
+	matches := m.MatchAll("lights on")
+	require.Equal(t, 2, len(matches))
+	assert.Equal(t, "voice", matches[0].Intent)
+	assert.Equal(t, "switch", matches[1].Intent)
+	assert.Equal(t, "switch cap:light on", matches[1].Query)
+
+	// deterministic
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, "switch living on", m.Match("lights on").Query)
+	}
+}
+
+func TestAmbiguous(t *testing.T) {
+	conf := config.Must(config.OpenRaw([]byte(`
+devices:
+  light.desk:
+    name: Desk lamp
+    caps: [light]
+  light.dresser:
+    name: Desk lamb
+    caps: [light]
+`)))
+	m, err := New(conf)
+	require.NoError(t, err)
+	// equally similar to both
+	assert.Nil(t, m.Match("desk lamx on"))
+	match := m.Match("desk lamp on")
+	require.NotNil(t, match)
+	assert.Equal(t, "switch light.desk on", match.Query)
+}
+
+func TestInvalidPattern(t *testing.T) {
+	conf := &config.Config{Intents: []config.IntentConf{{Name: "bad", Patterns: []string{"(unclosed"}}}}
+	_, err := New(conf)
+	assert.Error(t, err)
+}
+
+func ExampleNormalise() {
+	fmt.Println(Normalise("What's the temperature in the Living-Room, please?"))
+	fmt.Println(Normalise("Set it to 20.5°C."))
+	// Output:
+	// whats the temperature in the living room
+	// set it to 20.5 c
+}
+
+func ExampleSimilarity() {
+	fmt.Printf("%.2f\n", Similarity("glowworm", "glow worm"))
+	fmt.Printf("%.2f\n", Similarity("kitchen", "kitten"))
+	// Output:
+	// 0.89
+	// 0.71
+}
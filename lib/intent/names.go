@@ -0,0 +1,211 @@
+package intent
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/barnybug/gohome/config"
+)
+
+// candidate is a name a slot value resolves by.
+type candidate struct {
+	phrase string
+	value  string
+	rank   int // lower is preferred on equal scores
+}
+
+type table []candidate
+
+func (self *table) add(value string, rank int, phrases ...string) {
+	for _, phrase := range phrases {
+		if phrase = Normalise(phrase); phrase != "" {
+			*self = append(*self, candidate{phrase, value, rank})
+		}
+	}
+}
+
+var articles = []string{"all of the ", "all the ", "all ", "the ", "my "}
+
+var suffixes = []string{" lights", " light", " lamps", " lamp"}
+
+// variants of the text to resolve, with their score multiplier.
+func variants(text string) map[string]float64 {
+	for _, article := range articles {
+		if strings.HasPrefix(text, article) {
+			text = text[len(article):]
+			break
+		}
+	}
+	ret := map[string]float64{text: 1}
+	for _, suffix := range suffixes {
+		if trimmed := strings.TrimSuffix(text, suffix); trimmed != text && trimmed != "" {
+			ret[trimmed] = suffixPenalty
+		}
+	}
+	return ret
+}
+
+// resolve returns the value best matching text and its score, or "" if
+// none is similar enough. ambiguous is true if another value, of the same
+// rank, matches equally well.
+func (self table) resolve(text string) (value string, score float64, ambiguous bool) {
+	var best *candidate
+	bestScore := 0.0
+	for variant, multiplier := range variants(text) {
+		for i := range self {
+			c := &self[i]
+			score := Similarity(variant, c.phrase) * multiplier
+			if score < Threshold {
+				continue
+			}
+			switch {
+			case best == nil || score > bestScore || score == bestScore && c.rank < best.rank:
+				best, bestScore, ambiguous = c, score, false
+			case score == bestScore && c.rank == best.rank && c.value != best.value:
+				ambiguous = true
+				if c.value < best.value {
+					best = c
+				}
+			}
+		}
+	}
+	if best == nil {
+		return "", 0, false
+	}
+	return best.value, bestScore, ambiguous
+}
+
+// Similarity of a and b from 0 (nothing in common) to 1 (equal), by edit
+// distance.
+func Similarity(a, b string) float64 {
+	ra, rb := []rune(a), []rune(b)
+	n := len(ra)
+	if len(rb) > n {
+		n = len(rb)
+	}
+	if n == 0 {
+		return 1
+	}
+	return 1 - float64(levenshtein(ra, rb))/float64(n)
+}
+
+func levenshtein(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
+
+func min(vs ...int) int {
+	m := vs[0]
+	for _, v := range vs[1:] {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
+
+// devicePhrases are the names a device is known by: id, name and aliases,
+// with and without its type ("kitchen light").
+func devicePhrases(dev config.DeviceConf) []string {
+	prefix, minor := dev.Prefix(), dev.Minor()
+	phrases := []string{dev.Id, minor, minor + " " + prefix}
+	if dev.Name != "" {
+		phrases = append(phrases, dev.Name)
+		if !strings.HasSuffix(strings.ToLower(dev.Name), prefix) {
+			phrases = append(phrases, dev.Name+" "+prefix)
+		}
+	}
+	return append(phrases, dev.Aliases...)
+}
+
+func isSensor(dev config.DeviceConf) bool {
+	return dev.Cap["temp"] || dev.Cap["thermostat"] || dev.Prefix() == "temp" || dev.Prefix() == "thermostat"
+}
+
+// zoneSensor is the device with the zone's temperature.
+func zoneSensor(zone string, zc config.ZoneConf) string {
+	if zc.Sensor != "" {
+		return zc.Sensor
+	}
+	return "thermostat." + zone
+}
+
+func buildTables(conf *config.Config) map[string]table {
+	var devices, targets, zones, sensors table
+
+	var ids []string
+	for id := range conf.Devices {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	groups := map[string]bool{}
+	locations := map[string]bool{}
+	caps := map[string]bool{}
+	for _, id := range ids {
+		dev := conf.Devices[id]
+		phrases := devicePhrases(dev)
+		devices.add(id, 0, phrases...)
+		if dev.IsControllable() || dev.Cap["scene"] {
+			targets.add(id, 0, phrases...)
+		}
+		if dev.IsControllable() {
+			if dev.Group != "" {
+				groups[dev.Group] = true
+			}
+			if dev.Location != "" {
+				locations[dev.Location] = true
+			}
+			caps[dev.Prefix()] = true
+			for cap := range dev.Cap {
+				caps[cap] = true
+			}
+		}
+		if isSensor(dev) {
+			sensors.add(id, 0, phrases...)
+			sensors.add(id, 1, dev.Location)
+		}
+	}
+	for group := range groups {
+		targets.add("group:"+group, 1, group)
+	}
+	for location := range locations {
+		targets.add("location:"+location, 2, location)
+	}
+	for cap := range caps {
+		targets.add("cap:"+cap, 3, cap, cap+"s")
+	}
+
+	for zone, zc := range conf.Heating.Zones {
+		zones.add(zone, 0, zone, zone+" zone")
+		sensor := zoneSensor(zone, zc)
+		sensors.add(sensor, 2, zone, zone+" zone")
+		for _, id := range []string{"thermostat." + zone, sensor} {
+			if dev, ok := conf.Devices[id]; ok {
+				zones.add(zone, 1, devicePhrases(dev)...)
+				zones.add(zone, 1, dev.Location)
+			}
+		}
+	}
+
+	return map[string]table{
+		"device": devices,
+		"target": targets,
+		"zone":   zones,
+		"sensor": sensors,
+	}
+}
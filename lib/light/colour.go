@@ -0,0 +1,147 @@
+package light
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math"
+	"regexp"
+)
+
+// RGB colour, with components 0-1.
+type RGB struct {
+	R, G, B float64
+}
+
+var reHexCode = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// ParseHex parses a #rrggbb colour.
+func ParseHex(s string) (RGB, error) {
+	if !reHexCode.MatchString(s) {
+		return RGB{}, fmt.Errorf("invalid colour: %s (expected #rrggbb)", s)
+	}
+	decoded, _ := hex.DecodeString(s[1:])
+	return RGB{float64(decoded[0]) / 255, float64(decoded[1]) / 255, float64(decoded[2]) / 255}, nil
+}
+
+// Hex formats as #rrggbb.
+func (c RGB) Hex() string {
+	r, g, b := c.Bytes()
+	return fmt.Sprintf("#%02x%02x%02x", r, g, b)
+}
+
+// Bytes returns the components scaled 0-255.
+func (c RGB) Bytes() (int, int, int) {
+	return Round(bound(c.R) * 255), Round(bound(c.G) * 255), Round(bound(c.B) * 255)
+}
+
+// HSVToRGB converts hue (degrees), saturation (0-1) and value (0-1) to RGB.
+func HSVToRGB(h, s, v float64) RGB {
+	h = math.Mod(h, 360)
+	if h < 0 {
+		h += 360
+	}
+	c := v * s
+	x := c * (1 - math.Abs(math.Mod(h/60, 2)-1))
+	m := v - c
+	var r, g, b float64
+	switch {
+	case h < 60:
+		r, g, b = c, x, 0
+	case h < 120:
+		r, g, b = x, c, 0
+	case h < 180:
+		r, g, b = 0, c, x
+	case h < 240:
+		r, g, b = 0, x, c
+	case h < 300:
+		r, g, b = x, 0, c
+	default:
+		r, g, b = c, 0, x
+	}
+	return RGB{r + m, g + m, b + m}
+}
+
+// Gamma correction of rgb component
+func norm(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	} else {
+		return math.Pow((v+0.055)/1.055, 2.4)
+	}
+}
+
+// Round to the nearest integer.
+func Round(f float64) int {
+	if f < -0.5 {
+		return int(f - 0.5)
+	}
+	if f > 0.5 {
+		return int(f + 0.5)
+	}
+	return 0
+}
+
+func RGBToColorXYDim(r, g, b float64) (x float64, y float64, dim int) {
+	// Gamma correct sRGB -> sRGB'
+	r = norm(r)
+	g = norm(g)
+	b = norm(b)
+	// Wide RGB D65 conversion formula
+	X := r*0.664511 + g*0.154324 + b*0.162028
+	Y := r*0.313881 + g*0.668433 + b*0.047685
+	Z := r*0.000088 + g*0.072310 + b*0.986039
+	// Convert XYZ -> xy
+	x = X / (X + Y + Z)
+	y = Y / (X + Y + Z)
+	if Y > 1 {
+		Y = 1
+	}
+	dim = int(Y * 255)
+	return
+}
+
+func bound(f float64) float64 {
+	if f <= 0 {
+		return 0
+	} else if f >= 1 {
+		return 1
+	} else {
+		return f
+	}
+}
+
+func KelvinToRGB(k int) (r, g, b float64) {
+	if k < MinKelvin {
+		k = MinKelvin
+	} else if k > MaxKelvin {
+		k = MaxKelvin
+	}
+	t := float64(k / 100)
+	if t <= 66 {
+		r = 1
+		g = bound((99.4708025861*math.Log(t) - 161.1195681661) / 255)
+	} else {
+		r = bound((329.698727446 * math.Pow(t-60, -0.1332047592)) / 255)
+		g = bound((288.1221695283 * math.Pow(t-60, -0.0755148492)) / 255)
+	}
+	if t >= 66 {
+		b = 1
+	} else if t <= 19 {
+		b = 0
+	} else {
+		b = bound((138.5177312231*math.Log(t-10) - 305.0447927307) / 255)
+	}
+	return
+}
+
+func KelvinToColorXYDim(k int) (x float64, y float64, dim int) {
+	return RGBToColorXYDim(KelvinToRGB(k))
+}
+
+// KelvinToMired converts a colour temperature to mireds (micro reciprocal degrees).
+func KelvinToMired(k int) int {
+	if k <= 0 {
+		return 0
+	}
+	return 1000000 / k
+}
@@ -0,0 +1,30 @@
+package light
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseHex(t *testing.T) {
+	assert := assert.New(t)
+	rgb, err := ParseHex("#ff8000")
+	assert.NoError(err)
+	assert.Equal("#ff8000", rgb.Hex())
+	r, g, b := rgb.Bytes()
+	assert.Equal([]int{255, 128, 0}, []int{r, g, b})
+
+	_, err = ParseHex("orange")
+	assert.Error(err)
+}
+
+func TestHSVToRGB(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("#ff0000", HSVToRGB(0, 1, 1).Hex())
+	assert.Equal("#0000ff", HSVToRGB(240, 1, 1).Hex())
+	assert.Equal("#ffffff", HSVToRGB(0, 0, 1).Hex())
+}
+
+func TestKelvinToMired(t *testing.T) {
+	assert.Equal(t, 370, KelvinToMired(2700))
+}
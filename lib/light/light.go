@@ -0,0 +1,206 @@
+// Package light is the common light command schema shared by the light
+// protocol services (zigbee, yeelight, tasmota), the automata flux function,
+// the api and googlehome.
+//
+// A light command is a "command" event with the fields:
+//
+// command: on or off
+//
+// level: brightness 0-100
+//
+// temp: colour temperature in kelvin
+//
+// colour: RGB colour as #rrggbb, or alternatively hue (0-360), saturation (0-100)
+// and value (0-100, default 100)
+//
+// transition: transition time in seconds
+//
+// What a light supports is declared by its device caps: dimmer (level), ct
+// (temp) and colour (colour). A light declaring none of these is assumed to
+// support everything, for backwards compatibility, though services keep
+// their previous defaults for it (eg zigbee emulates colour temperature).
+package light
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/barnybug/gohome/config"
+	"github.com/barnybug/gohome/pubsub"
+)
+
+const (
+	MinKelvin = 1000
+	MaxKelvin = 40000
+)
+
+// Command is a parsed light command.
+type Command struct {
+	On         bool
+	Level      *int
+	Temp       int // kelvin, 0 if not set
+	Colour     *RGB
+	Transition time.Duration
+}
+
+var ErrCommand = errors.New("light command should be on or off")
+
+func clamp(v, min, max float64) float64 {
+	if v < min {
+		return min
+	} else if v > max {
+		return max
+	}
+	return v
+}
+
+func numberField(ev *pubsub.Event, name string) (float64, bool, error) {
+	value, ok := ev.Fields[name]
+	if !ok {
+		return 0, false, nil
+	}
+	switch v := value.(type) {
+	case float64:
+		return v, true, nil
+	case int:
+		return float64(v), true, nil
+	case int64:
+		return float64(v), true, nil
+	}
+	return 0, false, fmt.Errorf("%s should be a number", name)
+}
+
+// Parse a light command from a command event.
+func Parse(ev *pubsub.Event) (Command, error) {
+	var c Command
+	switch ev.Command() {
+	case "on":
+		c.On = true
+	case "off":
+		c.On = false
+	default:
+		return c, ErrCommand
+	}
+
+	if level, ok, err := numberField(ev, "level"); err != nil {
+		return c, err
+	} else if ok {
+		l := int(clamp(level, 0, 100))
+		c.Level = &l
+	}
+
+	if temp, ok, err := numberField(ev, "temp"); err != nil {
+		return c, err
+	} else if ok && temp != 0 {
+		c.Temp = int(clamp(temp, MinKelvin, MaxKelvin))
+	}
+
+	if ev.IsSet("colour") {
+		rgb, err := ParseHex(ev.StringField("colour"))
+		if err != nil {
+			return c, err
+		}
+		c.Colour = &rgb
+	} else if hue, ok, err := numberField(ev, "hue"); err != nil {
+		return c, err
+	} else if ok {
+		saturation, sok, err := numberField(ev, "saturation")
+		if err != nil {
+			return c, err
+		}
+		if !sok {
+			saturation = 100
+		}
+		value, vok, err := numberField(ev, "value")
+		if err != nil {
+			return c, err
+		}
+		if !vok {
+			value = 100
+		}
+		rgb := HSVToRGB(hue, clamp(saturation, 0, 100)/100, clamp(value, 0, 100)/100)
+		c.Colour = &rgb
+	}
+
+	if transition, ok, err := numberField(ev, "transition"); err != nil {
+		return c, err
+	} else if ok {
+		c.Transition = time.Duration(clamp(transition, 0, 3600) * float64(time.Second))
+	} else if duration, ok, _ := numberField(ev, "duration"); ok {
+		// legacy yeelight duration in milliseconds
+		c.Transition = time.Duration(duration) * time.Millisecond
+	}
+	return c, nil
+}
+
+// Event creates a light command event for a device.
+func (c Command) Event(device string) *pubsub.Event {
+	fields := c.Fields()
+	fields["device"] = device
+	return pubsub.NewEvent("command", fields)
+}
+
+// Fields encodes the command as event fields.
+func (c Command) Fields() pubsub.Fields {
+	fields := pubsub.Fields{"command": "off"}
+	if c.On {
+		fields["command"] = "on"
+	}
+	if c.Level != nil {
+		fields["level"] = *c.Level
+	}
+	if c.Temp != 0 {
+		fields["temp"] = c.Temp
+	}
+	if c.Colour != nil {
+		fields["colour"] = c.Colour.Hex()
+	}
+	if c.Transition != 0 {
+		fields["transition"] = c.Transition.Seconds()
+	}
+	return fields
+}
+
+// Caps a light supports.
+type Caps struct {
+	Dimmer     bool
+	ColourTemp bool
+	Colour     bool
+	Declared   bool // false if assumed, none being declared
+}
+
+// DeviceCaps returns the light capabilities declared for a device.
+func DeviceCaps(dev config.DeviceConf) Caps {
+	caps := Caps{
+		Dimmer:     dev.Cap["dimmer"],
+		ColourTemp: dev.Cap["ct"] || dev.Cap["colourtemp"],
+		Colour:     dev.Cap["colour"],
+		Declared:   true,
+	}
+	if !caps.Dimmer && !caps.ColourTemp && !caps.Colour {
+		// undeclared - assume everything is supported
+		return Caps{Dimmer: true, ColourTemp: true, Colour: true}
+	}
+	return caps
+}
+
+// IsLight returns true if the device declares any light capabilities.
+func IsLight(dev config.DeviceConf) bool {
+	return dev.Cap["dimmer"] || dev.Cap["ct"] || dev.Cap["colourtemp"] || dev.Cap["colour"]
+}
+
+// Restrict drops the parts of a command a light does not support. Colour
+// temperature is kept for colour lights, as it can be emulated.
+func (c Command) Restrict(caps Caps) Command {
+	if !caps.Dimmer {
+		c.Level = nil
+	}
+	if !caps.ColourTemp && !caps.Colour {
+		c.Temp = 0
+	}
+	if !caps.Colour {
+		c.Colour = nil
+	}
+	return c
+}
@@ -0,0 +1,75 @@
+package light
+
+import (
+	"testing"
+	"time"
+
+	"github.com/barnybug/gohome/config"
+	"github.com/barnybug/gohome/pubsub"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	assert := assert.New(t)
+	ev := pubsub.NewEvent("command", pubsub.Fields{"device": "light.a", "command": "on", "level": 150.0, "temp": 2700.0, "colour": "#ff0000", "transition": 2.0})
+	c, err := Parse(ev)
+	assert.NoError(err)
+	assert.True(c.On)
+	assert.Equal(100, *c.Level)
+	assert.Equal(2700, c.Temp)
+	assert.Equal("#ff0000", c.Colour.Hex())
+	assert.Equal(2*time.Second, c.Transition)
+
+	_, err = Parse(pubsub.NewCommand("light.a", "toggle"))
+	assert.Equal(ErrCommand, err)
+
+	ev = pubsub.NewEvent("command", pubsub.Fields{"device": "light.a", "command": "on", "level": "bright"})
+	_, err = Parse(ev)
+	assert.Error(err)
+
+	ev = pubsub.NewEvent("command", pubsub.Fields{"device": "light.a", "command": "on", "hue": 120.0, "duration": 500.0})
+	c, err = Parse(ev)
+	assert.NoError(err)
+	assert.Equal("#00ff00", c.Colour.Hex())
+	assert.Equal(500*time.Millisecond, c.Transition)
+
+	ev = pubsub.NewEvent("command", pubsub.Fields{"device": "light.a", "command": "on", "hue": 0.0, "saturation": 100.0, "value": 50.0})
+	c, err = Parse(ev)
+	assert.NoError(err)
+	assert.Equal("#800000", c.Colour.Hex())
+}
+
+func TestFields(t *testing.T) {
+	assert := assert.New(t)
+	level := 50
+	c := Command{On: true, Level: &level, Temp: 3000, Transition: time.Second}
+	ev := c.Event("light.a")
+	assert.Equal("light.a", ev.Device())
+	assert.Equal("on", ev.Command())
+	assert.Equal(50, ev.Fields["level"])
+	assert.Equal(3000, ev.Fields["temp"])
+	assert.Equal(1.0, ev.Fields["transition"])
+	assert.NotContains(ev.Fields, "colour")
+}
+
+func TestRestrict(t *testing.T) {
+	assert := assert.New(t)
+	level := 50
+	rgb := RGB{1, 0, 0}
+	c := Command{On: true, Level: &level, Temp: 3000, Colour: &rgb}
+
+	dimmer := c.Restrict(DeviceCaps(config.DeviceConf{Cap: map[string]bool{"dimmer": true}}))
+	assert.NotNil(dimmer.Level)
+	assert.Equal(0, dimmer.Temp)
+	assert.Nil(dimmer.Colour)
+
+	colour := c.Restrict(DeviceCaps(config.DeviceConf{Cap: map[string]bool{"colour": true}}))
+	assert.Nil(colour.Level)
+	assert.Equal(3000, colour.Temp)
+	assert.NotNil(colour.Colour)
+
+	caps := DeviceCaps(config.DeviceConf{})
+	assert.False(caps.Declared)
+	all := c.Restrict(caps)
+	assert.Equal(c, all)
+}
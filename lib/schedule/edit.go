@@ -0,0 +1,100 @@
+package schedule
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/barnybug/gohome/config"
+)
+
+// Replace validates a zone schedule, and returns the raw config with the zone
+// schedule replaced, preserving everything else.
+func Replace(raw []byte, zone string, conf config.ScheduleConf) ([]byte, error) {
+	if _, err := New(conf); err != nil {
+		return nil, err
+	}
+	current, err := config.OpenRaw(raw)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := current.Heating.Zones[zone]; !ok {
+		return nil, fmt.Errorf("Zone %s not found", zone)
+	}
+	data, err := config.ReplaceKey(raw, []string{"heating", "zones", zone, "schedule"}, conf)
+	if err != nil {
+		return nil, err
+	}
+	// sanity check the result
+	if _, err := config.OpenRaw(data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func copyConf(conf config.ScheduleConf) config.ScheduleConf {
+	ret := config.ScheduleConf{}
+	for days, slots := range conf {
+		for _, slot := range slots {
+			s := map[string]float64{}
+			for at, temp := range slot {
+				s[at] = temp
+			}
+			ret[days] = append(ret[days], s)
+		}
+	}
+	return ret
+}
+
+func slotTime(slot map[string]float64) string {
+	for at := range slot {
+		return at
+	}
+	return ""
+}
+
+// Set sets the temperature for a time slot on days, replacing any existing
+// slot at the same time.
+func Set(conf config.ScheduleConf, days, at string, temp float64) config.ScheduleConf {
+	ret := copyConf(conf)
+	var slots []map[string]float64
+	for _, slot := range ret[days] {
+		if _, ok := slot[at]; !ok {
+			slots = append(slots, slot)
+		}
+	}
+	slots = append(slots, map[string]float64{at: temp})
+	sort.SliceStable(slots, func(i, j int) bool {
+		si, _, _ := ParseHourMinuteRange(slotTime(slots[i]))
+		sj, _, _ := ParseHourMinuteRange(slotTime(slots[j]))
+		return si < sj
+	})
+	ret[days] = slots
+	return ret
+}
+
+// Remove removes the time slot on days, or all of days if at is empty.
+func Remove(conf config.ScheduleConf, days, at string) (config.ScheduleConf, error) {
+	ret := copyConf(conf)
+	if _, ok := ret[days]; !ok {
+		return nil, fmt.Errorf("%s not in schedule", days)
+	}
+	if at == "" {
+		delete(ret, days)
+		return ret, nil
+	}
+	var slots []map[string]float64
+	for _, slot := range ret[days] {
+		if _, ok := slot[at]; !ok {
+			slots = append(slots, slot)
+		}
+	}
+	if len(slots) == len(ret[days]) {
+		return nil, fmt.Errorf("%s %s not in schedule", days, at)
+	}
+	if len(slots) == 0 {
+		delete(ret, days)
+	} else {
+		ret[days] = slots
+	}
+	return ret, nil
+}
@@ -0,0 +1,31 @@
+package schedule
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/barnybug/gohome/config"
+)
+
+func TestSet(t *testing.T) {
+	conf := config.ScheduleConf{"Weekends": {{"10:00-22:00": 18}}}
+	set := Set(conf, "Weekends", "08:00-10:00", 16)
+	assert.Equal(t, []map[string]float64{{"08:00-10:00": 16}, {"10:00-22:00": 18}}, set["Weekends"])
+	set = Set(set, "Weekends", "10:00-22:00", 19)
+	assert.Equal(t, []map[string]float64{{"08:00-10:00": 16}, {"10:00-22:00": 19}}, set["Weekends"])
+	// unchanged
+	assert.Equal(t, []map[string]float64{{"10:00-22:00": 18}}, conf["Weekends"])
+}
+
+func TestRemove(t *testing.T) {
+	conf := config.ScheduleConf{"Weekends": {{"08:00-10:00": 16}, {"10:00-22:00": 18}}}
+	removed, err := Remove(conf, "Weekends", "08:00-10:00")
+	assert.NoError(t, err)
+	assert.Equal(t, []map[string]float64{{"10:00-22:00": 18}}, removed["Weekends"])
+	removed, err = Remove(removed, "Weekends", "10:00-22:00")
+	assert.NoError(t, err)
+	assert.Empty(t, removed)
+	_, err = Remove(conf, "Weekdays", "")
+	assert.EqualError(t, err, "Weekdays not in schedule")
+}
@@ -0,0 +1,167 @@
+// Package schedule parses heating schedules - temperatures by weekdays and
+// hh:mm-hh:mm time ranges - and edits them in the config.
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/barnybug/gohome/config"
+	"github.com/barnybug/gohome/util"
+)
+
+type Schedule struct {
+	Days map[time.Weekday][]Period
+}
+
+type Period struct {
+	Start int
+	End   int
+	Temp  float64
+}
+
+const (
+	MinimumTemperature = 1.0
+	MaximumTemperature = 25.0
+)
+
+var reHourMinuteRange = regexp.MustCompile(`^(\d+):(\d+)-(\d+):(\d+)$`)
+
+func ParseHourMinuteRange(s string) (int, int, error) {
+	m := reHourMinuteRange.FindStringSubmatch(s)
+	if m == nil {
+		return 0, 0, errors.New("Expected hh:mm-hh:mm")
+	}
+	sh, _ := strconv.Atoi(m[1])
+	sm, _ := strconv.Atoi(m[2])
+	eh, _ := strconv.Atoi(m[3])
+	em, _ := strconv.Atoi(m[4])
+	return sh*60 + sm, eh*60 + em, nil
+}
+
+func WeekdayRange(start, end time.Weekday) []time.Weekday {
+	var days []time.Weekday
+	i := start
+	for {
+		days = append(days, i)
+		if i == end {
+			break
+		}
+		i = NextWeekday(i)
+	}
+	return days
+}
+
+func NextWeekday(w time.Weekday) time.Weekday {
+	if w == time.Saturday {
+		return time.Sunday
+	} else {
+		return w + 1
+	}
+}
+
+const Midnight = 24 * 60
+
+func ParseWeekdays(s string) ([]time.Weekday, error) {
+	var weekdays []time.Weekday
+	for _, d := range strings.Split(s, ",") {
+		if d == "Weekdays" {
+			weekdays = append(weekdays, WeekdayRange(time.Monday, time.Friday)...)
+		} else if d == "Weekends" {
+			weekdays = append(weekdays, WeekdayRange(time.Saturday, time.Sunday)...)
+		} else if d == "All" {
+			weekdays = append(weekdays, WeekdayRange(time.Monday, time.Sunday)...)
+		} else if strings.Contains(d, "-") {
+			ps := strings.SplitN(d, "-", 2)
+			if len(ps) != 2 {
+				return nil, fmt.Errorf("Invalid range: %s", d)
+			}
+			var start, end time.Weekday
+			var ok bool
+			if start, ok = util.DOW[ps[0]]; !ok {
+				return nil, fmt.Errorf("Invalid weekday: %s", ps[0])
+			}
+			if end, ok = util.DOW[ps[1]]; !ok {
+				return nil, fmt.Errorf("Invalid weekday: %s", ps[1])
+			}
+			weekdays = append(weekdays, WeekdayRange(start, end)...)
+		} else {
+			if weekday, ok := util.DOW[d]; ok {
+				weekdays = append(weekdays, weekday)
+			} else {
+				return nil, fmt.Errorf("Invalid weekday: %s", weekday)
+			}
+		}
+	}
+	return weekdays, nil
+}
+
+func New(conf config.ScheduleConf) (*Schedule, error) {
+	days := map[time.Weekday][]Period{}
+	for _, day := range WeekdayRange(time.Sunday, time.Saturday) {
+		days[day] = []Period{}
+	}
+	for weekdays, mts := range conf {
+		wds, err := ParseWeekdays(weekdays)
+		if err != nil {
+			return nil, err
+		}
+		for _, weekday := range wds {
+			for _, arr := range mts {
+				for at, temp := range arr {
+					start, end, err := ParseHourMinuteRange(at)
+					if err != nil {
+						return nil, err
+					}
+					if temp < MinimumTemperature || temp > MaximumTemperature {
+						return nil, fmt.Errorf("Temperature %.1f outside range %.1f <= t <= %.1f", temp, MinimumTemperature, MaximumTemperature)
+					}
+					if start > end {
+						// spanning midnight, split
+						tomorrow := NextWeekday(weekday)
+						s2 := Period{0, end, temp}
+						days[tomorrow] = append(days[tomorrow], s2)
+						end = Midnight
+					}
+					s := Period{start, end, temp}
+					days[weekday] = append(days[weekday], s)
+				}
+			}
+		}
+	}
+	return &Schedule{Days: days}, nil
+}
+
+func (self *Schedule) Target(at time.Time, def float64) float64 {
+	day_mins := at.Hour()*60 + at.Minute()
+	target := def
+	if sts, ok := self.Days[at.Weekday()]; ok {
+		var specific = 86401
+		for _, st := range sts {
+			if st.Start <= day_mins && day_mins < st.End && st.End-st.Start < specific {
+				target = st.Temp
+				specific = st.End - st.Start
+			}
+		}
+	}
+	return target
+}
+
+// Next returns the next time within lead the schedule rises above the
+// current target, and the temperature it rises to.
+func (self *Schedule) Next(now time.Time, lead time.Duration, def float64) (time.Time, float64, bool) {
+	current := self.Target(now, def)
+	at := now.Truncate(time.Minute)
+	for at = at.Add(time.Minute); !at.After(now.Add(lead)); at = at.Add(time.Minute) {
+		if temp := self.Target(at, def); temp > current {
+			return at, temp, true
+		} else if temp < current {
+			return time.Time{}, 0, false
+		}
+	}
+	return time.Time{}, 0, false
+}
@@ -0,0 +1,225 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/barnybug/gohome/config"
+)
+
+var testScheduleTable = []struct {
+	t    time.Time
+	temp float64
+}{
+	{
+		time.Date(2014, 1, 6, 8, 0, 0, 0, time.UTC), // Monday 8am
+		18.0,
+	},
+	{
+		time.Date(2014, 1, 6, 8, 10, 0, 0, time.UTC), // Monday 8:10am
+		14.0,
+	},
+	{
+		time.Date(2014, 1, 6, 17, 20, 0, 0, time.UTC), // Monday 5:29pm
+		14.0,
+	},
+	{
+		time.Date(2014, 1, 6, 17, 30, 0, 0, time.UTC), // Monday 5:30pm
+		18.0,
+	},
+	{
+		time.Date(2014, 1, 6, 22, 19, 0, 0, time.UTC), // Monday 10:19pm
+		18.0,
+	},
+	{
+		time.Date(2014, 1, 10, 8, 0, 0, 0, time.UTC), // Friday 8am
+		18.0,
+	},
+	{
+		time.Date(2014, 1, 10, 8, 10, 0, 0, time.UTC), // Friday 8:10am
+		14.0,
+	},
+	{
+		time.Date(2014, 1, 4, 8, 0, 0, 0, time.UTC), // Saturday 8am
+		0.0,
+	},
+	{
+		time.Date(2014, 1, 4, 16, 0, 0, 0, time.UTC), // Saturday 4pm
+		18.0,
+	},
+}
+
+var scheduleConf = `
+Weekends:
+- 10:20-22:50: 18.0
+Monday,Tue-Thu,Fri:
+- 07:30-08:10: 18.0
+- 08:10-17:30: 14.0
+Weekdays:
+- 17:30-22:20: 18.0
+`
+
+func TestSchedule(t *testing.T) {
+	var schedule config.ScheduleConf
+	yaml.Unmarshal([]byte(scheduleConf), &schedule)
+	s, err := New(schedule)
+	require.Nil(t, err)
+	for _, tt := range testScheduleTable {
+		t.Run(tt.t.Format(time.RFC3339), func(t *testing.T) {
+			assert.Equal(t, tt.temp, s.Target(tt.t, 0))
+		})
+	}
+}
+
+func TestScheduleBST(t *testing.T) {
+	var schedule config.ScheduleConf
+	yaml.Unmarshal([]byte(scheduleConf), &schedule)
+	s, err := New(schedule)
+	require.Nil(t, err)
+	bst := time.FixedZone("BST", 3600)
+	for _, tt := range testScheduleTable {
+		bt := time.Date(tt.t.Year(), tt.t.Month(), tt.t.Day(), tt.t.Hour(), tt.t.Minute(), tt.t.Second(), tt.t.Nanosecond(), bst)
+		assert.Equal(t, tt.temp, s.Target(bt, 0))
+	}
+}
+
+var testScheduleWithoutWeekendsTable = []struct {
+	t    time.Time
+	temp float64
+}{
+	{
+		time.Date(2014, 1, 3, 7, 59, 0, 0, time.UTC), // Friday 7:59am
+		0.0,
+	},
+	{
+		time.Date(2014, 1, 3, 7, 59, 0, 0, time.UTC), // Friday 7:59am
+		0.0,
+	},
+	{
+		time.Date(2014, 1, 3, 8, 0, 0, 0, time.UTC), // Friday 8am
+		17.0,
+	},
+	{
+		time.Date(2014, 1, 3, 17, 59, 0, 0, time.UTC), // Friday 5:59pm
+		17.0,
+	},
+	{
+		time.Date(2014, 1, 3, 18, 0, 0, 0, time.UTC), // Friday 6pm
+		0.0,
+	},
+	{
+		time.Date(2014, 1, 4, 8, 0, 0, 0, time.UTC), // Saturday 8am
+		0.0,
+	},
+	{
+		time.Date(2014, 1, 5, 8, 0, 0, 0, time.UTC), // Sunday 8am
+		0.0,
+	},
+	{
+		time.Date(2014, 1, 6, 8, 0, 0, 0, time.UTC), // Monday 8am
+		17.0,
+	},
+}
+
+func TestScheduleWithoutWeekends(t *testing.T) {
+	conf := `
+Weekdays:
+- 8:00-18:00: 17
+`
+	var schedule config.ScheduleConf
+	yaml.Unmarshal([]byte(conf), &schedule)
+	s, err := New(schedule)
+	require.Nil(t, err)
+	for _, tt := range testScheduleWithoutWeekendsTable {
+		t.Run(tt.t.Format(time.RFC3339), func(t *testing.T) {
+			assert.Equal(t, tt.temp, s.Target(tt.t, 0))
+		})
+	}
+}
+
+func TestScheduleEmpty(t *testing.T) {
+	conf := `{}`
+	var schedule config.ScheduleConf
+	yaml.Unmarshal([]byte(conf), &schedule)
+	s, err := New(schedule)
+	require.Nil(t, err)
+	assert.Equal(t, 1.0, s.Target(time.Date(2014, 1, 3, 7, 59, 0, 0, time.UTC), 1))
+}
+
+func TestScheduleAll(t *testing.T) {
+	conf := `
+All:
+- 0:00-24:00: 10`
+	var schedule config.ScheduleConf
+	yaml.Unmarshal([]byte(conf), &schedule)
+	s, err := New(schedule)
+	require.Nil(t, err)
+	assert.Equal(t, 10.0, s.Target(time.Date(2014, 1, 3, 7, 59, 0, 0, time.UTC), 0))
+}
+
+func TestScheduleOverlap(t *testing.T) {
+	conf := `
+All:
+- 08:00-09:00: 15
+- 00:00-24:00: 10
+Fri:
+- 08:30-08:35: 20
+`
+	var schedule config.ScheduleConf
+	yaml.Unmarshal([]byte(conf), &schedule)
+	s, err := New(schedule)
+	require.Nil(t, err)
+	assert.Equal(t, 10.0, s.Target(time.Date(2014, 1, 3, 7, 59, 0, 0, time.UTC), 0))
+	assert.Equal(t, 15.0, s.Target(time.Date(2014, 1, 3, 8, 0, 0, 0, time.UTC), 0))
+	assert.Equal(t, 15.0, s.Target(time.Date(2014, 1, 2, 8, 30, 0, 0, time.UTC), 0)) // Thursdau
+	assert.Equal(t, 20.0, s.Target(time.Date(2014, 1, 3, 8, 30, 0, 0, time.UTC), 0)) // Friday
+	assert.Equal(t, 15.0, s.Target(time.Date(2014, 1, 3, 8, 35, 0, 0, time.UTC), 0))
+	assert.Equal(t, 10.0, s.Target(time.Date(2014, 1, 3, 9, 0, 0, 0, time.UTC), 0))
+}
+
+func TestScheduleSpanningMidnight(t *testing.T) {
+	conf := `
+Fri:
+- 00:00-24:00: 10
+- 23:00-01:00: 18
+Sat:
+- 00:00-24:00: 10
+`
+	var schedule config.ScheduleConf
+	yaml.Unmarshal([]byte(conf), &schedule)
+	s, err := New(schedule)
+	require.Nil(t, err)
+	assert.Equal(t, 10.0, s.Target(time.Date(2014, 1, 3, 22, 59, 0, 0, time.UTC), 0))
+	assert.Equal(t, 18.0, s.Target(time.Date(2014, 1, 3, 23, 0, 0, 0, time.UTC), 0))
+	assert.Equal(t, 18.0, s.Target(time.Date(2014, 1, 4, 0, 0, 0, 0, time.UTC), 0))
+	assert.Equal(t, 18.0, s.Target(time.Date(2014, 1, 4, 0, 59, 0, 0, time.UTC), 0))
+	assert.Equal(t, 10.0, s.Target(time.Date(2014, 1, 4, 1, 0, 0, 0, time.UTC), 0))
+}
+
+var testScheduleParseErrorTable = []string{
+	"Monkeys: ['8:00-9:00': 17]",
+	"Monkeys: ['8:00-9': 17]",
+	"Monkeys: ['8:00-': 17]",
+	"Monkeys: ['8:00': 17]",
+	"Monday: ['8:': 17]",
+	"Monday: [':00': 17]",
+	"Monday: [':': 17]",
+	"Monday: ['0:00-1:00': -1]",
+	"Monday: ['0:00-1:00': 60]",
+}
+
+func TestScheduleParseError(t *testing.T) {
+	for _, conf := range testScheduleParseErrorTable {
+		t.Run(conf, func(t *testing.T) {
+			var schedule config.ScheduleConf
+			yaml.Unmarshal([]byte(conf), &schedule)
+			s, err := New(schedule)
+			assert.Error(t, err)
+			assert.Nil(t, s)
+		})
+	}
+}
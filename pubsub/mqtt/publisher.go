@@ -59,8 +59,10 @@ func (pub *Publisher) Emit(ev *pubsub.Event) {
 	// so we hand off to a channel.
 	select {
 	case pub.channel <- ev:
+		pubsub.EventsPublished.Inc()
 		return
 	default:
+		pubsub.EventsDropped.Inc()
 		log.Println("Publish channel FULL - dropping message!")
 	}
 }
@@ -44,6 +44,7 @@ func (self *Subscriber) publishHandler(client MQTT.Client, msg MQTT.Message) {
 		return
 	}
 	event.SetRetained(msg.Retained())
+	pubsub.EventsReceived.Inc()
 	self.channelsLock.Lock()
 	// fmt.Printf("Event: %+v\n", event)
 	for _, ch := range self.channels {
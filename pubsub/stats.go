@@ -0,0 +1,23 @@
+package pubsub
+
+import "sync/atomic"
+
+// Counter is a monotonic count, safe for concurrent use.
+type Counter struct {
+	n int64
+}
+
+func (self *Counter) Inc() {
+	atomic.AddInt64(&self.n, 1)
+}
+
+func (self *Counter) Value() int64 {
+	return atomic.LoadInt64(&self.n)
+}
+
+// Counts of events through this process's publisher and subscriber.
+var (
+	EventsReceived  Counter // events received by the subscriber
+	EventsPublished Counter // events published
+	EventsDropped   Counter // events dropped as the publish queue was full
+)
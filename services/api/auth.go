@@ -0,0 +1,295 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/barnybug/gohome/config"
+	"github.com/barnybug/gohome/services"
+)
+
+type Role int
+
+const (
+	RoleNone Role = iota
+	RoleRead
+	RoleControl
+	RoleAdmin
+)
+
+var roleNames = map[string]Role{
+	"read":    RoleRead,
+	"control": RoleControl,
+	"admin":   RoleAdmin,
+}
+
+var ErrUnauthorized = errors.New("unauthorized")
+var ErrForbidden = errors.New("forbidden")
+
+// User is an authenticated api user.
+type User struct {
+	Name   string
+	Role   Role
+	Groups []string // device groups control is limited to, empty for all
+}
+
+func newUser(name string, conf config.ApiUserConf) *User {
+	return &User{Name: name, Role: roleNames[conf.Role], Groups: conf.Groups}
+}
+
+// CanSee returns true if the user may see events on the topic: the config
+// (which holds the api credentials) and logs are for admins only.
+func (self *User) CanSee(topic string) bool {
+	if self == nil || self.Role == RoleAdmin {
+		return true
+	}
+	return topic != "log" && topic != "config" && !strings.HasPrefix(topic, "config/")
+}
+
+// CanControl returns true if the user may control the device.
+func (self *User) CanControl(device string) bool {
+	if self.Role < RoleControl {
+		return false
+	}
+	if self.Role == RoleAdmin || len(self.Groups) == 0 {
+		return true
+	}
+	group := services.Config.Devices[device].Group
+	for _, g := range self.Groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+func secureCompare(a, b string) bool {
+	return a != "" && subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+func tokenUser(token string) *User {
+	for name, conf := range services.Config.Api.Users {
+		if secureCompare(conf.Token, token) {
+			return newUser(name, conf)
+		}
+	}
+	return nil
+}
+
+// authenticate returns the user for the request credentials: a bearer token,
+// basic auth or an access_token parameter (as browsers can't set headers for
+// WebSocket or EventSource). With no users configured, auth is disabled and
+// everyone is admin.
+func authenticate(r *http.Request) *User {
+	users := services.Config.Api.Users
+	if len(users) == 0 {
+		return &User{Role: RoleAdmin}
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return tokenUser(strings.TrimPrefix(auth, "Bearer "))
+	}
+	if name, password, ok := r.BasicAuth(); ok {
+		if conf, ok := users[name]; ok && secureCompare(conf.Password, password) {
+			return newUser(name, conf)
+		}
+		return nil
+	}
+	if token := r.URL.Query().Get("access_token"); token != "" {
+		return tokenUser(token)
+	}
+	return nil
+}
+
+// allowedOrigin returns true if cross-origin requests (and WebSockets) are
+// allowed from the origin: any while auth is disabled, otherwise only the
+// origins configured.
+func allowedOrigin(origin string) bool {
+	conf := services.Config.Api
+	if len(conf.Users) == 0 && len(conf.Origins) == 0 {
+		return true
+	}
+	for _, allowed := range conf.Origins {
+		if strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+type contextKey int
+
+const userKey contextKey = 0
+
+// requestUser returns the authenticated user of the request. Requests not
+// passed through authHandler (ie tests) have no user and are unrestricted.
+func requestUser(r *http.Request) *User {
+	user, _ := r.Context().Value(userKey).(*User)
+	return user
+}
+
+// checkControl returns ErrForbidden unless the request may control all the
+// devices.
+func checkControl(user *User, devices []string) error {
+	if user == nil {
+		return nil
+	}
+	for _, device := range devices {
+		if !user.CanControl(device) {
+			return ErrForbidden
+		}
+	}
+	return nil
+}
+
+// queryDevices returns the devices a query controls: the target of a switch
+// query, otherwise all of them, as other queries aren't limited to devices.
+func queryDevices(query string) ([]string, error) {
+	devices, ok, err := services.QueryDevices(query)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", query, err)
+	}
+	if !ok {
+		devices = nil
+		for id := range services.Config.Devices {
+			devices = append(devices, id)
+		}
+	}
+	return devices, nil
+}
+
+func forbidden(w http.ResponseWriter) {
+	writeError(w, http.StatusForbidden, ErrForbidden)
+}
+
+// isHook returns true for webhook requests, which are verified by the hook's
+// own secret instead, as callers can't generally be given api credentials.
+func isHook(r *http.Request) bool {
+	return strings.HasPrefix(strings.TrimPrefix(r.URL.Path, "/v1"), "/hooks/")
+}
+
+// authHandler authenticates requests, adding the user to the request context.
+type authHandler struct {
+	Handler http.Handler
+}
+
+func (self authHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if isHook(r) {
+		self.Handler.ServeHTTP(w, r)
+		return
+	}
+	user := authenticate(r)
+	if user == nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="gohome"`)
+		writeError(w, http.StatusUnauthorized, ErrUnauthorized)
+		return
+	}
+	ctx := context.WithValue(r.Context(), userKey, user)
+	self.Handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// authorize requires the read role for GET requests, and write otherwise.
+func authorize(read, write Role, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		role := write
+		if r.Method == "GET" || r.Method == "HEAD" {
+			role = read
+		}
+		if user := requestUser(r); user != nil && user.Role < role {
+			forbidden(w)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// Role required for each query verb. Verbs not listed (any other service's)
+// are for admins only.
+var queryRoles = map[string]Role{
+	// read
+	"status":      RoleRead,
+	"help":        RoleRead,
+	"report":      RoleRead,
+	"ps":          RoleRead,
+	"temperature": RoleRead,
+	"presence":    RoleRead,
+	"intent":      RoleRead,
+	"discovered":  RoleRead,
+	// control
+	"switch":      RoleControl,
+	"ch":          RoleControl,
+	"party":       RoleControl,
+	"holiday":     RoleControl,
+	"profile":     RoleControl,
+	"cheer":       RoleControl,
+	"identify":    RoleControl,
+	"diagnostics": RoleControl,
+	"exercise":    RoleControl,
+	"voltage":     RoleControl,
+	"discover":    RoleControl,
+	// admin, as on the rest api
+	"logs":    RoleAdmin,
+	"script":  RoleAdmin,
+	"start":   RoleAdmin,
+	"stop":    RoleAdmin,
+	"restart": RoleAdmin,
+}
+
+// queryRole returns the role required for a query.
+func queryRole(verb, args string) Role {
+	ps := strings.Fields(args)
+	switch verb {
+	case "schedule":
+		// editing schedules is for admins, as PUT /heating/schedule
+		if len(ps) > 0 && ps[0] == "get" {
+			return RoleRead
+		}
+		return RoleAdmin
+	case "state":
+		// forcing a state is control, as POST /automata/{name}/state
+		if len(ps) > 1 {
+			return RoleControl
+		}
+		return RoleRead
+	}
+	if role, ok := queryRoles[verb]; ok {
+		return role
+	}
+	return RoleAdmin
+}
+
+// authorizeQuery checks the user has the role the query verb requires, and
+// may control the devices of control queries.
+func authorizeQuery(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := requestUser(r)
+		if user == nil {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		endpoint := queryEndpoint(r)
+		ps := strings.Split(endpoint, "/")
+		verb := strings.ToLower(ps[len(ps)-1])
+		args := r.URL.Query().Get("q")
+		role := queryRole(verb, args)
+		if user.Role < role {
+			forbidden(w)
+			return
+		}
+		if role == RoleControl {
+			devices, err := queryDevices(endpoint + " " + args)
+			if err != nil {
+				badRequest(w, err)
+				return
+			}
+			if err := checkControl(user, devices); err != nil {
+				forbidden(w)
+				return
+			}
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,169 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/barnybug/gohome/config"
+	"github.com/barnybug/gohome/pubsub"
+	"github.com/barnybug/gohome/pubsub/dummy"
+	"github.com/barnybug/gohome/services"
+)
+
+var authYaml = `
+devices:
+  light.kitchen:
+    group: downstairs
+    caps: [switch]
+  light.bedroom:
+    group: upstairs
+    caps: [switch]
+api:
+  users:
+    reader:
+      token: r34d
+      role: read
+    downstairs:
+      password: d0wn
+      role: control
+      groups: [downstairs]
+    control:
+      token: c0ntr0l
+      role: control
+    admin:
+      token: 4dm1n
+      role: admin
+  origins: [https://dash.example.com]
+`
+
+func authRequest(method, url string, auth func(r *http.Request)) int {
+	rec := httptest.NewRecorder()
+	r := httptest.NewRequest(method, url, nil)
+	if auth != nil {
+		auth(r)
+	}
+	authHandler{Handler: router()}.ServeHTTP(rec, r)
+	return rec.Code
+}
+
+func bearer(token string) func(r *http.Request) {
+	return func(r *http.Request) {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+func basic(user, password string) func(r *http.Request) {
+	return func(r *http.Request) {
+		r.SetBasicAuth(user, password)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	services.Config = config.Must(config.OpenRaw([]byte(authYaml)))
+	me := dummy.Publisher{}
+	services.Publisher = &me
+
+	assert.Equal(t, http.StatusUnauthorized, authRequest("GET", "/devices", nil))
+	assert.Equal(t, http.StatusUnauthorized, authRequest("GET", "/devices", bearer("wrong")))
+	assert.Equal(t, http.StatusUnauthorized, authRequest("GET", "/devices", basic("downstairs", "wrong")))
+
+	// read
+	assert.Equal(t, http.StatusOK, authRequest("GET", "/devices", bearer("r34d")))
+	assert.Equal(t, http.StatusOK, authRequest("GET", "/devices?access_token=r34d", nil))
+	assert.Equal(t, http.StatusForbidden, authRequest("GET", "/devices/control?id=light.kitchen", bearer("r34d")))
+	assert.Equal(t, http.StatusForbidden, authRequest("GET", "/config?path=config", bearer("r34d")))
+	assert.Equal(t, http.StatusForbidden, authRequest("GET", "/query/heating/ch?q=20", bearer("r34d")))
+	// the dashboard's logs
+	assert.Equal(t, http.StatusForbidden, authRequest("GET", "/v1/query/automata/logs", bearer("r34d")))
+
+	// control limited to groups
+	assert.Equal(t, http.StatusOK, authRequest("GET", "/devices/control?id=light.kitchen", basic("downstairs", "d0wn")))
+	assert.Equal(t, http.StatusForbidden, authRequest("GET", "/devices/control?id=light.bedroom", basic("downstairs", "d0wn")))
+	assert.Equal(t, http.StatusForbidden, authRequest("GET", "/devices/control?id=cap:switch", basic("downstairs", "d0wn")))
+	assert.Equal(t, http.StatusForbidden, authRequest("GET", "/query/automata/switch?q=bedroom+on", basic("downstairs", "d0wn")))
+	assert.Equal(t, http.StatusForbidden, authRequest("GET", "/query/heating/ch?q=20", basic("downstairs", "d0wn")))
+	assert.Equal(t, http.StatusForbidden, authRequest("GET", "/config?path=config", basic("downstairs", "d0wn")))
+	// voice resolved to the devices switched, or all for other queries
+	assert.Equal(t, http.StatusForbidden, authRequest("GET", "/v1/voice?q=switch+on+the+bedroom+light", basic("downstairs", "d0wn")))
+	assert.Equal(t, http.StatusForbidden, authRequest("GET", "/v1/voice?q=turn+on+the+lights", basic("downstairs", "d0wn")))
+	assert.Equal(t, http.StatusForbidden, authRequest("GET", "/voice?q=is+anyone+home", basic("downstairs", "d0wn")))
+	assert.Equal(t, 1, len(me.Events))
+
+	// admin
+	assert.Equal(t, http.StatusOK, authRequest("GET", "/devices/control?id=light.bedroom", bearer("4dm1n")))
+	assert.Equal(t, http.StatusBadRequest, authRequest("GET", "/config?path=other", bearer("4dm1n")))
+}
+
+func TestAuthQueries(t *testing.T) {
+	services.Config = config.Must(config.OpenRaw([]byte(authYaml)))
+	control := bearer("c0ntr0l")
+	// admin only, as on the rest api
+	assert.Equal(t, http.StatusForbidden, authRequest("GET", "/query/heating/schedule?q=set+living+Mon-Fri+07:00-09:00+20", control))
+	assert.Equal(t, http.StatusForbidden, authRequest("GET", "/query/heating/schedule?q=remove+living+Mon-Fri", control))
+	assert.Equal(t, http.StatusForbidden, authRequest("GET", "/query/automata/logs", control))
+	assert.Equal(t, http.StatusForbidden, authRequest("GET", "/query/automata/script?q=goodnight", control))
+	assert.Equal(t, http.StatusForbidden, authRequest("GET", "/query/systemd/restart?q=heating", control))
+	// unknown verbs
+	assert.Equal(t, http.StatusForbidden, authRequest("GET", "/query/other/anything", control))
+
+	assert.Equal(t, RoleRead, queryRole("schedule", "get living"))
+	assert.Equal(t, RoleRead, queryRole("state", "lights"))
+	assert.Equal(t, RoleControl, queryRole("state", "lights Off"))
+	assert.Equal(t, RoleControl, queryRole("party", "living 21"))
+	assert.Equal(t, RoleAdmin, queryRole("other", ""))
+}
+
+func TestAuthDisabled(t *testing.T) {
+	services.Config = config.ExampleConfig
+	assert.Equal(t, http.StatusOK, authRequest("GET", "/devices", nil))
+}
+
+func TestStreamCommandForbidden(t *testing.T) {
+	services.Config = config.Must(config.OpenRaw([]byte(authYaml)))
+	me := dummy.Publisher{}
+	services.Publisher = &me
+	user := newUser("downstairs", services.Config.Api.Users["downstairs"])
+	client := newStreamClient(user, nil, nil)
+	_, err := client.Handle(streamMessage{Action: "command", Device: "light.bedroom", Command: "on"})
+	assert.Equal(t, ErrForbidden, err)
+	_, err = client.Handle(streamMessage{Action: "command", Device: "light.kitchen", Command: "on"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(me.Events))
+}
+
+func TestStreamPrivateTopics(t *testing.T) {
+	services.Config = config.Must(config.OpenRaw([]byte(authYaml)))
+	reader := newStreamClient(newUser("reader", services.Config.Api.Users["reader"]), nil, nil)
+	admin := newStreamClient(newUser("admin", services.Config.Api.Users["admin"]), nil, nil)
+	for _, topic := range []string{"config", "config/automata", "log"} {
+		ev := pubsub.NewEvent(topic, pubsub.Fields{})
+		assert.False(t, reader.Match(ev), topic)
+		assert.True(t, admin.Match(ev), topic)
+	}
+	assert.True(t, reader.Match(pubsub.NewEvent("temp", pubsub.Fields{"device": "temp.hallway"})))
+}
+
+func corsRequest(origin string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/devices", nil)
+	r.Header.Set("Origin", origin)
+	CORSHandler{Handler: http.HandlerFunc(nilHandler), AllowOrigin: allowedOrigin, SupportsCredentials: true}.ServeHTTP(rec, r)
+	return rec
+}
+
+func TestCORSOrigins(t *testing.T) {
+	services.Config = config.Must(config.OpenRaw([]byte(authYaml)))
+	rec := corsRequest("https://dash.example.com")
+	assert.Equal(t, "https://dash.example.com", rec.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", rec.Header().Get("Access-Control-Allow-Credentials"))
+	rec = corsRequest("https://evil.example.com")
+	assert.Equal(t, "", rec.Header().Get("Access-Control-Allow-Origin"))
+
+	// any while auth is disabled
+	services.Config = config.ExampleConfig
+	rec = corsRequest("https://evil.example.com")
+	assert.Equal(t, "https://evil.example.com", rec.Header().Get("Access-Control-Allow-Origin"))
+}
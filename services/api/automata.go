@@ -0,0 +1,92 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/barnybug/gohome/pubsub"
+	"github.com/barnybug/gohome/services"
+)
+
+// automataQuery queries the automata service, returning the answer, or nil
+// and a timeout response.
+func automataQuery(w http.ResponseWriter, q string) *pubsub.Event {
+	ch := services.QueryChannel("automata/"+q, time.Duration(DefaultQueryTimeout)*time.Millisecond)
+	ev := <-ch
+	if ev == nil {
+		timeout(w)
+	}
+	return ev
+}
+
+// automataError responds with the answer's message: not found for unknown
+// automata, otherwise a bad request.
+func automataError(w http.ResponseWriter, ev *pubsub.Event) {
+	err := errors.New(ev.StringField("message"))
+	if services.AnswerError(ev) == services.ErrAutomatonNotFound {
+		notFound(w, err)
+		return
+	}
+	badRequest(w, err)
+}
+
+func apiAutomata(w http.ResponseWriter, r *http.Request) {
+	ev := automataQuery(w, "status")
+	if ev == nil {
+		return
+	}
+	jsonResponse(w, ev.Fields["json"])
+}
+
+func apiAutomataSingle(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	ev := automataQuery(w, "state "+params["name"])
+	if ev == nil {
+		return
+	}
+	if ret, ok := ev.Fields["json"]; ok {
+		jsonResponse(w, ret)
+		return
+	}
+	automataError(w, ev)
+}
+
+func apiAutomataState(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	name := params["name"]
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("POST required"))
+		return
+	}
+	// state from a JSON body {"state": "..."}, or the state parameter
+	state := r.URL.Query().Get("state")
+	if state == "" {
+		var body struct {
+			State string `json:"state"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			badRequest(w, fmt.Errorf("state required: %s", err))
+			return
+		}
+		state = body.State
+	}
+	if state == "" || strings.Contains(state, " ") || strings.Contains(name, " ") {
+		badRequest(w, errors.New("invalid state"))
+		return
+	}
+	if err := checkControl(requestUser(r), []string{name}); err != nil {
+		forbidden(w)
+		return
+	}
+	ev := automataQuery(w, fmt.Sprintf("state %s %s", name, state))
+	if ev == nil {
+		return
+	}
+	if ret, ok := ev.Fields["json"]; ok {
+		jsonResponse(w, ret)
+		return
+	}
+	automataError(w, ev)
+}
@@ -0,0 +1,68 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/barnybug/gohome/config"
+	"github.com/barnybug/gohome/pubsub"
+	"github.com/barnybug/gohome/pubsub/dummy"
+	"github.com/barnybug/gohome/services"
+)
+
+// answer sets up the reply to the next query.
+func answer(fields pubsub.Fields) *dummy.Publisher {
+	publisher := &dummy.Publisher{}
+	services.Publisher = publisher
+	services.Subscriber = &dummy.Subscriber{Events: []*pubsub.Event{
+		pubsub.NewEvent("_rpc.1", fields),
+	}}
+	return publisher
+}
+
+var porch = map[string]interface{}{"name": "light.porch", "state": "On", "states": []interface{}{"Off", "On"}}
+
+func TestAutomata(t *testing.T) {
+	services.Config = config.ExampleConfig
+	publisher := answer(pubsub.Fields{"message": "...", "json": map[string]interface{}{"light.porch": porch}})
+	rec := apiRequest("GET", "/v1/automata")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `{"light.porch":{"name":"light.porch","state":"On","states":["Off","On"]}}`+"\n", rec.Body.String())
+	assert.Equal(t, "automata/status", publisher.Events[0].StringField("query"))
+
+	publisher = answer(pubsub.Fields{"message": "...", "json": porch})
+	rec = apiRequest("GET", "/v1/automata/light.porch")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "automata/state light.porch", publisher.Events[0].StringField("query"))
+
+	answer(pubsub.Fields{"message": "automata: 'x' not found", "error": "automaton not found", "error_code": "automaton_not_found"})
+	rec = apiRequest("GET", "/v1/automata/x")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Equal(t, `{"error":"automata: 'x' not found","status":404}`+"\n", rec.Body.String())
+
+	services.Subscriber = &dummy.Subscriber{}
+	rec = apiRequest("GET", "/v1/automata")
+	assert.Equal(t, http.StatusGatewayTimeout, rec.Code)
+}
+
+func TestAutomataState(t *testing.T) {
+	services.Config = config.ExampleConfig
+	publisher := answer(pubsub.Fields{"message": "Change light.porch state to Off", "json": porch})
+	rec := apiRequest("POST", "/v1/automata/light.porch/state?state=Off")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "automata/state light.porch Off", publisher.Events[0].StringField("query"))
+
+	publisher = answer(pubsub.Fields{"message": "automata state: 'Dim' not found", "error": "automaton state not found", "error_code": "state_not_found"})
+	r := strings.NewReader(`{"state": "Dim"}`)
+	rec = apiRequestBody("POST", "/v1/automata/light.porch/state", r)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Equal(t, "automata/state light.porch Dim", publisher.Events[0].StringField("query"))
+
+	rec = apiRequest("POST", "/v1/automata/light.porch/state")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = apiRequest("GET", "/v1/automata/light.porch/state")
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
@@ -0,0 +1,18 @@
+package api
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// The dashboard is a single self-contained page (no external scripts or
+// styles), so it works offline on the LAN. It uses the /v1 api and the /ws
+// event stream.
+//
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+func apiIndex(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "text/html; charset=utf-8")
+	w.Write(dashboardHTML)
+}
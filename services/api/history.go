@@ -0,0 +1,210 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/barnybug/gohome/lib/datalog"
+	"github.com/barnybug/gohome/lib/graphite"
+	"github.com/barnybug/gohome/pubsub"
+	"github.com/barnybug/gohome/services"
+	"github.com/barnybug/gohome/util"
+)
+
+// Maximum events returned by a history request.
+const maxHistory = 10000
+
+// historyDir returns the directory the datalogger logs to.
+var historyDir = func() string {
+	return util.ExpandUser(services.Config.Datalogger.Path)
+}
+
+type historyPoint struct {
+	At    time.Time `json:"at"`
+	Value float64   `json:"value"`
+}
+
+type historyBucket struct {
+	At    time.Time `json:"at"`
+	Min   float64   `json:"min"`
+	Max   float64   `json:"max"`
+	Avg   float64   `json:"avg"`
+	Count int       `json:"count"`
+}
+
+// parseHistoryTime parses an absolute time (RFC3339 or date), or a duration
+// ago (eg 24h, 7d).
+func parseHistoryTime(now time.Time, s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, now.Location()); err == nil {
+		return t, nil
+	}
+	if d, err := util.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time: %s", s)
+}
+
+// fieldPoint returns the numeric value of field in the event.
+func fieldPoint(ev *pubsub.Event, field string) (historyPoint, bool) {
+	value, ok := graphite.NumericValue(ev.Fields[field])
+	return historyPoint{At: ev.Timestamp, Value: value}, ok
+}
+
+// downsampler summarises points, in time order, into buckets of a duration.
+type downsampler struct {
+	bucket  time.Duration
+	buckets []historyBucket
+}
+
+func (self *downsampler) add(p historyPoint) {
+	at := p.At.Truncate(self.bucket)
+	n := len(self.buckets)
+	if n == 0 || !self.buckets[n-1].At.Equal(at) {
+		self.buckets = append(self.buckets, historyBucket{At: at, Min: math.Inf(1), Max: math.Inf(-1)})
+		n++
+	}
+	current := &self.buckets[n-1]
+	current.Min = math.Min(current.Min, p.Value)
+	current.Max = math.Max(current.Max, p.Value)
+	current.Avg += p.Value
+	current.Count++
+}
+
+func (self *downsampler) series() []historyBucket {
+	ret := []historyBucket{}
+	for _, b := range self.buckets {
+		b.Avg /= float64(b.Count)
+		ret = append(ret, b)
+	}
+	return ret
+}
+
+func apiDevicesHistory(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	device := params["device"]
+	if _, ok := services.Config.Devices[device]; !ok {
+		notFound(w, fmt.Errorf("not found: %s", device))
+		return
+	}
+	q := r.URL.Query()
+	now := time.Now()
+	query := datalog.Query{
+		Device: device,
+		From:   now.Add(-24 * time.Hour),
+		To:     now,
+	}
+	if topic := q.Get("topic"); topic != "" {
+		query.Topics = []string{topic}
+	} else {
+		// the topics the device has been seen on
+		for topic := range DeviceState.Events(device) {
+			query.Topics = append(query.Topics, topic)
+		}
+		sort.Strings(query.Topics)
+	}
+	for name, t := range map[string]*time.Time{"from": &query.From, "to": &query.To} {
+		if s := q.Get(name); s != "" {
+			var err error
+			if *t, err = parseHistoryTime(now, s); err != nil {
+				badRequest(w, err)
+				return
+			}
+		}
+	}
+	if !query.From.Before(query.To) {
+		badRequest(w, errors.New("from must be before to"))
+		return
+	}
+	var bucket time.Duration
+	if s := q.Get("bucket"); s != "" {
+		var err error
+		if bucket, err = util.ParseDuration(s); err != nil || bucket <= 0 {
+			badRequest(w, fmt.Errorf("invalid bucket: %s", s))
+			return
+		}
+	}
+	field := q.Get("field")
+	if bucket > 0 && field == "" {
+		badRequest(w, errors.New("bucket requires field"))
+		return
+	}
+	limit := maxHistory
+	if s := q.Get("limit"); s != "" {
+		if n, err := strconv.Atoi(s); err == nil && n > 0 && n < maxHistory {
+			limit = n
+		}
+	}
+
+	if services.Config.Datalogger.Path == "" {
+		errorResponse(w, errors.New("datalogger path not configured"))
+		return
+	}
+	if len(query.Topics) == 0 {
+		badRequest(w, fmt.Errorf("topic required: %s not seen", device))
+		return
+	}
+
+	// read oldest first from the start of the range, stopping at the limit
+	truncated := false
+	events := []interface{}{}
+	points := []historyPoint{}
+	ds := downsampler{bucket: bucket}
+	err := datalog.Read(historyDir(), query, func(ev *pubsub.Event) bool {
+		switch {
+		case bucket > 0:
+			if p, ok := fieldPoint(ev, field); ok {
+				ds.add(p)
+			}
+			if len(ds.buckets) > limit {
+				ds.buckets = ds.buckets[:limit]
+				truncated = true
+			}
+		case field != "":
+			if p, ok := fieldPoint(ev, field); ok {
+				if len(points) == limit {
+					truncated = true
+				} else {
+					points = append(points, p)
+				}
+			}
+		default:
+			if len(events) == limit {
+				truncated = true
+			} else {
+				events = append(events, ev.Map())
+			}
+		}
+		return !truncated
+	})
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+
+	ret := map[string]interface{}{
+		"device":    device,
+		"from":      query.From,
+		"to":        query.To,
+		"topics":    query.Topics,
+		"truncated": truncated,
+	}
+	switch {
+	case bucket > 0:
+		ret["field"] = field
+		ret["bucket"] = bucket.String()
+		ret["series"] = ds.series()
+	case field != "":
+		ret["field"] = field
+		ret["series"] = points
+	default:
+		ret["events"] = events
+	}
+	jsonResponse(w, ret)
+}
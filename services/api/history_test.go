@@ -0,0 +1,98 @@
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/barnybug/gohome/config"
+	"github.com/barnybug/gohome/pubsub"
+	"github.com/barnybug/gohome/services"
+)
+
+var tempLog = `{"topic":"temp","device":"temp.hallway","temp":18.5,"timestamp":"2014-01-04 10:00:00.000"}
+{"topic":"temp","device":"temp.living","temp":20.0,"timestamp":"2014-01-04 10:01:00.000"}
+{"topic":"temp","device":"temp.hallway","temp":19.5,"timestamp":"2014-01-04 10:20:00.000"}
+{"topic":"temp","device":"temp.hallway","temp":17.0,"timestamp":"2014-01-04 11:05:00.000"}
+`
+
+var tempLogRotated = `{"topic":"temp","device":"temp.hallway","temp":15.0,"timestamp":"2014-01-04 09:00:00.000"}
+`
+
+func setupHistory(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "history")
+	require.NoError(t, err)
+	os.Mkdir(path.Join(dir, "temp"), 0755)
+	ioutil.WriteFile(path.Join(dir, "temp", "data.log"), []byte(tempLog), 0644)
+	ioutil.WriteFile(path.Join(dir, "temp", "data.log.1"), []byte(tempLogRotated), 0644)
+	services.Config = config.Must(config.OpenRaw([]byte(`
+datalogger:
+  path: /unused
+devices:
+  temp.hallway:
+    name: Hallway
+`)))
+	historyDir = func() string { return dir }
+	DeviceState = NewStateCache()
+	DeviceState.Update(pubsub.Parse(`{"topic":"temp","device":"temp.hallway","temp":17.0}`, ""), time.Now())
+	return func() {
+		os.RemoveAll(dir)
+		DeviceState = NewStateCache()
+	}
+}
+
+func TestDevicesHistory(t *testing.T) {
+	defer setupHistory(t)()
+
+	rec := apiRequest("GET", "/v1/devices/temp.hallway/history?from=2014-01-04&to=2014-01-05")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var ret struct {
+		Events    []map[string]interface{}
+		Topics    []string
+		Truncated bool
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &ret))
+	require.Equal(t, 4, len(ret.Events))
+	assert.Equal(t, 15.0, ret.Events[0]["temp"])
+	assert.Equal(t, 17.0, ret.Events[3]["temp"])
+	assert.Equal(t, []string{"temp"}, ret.Topics)
+	assert.False(t, ret.Truncated)
+
+	// oldest first, up to the limit
+	rec = apiRequest("GET", "/v1/devices/temp.hallway/history?from=2014-01-04&to=2014-01-05&limit=2")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &ret))
+	require.Equal(t, 2, len(ret.Events))
+	assert.Equal(t, 15.0, ret.Events[0]["temp"])
+	assert.Equal(t, 18.5, ret.Events[1]["temp"])
+	assert.True(t, ret.Truncated)
+
+	rec = apiRequest("GET", "/v1/devices/temp.hallway/history?topic=temp&from=2014-01-04T10:00:00Z&to=2014-01-04T12:00:00Z&field=temp")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"series":[{"at":"2014-01-04T10:00:00Z","value":18.5},{"at":"2014-01-04T10:20:00Z","value":19.5},{"at":"2014-01-04T11:05:00Z","value":17}]`)
+
+	rec = apiRequest("GET", "/v1/devices/temp.hallway/history?from=2014-01-04&to=2014-01-05&field=temp&bucket=1h")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"series":[{"at":"2014-01-04T09:00:00Z","min":15,"max":15,"avg":15,"count":1},{"at":"2014-01-04T10:00:00Z","min":18.5,"max":19.5,"avg":19,"count":2},{"at":"2014-01-04T11:00:00Z","min":17,"max":17,"avg":17,"count":1}]`)
+}
+
+func TestDevicesHistoryErrors(t *testing.T) {
+	defer setupHistory(t)()
+
+	assert.Equal(t, http.StatusNotFound, apiRequest("GET", "/v1/devices/temp.attic/history").Code)
+	assert.Equal(t, http.StatusBadRequest, apiRequest("GET", "/v1/devices/temp.hallway/history?from=yesterday").Code)
+	assert.Equal(t, http.StatusBadRequest, apiRequest("GET", "/v1/devices/temp.hallway/history?bucket=1h").Code)
+	assert.Equal(t, http.StatusBadRequest, apiRequest("GET", "/v1/devices/temp.hallway/history?topic=../etc").Code)
+	assert.Equal(t, http.StatusBadRequest, apiRequest("GET", "/v1/devices/temp.hallway/history?from=2014-01-05&to=2014-01-04").Code)
+
+	// no topic given, and none seen
+	DeviceState = NewStateCache()
+	assert.Equal(t, http.StatusBadRequest, apiRequest("GET", "/v1/devices/temp.hallway/history").Code)
+}
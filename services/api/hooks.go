@@ -0,0 +1,269 @@
+package api
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/barnybug/gohome/config"
+	"github.com/barnybug/gohome/pubsub"
+	"github.com/barnybug/gohome/services"
+	"github.com/barnybug/gohome/util"
+)
+
+// Maximum size of a webhook body.
+const maxHookBody = 1 << 20
+
+const defaultSignatureHeader = "X-Hub-Signature-256"
+
+var ErrRateLimited = errors.New("rate limited")
+var ErrHookNotSecured = errors.New("hook has no secret or hmac configured")
+
+// rateLimiter limits requests per hook in fixed windows.
+type rateLimiter struct {
+	sync.Mutex
+	windows map[string]*rateWindow
+}
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+// Allow returns true if the request is within rate per period.
+func (self *rateLimiter) Allow(name string, rate int, period time.Duration, now time.Time) bool {
+	if rate <= 0 {
+		return true
+	}
+	self.Lock()
+	defer self.Unlock()
+	w, ok := self.windows[name]
+	if !ok || now.Sub(w.start) >= period {
+		w = &rateWindow{start: now}
+		self.windows[name] = w
+	}
+	if w.count >= rate {
+		return false
+	}
+	w.count++
+	return true
+}
+
+var hookLimiter = &rateLimiter{windows: map[string]*rateWindow{}}
+
+// verifyHook checks the request's shared secret and/or HMAC signature of the
+// body. A hook with neither configured is refused, unless declared open.
+func verifyHook(conf config.HookConf, r *http.Request, body []byte) error {
+	if conf.Secret == "" && conf.Hmac == "" && !conf.Open {
+		return ErrHookNotSecured
+	}
+	if conf.Secret != "" {
+		secret := r.Header.Get("X-Hook-Secret")
+		if secret == "" {
+			secret = r.URL.Query().Get("secret")
+		}
+		if !secureCompare(secret, conf.Secret) {
+			return ErrUnauthorized
+		}
+	}
+	if conf.Hmac != "" {
+		header := conf.Signature
+		if header == "" {
+			header = defaultSignatureHeader
+		}
+		signature := strings.TrimPrefix(r.Header.Get(header), "sha256=")
+		got, err := hex.DecodeString(signature)
+		if err != nil || len(got) == 0 {
+			return ErrUnauthorized
+		}
+		mac := hmac.New(sha256.New, []byte(conf.Hmac))
+		mac.Write(body)
+		if !hmac.Equal(got, mac.Sum(nil)) {
+			return ErrUnauthorized
+		}
+	}
+	return nil
+}
+
+// parsePayload decodes a JSON body, or form values from the body and query.
+func parsePayload(r *http.Request, body []byte) (interface{}, error) {
+	trimmed := bytes.TrimSpace(body)
+	if strings.Contains(r.Header.Get("Content-Type"), "json") || bytes.HasPrefix(trimmed, []byte("{")) || bytes.HasPrefix(trimmed, []byte("[")) {
+		var payload interface{}
+		if err := json.Unmarshal(body, &payload); err != nil {
+			return nil, err
+		}
+		return payload, nil
+	}
+	values, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, err
+	}
+	for key, vs := range r.URL.Query() {
+		if key != "secret" {
+			values[key] = append(values[key], vs...)
+		}
+	}
+	payload := map[string]interface{}{}
+	for key := range values {
+		payload[key] = values.Get(key)
+	}
+	return payload, nil
+}
+
+// lookupPath looks up a $.dotted.path into the payload, indexing arrays by
+// number.
+func lookupPath(payload interface{}, path string) (interface{}, bool) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	value := payload
+	if path == "" {
+		return value, true
+	}
+	for _, key := range strings.Split(path, ".") {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if value, ok = v[key]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			value = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+func mapField(value string, payload interface{}) (interface{}, bool, error) {
+	switch {
+	case strings.HasPrefix(value, "$"):
+		v, ok := lookupPath(payload, value)
+		return v, ok, nil
+	case strings.Contains(value, "{{"):
+		tmpl, err := template.New("field").Option("missingkey=zero").Parse(value)
+		if err != nil {
+			return nil, false, err
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, payload); err != nil {
+			return nil, false, err
+		}
+		s := strings.TrimSpace(buf.String())
+		if s == "" || s == "<no value>" {
+			return nil, false, nil
+		}
+		return util.ParseArg(s), true, nil
+	}
+	return util.ParseArg(value), true, nil
+}
+
+// Fields only set from the hook config, never copied from the payload.
+var hookReserved = map[string]bool{"device": true, "topic": true, "source": true, "timestamp": true}
+
+// hookEvent maps the payload to an event. With no fields configured, the
+// payload's top level values are copied, except those reserved.
+func hookEvent(name string, conf config.HookConf, payload interface{}) (*pubsub.Event, error) {
+	fields := pubsub.Fields{}
+	if len(conf.Fields) == 0 {
+		if m, ok := payload.(map[string]interface{}); ok {
+			for key, value := range m {
+				switch value.(type) {
+				case map[string]interface{}, []interface{}:
+				default:
+					if !hookReserved[key] {
+						fields[key] = value
+					}
+				}
+			}
+		}
+	}
+	for field, value := range conf.Fields {
+		v, ok, err := mapField(value, payload)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %s", field, err)
+		}
+		if ok {
+			fields[field] = v
+		}
+	}
+	if _, ok := fields["source"]; !ok {
+		source := conf.Source
+		if source == "" {
+			source = "hook." + name
+		}
+		fields["source"] = source
+	}
+	topic := conf.Topic
+	if topic == "" {
+		topic = "hook"
+	}
+	ev := pubsub.NewEvent(topic, fields)
+	if ev.Device() == "" {
+		services.Config.AddDeviceToEvent(ev)
+	}
+	return ev, nil
+}
+
+func apiHook(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	name := params["name"]
+	conf, ok := services.Config.Api.Hooks[name]
+	if !ok {
+		notFound(w, fmt.Errorf("not found: %s", name))
+		return
+	}
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("POST required"))
+		return
+	}
+	// limited before verifying, so guessing the secret is too
+	period := conf.Period.Duration
+	if period == 0 {
+		period = time.Minute
+	}
+	if !hookLimiter.Allow(name, conf.Rate, period, time.Now()) {
+		writeError(w, http.StatusTooManyRequests, ErrRateLimited)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxHookBody))
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+	if err := verifyHook(conf, r, body); err == ErrHookNotSecured {
+		writeError(w, http.StatusForbidden, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	payload, err := parsePayload(r, body)
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+	ev, err := hookEvent(name, conf, payload)
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+	services.Publisher.Emit(ev)
+	jsonResponse(w, ev.Map())
+}
@@ -0,0 +1,188 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/barnybug/gohome/config"
+	"github.com/barnybug/gohome/pubsub/dummy"
+	"github.com/barnybug/gohome/services"
+)
+
+var hooksYaml = `
+devices:
+  bell.front:
+    source: hook.doorbell
+api:
+  users:
+    admin:
+      token: 4dm1n
+      role: admin
+  hooks:
+    owntracks:
+      secret: s3cr3t
+      topic: location
+      fields:
+        device: person.me
+        lat: $.lat
+        lon: $.lon
+        first: $.waypoints.0.desc
+        missing: $.nothing
+    doorbell:
+      hmac: k3y
+      topic: doorbell
+      fields:
+        command: '{{if .pressed}}on{{else}}off{{end}}'
+    form:
+      open: true
+      rate: 2
+      period: 1h
+    unsecured:
+      topic: alarm
+`
+
+func hookRequest(url, body string, headers map[string]string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", url, strings.NewReader(body))
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	apiHandler().ServeHTTP(rec, r)
+	return rec
+}
+
+func setupHooks() *dummy.Publisher {
+	services.Config = config.Must(config.OpenRaw([]byte(hooksYaml)))
+	publisher := &dummy.Publisher{}
+	services.Publisher = publisher
+	hookLimiter = &rateLimiter{windows: map[string]*rateWindow{}}
+	return publisher
+}
+
+func TestHookSecret(t *testing.T) {
+	publisher := setupHooks()
+	body := `{"lat": 51.5, "lon": -0.1, "waypoints": [{"desc": "home"}]}`
+
+	// no api credentials required, but the hook secret is
+	rec := hookRequest("/hooks/owntracks", body, nil)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	rec = hookRequest("/hooks/owntracks?secret=wrong", body, nil)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Empty(t, publisher.Events)
+
+	rec = hookRequest("/v1/hooks/owntracks", body, map[string]string{"X-Hook-Secret": "s3cr3t"})
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, 1, len(publisher.Events))
+	ev := publisher.Events[0]
+	assert.Equal(t, "location", ev.Topic)
+	assert.Equal(t, "person.me", ev.Device())
+	assert.Equal(t, "hook.owntracks", ev.Source())
+	assert.Equal(t, 51.5, ev.Fields["lat"])
+	assert.Equal(t, -0.1, ev.Fields["lon"])
+	assert.Equal(t, "home", ev.Fields["first"])
+	assert.NotContains(t, ev.Fields, "missing")
+
+	rec = hookRequest("/hooks/owntracks?secret=s3cr3t", body, nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestHookHmac(t *testing.T) {
+	publisher := setupHooks()
+	body := `{"pressed": true}`
+	mac := hmac.New(sha256.New, []byte("k3y"))
+	mac.Write([]byte(body))
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	rec := hookRequest("/hooks/doorbell", body, map[string]string{"X-Hub-Signature-256": "sha256=00"})
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	rec = hookRequest("/hooks/doorbell", `{"pressed": false}`, map[string]string{"X-Hub-Signature-256": signature})
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	rec = hookRequest("/hooks/doorbell", body, map[string]string{"X-Hub-Signature-256": signature})
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, 1, len(publisher.Events))
+	ev := publisher.Events[0]
+	assert.Equal(t, "doorbell", ev.Topic)
+	assert.Equal(t, "on", ev.Command())
+	// device looked up by source
+	assert.Equal(t, "bell.front", ev.Device())
+}
+
+func TestHookForm(t *testing.T) {
+	publisher := setupHooks()
+	headers := map[string]string{"Content-Type": "application/x-www-form-urlencoded"}
+	rec := hookRequest("/hooks/form?value=12.5", "name=front", headers)
+	require.Equal(t, http.StatusOK, rec.Code)
+	ev := publisher.Events[0]
+	assert.Equal(t, "hook", ev.Topic)
+	assert.Equal(t, "front", ev.Fields["name"])
+	assert.Equal(t, "12.5", ev.Fields["value"])
+
+	// device, topic and source only from the config
+	rec = hookRequest("/hooks/form", `{"device": "bell.front", "topic": "command", "source": "hook.doorbell"}`, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	ev = publisher.Events[1]
+	assert.Equal(t, "hook", ev.Topic)
+	assert.Equal(t, "", ev.Device())
+	assert.Equal(t, "hook.form", ev.Source())
+
+	// rate limited
+	rec = hookRequest("/v1/hooks/form", "", headers)
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, `{"error":"rate limited","status":429}`+"\n", rec.Body.String())
+	assert.Equal(t, 2, len(publisher.Events))
+}
+
+func TestHookErrors(t *testing.T) {
+	setupHooks()
+	rec := hookRequest("/hooks/unknown", "{}", nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = hookRequest("/hooks/form", "{bad json", nil)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	r := httptest.NewRequest("GET", "/hooks/form", nil)
+	rec = httptest.NewRecorder()
+	apiHandler().ServeHTTP(rec, r)
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+
+	// neither secret nor hmac, and not declared open
+	rec = hookRequest("/hooks/unsecured", "{}", nil)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	// other endpoints still require credentials
+	rec = hookRequest("/devices/control?id=bell.front&command=on", "", nil)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+}
+
+func TestHookRateLimitedFirst(t *testing.T) {
+	publisher := setupHooks()
+	conf := services.Config.Api.Hooks["owntracks"]
+	conf.Rate = 1
+	services.Config.Api.Hooks["owntracks"] = conf
+	rec := hookRequest("/hooks/owntracks?secret=wrong", "{}", nil)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	// limited before the secret is checked
+	rec = hookRequest("/hooks/owntracks?secret=s3cr3t", "{}", nil)
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Empty(t, publisher.Events)
+}
+
+func TestRateLimiter(t *testing.T) {
+	limiter := &rateLimiter{windows: map[string]*rateWindow{}}
+	now := time.Date(2014, 1, 4, 10, 0, 0, 0, time.UTC)
+	assert.True(t, limiter.Allow("a", 1, time.Minute, now))
+	assert.False(t, limiter.Allow("a", 1, time.Minute, now.Add(30*time.Second)))
+	assert.True(t, limiter.Allow("b", 1, time.Minute, now))
+	assert.True(t, limiter.Allow("a", 1, time.Minute, now.Add(time.Minute)))
+	assert.True(t, limiter.Allow("a", 0, time.Minute, now))
+}
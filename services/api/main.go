@@ -1,26 +1,63 @@
 // Package api is a service providing an HTTP REST API to access gohome and control devices.
 //
+// With api users configured, requests must authenticate by bearer token
+// (Authorization: Bearer <token>), basic auth or an access_token parameter.
+// Users have a role: read, control (optionally limited to device groups) or
+// admin (config, schedules and logs). Cross-origin requests are then only
+// allowed from the api origins configured.
+//
+// All endpoints are also served under /v1 (eg /v1/devices), which returns JSON
+// error bodies {"error": message, "status": code}, JSON query responses and
+// config, and 504 when a service doesn't respond. The OpenAPI description is
+// at /v1/openapi.json.
+//
 // The endpoints supported are:
 //
+// http://localhost:8723/ - web dashboard: devices, heating, automata and logs
+//
 // http://localhost:8723/config?path=config - GET configuration or POST to update configuration
 //
-// http://localhost:8723/devices - list of devices and events
+// http://localhost:8723/devices?since=<etag> - list of devices and events, or only those changed since the ETag (all after a restart)
 //
 // http://localhost:8723/devices/control?id=device&control=0 - turn a device on or off
 //
 // http://localhost:8723/devices/<devicename> - single device with events
 //
+// http://localhost:8723/devices/<devicename>/history?topic=temp&from=24h&to=&field=temp&bucket=1h&limit=1000 - device history from the datalogger, oldest first
+//
+// http://localhost:8723/scenes - list of scenes
+//
+// http://localhost:8723/scenes/<scene>?command=on - single scene, POST to activate (on) or restore (off)
+//
 // http://localhost:8723/heating/status - get the status of heating
 //
 // http://localhost:8723/heating/set?temp=20&until=1h - set heating to 'temp' until 'until'
 //
+// http://localhost:8723/heating/profile?name=wfh&until=2014-01-10 - get or switch the heating schedule profile
+//
+// http://localhost:8723/heating/schedule/<zone> - GET zone schedule or PUT to replace it
+//
+// http://localhost:8723/automata - list automata, with states and transitions
+//
+// http://localhost:8723/automata/<name> - single automaton, POST {"state": "..."} to /automata/<name>/state to force a state
+//
 // http://localhost:8723/events/feed - continuous live stream of events (line delimited)
 //
+// http://localhost:8723/events/sse?topics=temp&devices=light.kitchen - live stream of events as Server-Sent Events
+//
+// http://localhost:8723/events/sse/<id> - POST {"action": "subscribe", "topics": [...]} to change an sse stream's subscription
+//
+// http://localhost:8723/ws?topics=temp - live stream of events over a WebSocket, accepting subscribe, unsubscribe and command actions
+//
 // http://localhost:8723/query/{query} - query a service, e.g. http://localhost:8723/query/heating/status
 //
+// http://localhost:8723/hooks/<name> - POST an inbound webhook, publishing the payload mapped to an event
+//
+// http://localhost:8723/metrics - Prometheus metrics
+//
 // http://localhost:8723/logs - stream logs, until disconnect
 //
-// http://localhost:8723/voice - perform a voice query command
+// http://localhost:8723/voice?q=turn+on+the+kitchen+light - perform a voice command, matched to an intent
 package api
 
 import (
@@ -31,17 +68,19 @@ import (
 	"log"
 	"math"
 	"net/http"
-	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/barnybug/gohome/config"
+	"github.com/barnybug/gohome/lib/light"
+	"github.com/barnybug/gohome/lib/schedule"
 	"github.com/barnybug/gohome/pubsub"
 	"github.com/barnybug/gohome/services"
 	"github.com/barnybug/gohome/util"
 
 	"github.com/gorilla/mux"
+	"gopkg.in/yaml.v2"
 )
 
 // Service api
@@ -49,7 +88,6 @@ type Service struct {
 }
 
 var Debug bool = false
-var DeviceState = map[string]map[string]*pubsub.Event{}
 
 // ID of the service
 func (service *Service) ID() string {
@@ -57,11 +95,11 @@ func (service *Service) ID() string {
 }
 
 func errorResponse(w http.ResponseWriter, err error) {
-	http.Error(w, err.Error(), http.StatusInternalServerError)
+	writeError(w, http.StatusInternalServerError, err)
 }
 
 func badRequest(w http.ResponseWriter, err error) {
-	http.Error(w, err.Error(), http.StatusBadRequest)
+	writeError(w, http.StatusBadRequest, err)
 }
 
 type VarsHandler func(http.ResponseWriter, *http.Request, map[string]string)
@@ -71,12 +109,6 @@ func (h VarsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	h(w, req, vars)
 }
 
-func apiIndex(w http.ResponseWriter, r *http.Request) {
-	w.Header().Add("Content-Type", "text/html")
-	fmt.Fprintf(w, "<html>Gohome is listening</html>")
-
-}
-
 func jsonResponse(w http.ResponseWriter, obj interface{}) {
 	w.Header().Add("Content-Type", "application/json; charset=utf-8")
 	enc := json.NewEncoder(w)
@@ -89,9 +121,25 @@ func jsonResponse(w http.ResponseWriter, obj interface{}) {
 const DefaultQueryTimeout = 500
 
 func query(endpoint string, q string, timeout int64, responses int64, w http.ResponseWriter) {
-	w.Header().Add("Content-Type", "application/json; charset=utf-8")
-
 	ch := services.QueryChannel(endpoint+" "+q, time.Duration(timeout)*time.Millisecond)
+	if isV1(w) {
+		// collect responses as a JSON array
+		ret := []interface{}{}
+		for ev := range ch {
+			ret = append(ret, ev.Map())
+			if int64(len(ret)) >= responses {
+				break
+			}
+		}
+		if len(ret) == 0 {
+			writeError(w, http.StatusGatewayTimeout, ErrTimeout)
+			return
+		}
+		jsonResponse(w, ret)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
 
 	var n int64 = 0
 	for ev := range ch {
@@ -105,7 +153,7 @@ func query(endpoint string, q string, timeout int64, responses int64, w http.Res
 }
 
 func apiQuery(w http.ResponseWriter, r *http.Request) {
-	endpoint := r.URL.Path[len("/query/"):]
+	endpoint := queryEndpoint(r)
 	qvals := r.URL.Query()
 	q := qvals.Get("q")
 	timeout, err := strconv.ParseInt(qvals.Get("timeout"), 10, 32)
@@ -123,27 +171,45 @@ func apiVoice(w http.ResponseWriter, r *http.Request) {
 	q := r.URL.Query().Get("q")
 	log.Printf("Received voice request: '%s'", q)
 
-	body := ""
-	for key, value := range services.Config.Voice {
-		re, err := regexp.Compile(key)
-		if err != nil {
-			continue
-		}
-		var match = re.FindStringSubmatchIndex(q)
-		if match != nil {
-			// Expand $1 matches in the command
-			var dst []byte
-			result := re.ExpandString(dst, value, q, match)
-			body = string(result)
-		}
-	}
-	if body == "" {
+	match := services.MatchIntent(q)
+	if match == nil {
 		log.Printf("Not understood: '%s'", q)
+		if isV1(w) {
+			badRequest(w, fmt.Errorf("Not understood: '%s'", q))
+			return
+		}
 		fmt.Fprintf(w, "Not understood: '%s'", q)
 		return
 	}
+	log.Printf("Voice intent %s: %s", match.Intent, match.Query)
+	devices, err := queryDevices(match.Query)
+	if err == nil {
+		err = checkControl(requestUser(r), devices)
+	}
+	if err != nil {
+		log.Printf("Voice query refused: %s", err)
+		status := http.StatusBadRequest
+		if err == ErrForbidden {
+			status = http.StatusForbidden
+		}
+		if isV1(w) {
+			writeError(w, status, err)
+			return
+		}
+		w.WriteHeader(status)
+		fmt.Fprintf(w, "error: %s", err)
+		return
+	}
 
-	resp, err := services.RPC(body, time.Second*5)
+	resp, err := services.RPC(match.Query, time.Second*5)
+	if isV1(w) {
+		if err != nil {
+			errorResponse(w, err)
+			return
+		}
+		jsonResponse(w, map[string]string{"response": resp, "intent": match.Intent, "query": match.Query})
+		return
+	}
 	if err == nil {
 		log.Printf("Voice response: '%s'", resp)
 		fmt.Fprintf(w, resp)
@@ -153,16 +219,22 @@ func apiVoice(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func getDevicesEvents() map[string]map[string]interface{} {
+// getDevicesEvents returns the devices, or only those changed since a cache
+// version if not nil.
+func getDevicesEvents(changed map[string]bool) map[string]map[string]interface{} {
 	ret := make(map[string]map[string]interface{})
 	for device, conf := range services.Config.Devices {
-		ret[device] = deviceEntry(conf, DeviceState[device])
+		if changed != nil && !changed[device] {
+			continue
+		}
+		ret[device] = deviceEntry(conf)
 	}
 	// returns {device: {topic: {event}}}
 	return ret
 }
 
-func deviceEntry(dev config.DeviceConf, events map[string]*pubsub.Event) map[string]interface{} {
+func deviceEntry(dev config.DeviceConf) map[string]interface{} {
+	events := DeviceState.Events(dev.Id)
 	value := make(map[string]interface{})
 	value["id"] = dev.Id
 	value["name"] = dev.Name
@@ -177,60 +249,230 @@ func deviceEntry(dev config.DeviceConf, events map[string]*pubsub.Event) map[str
 		ev[topic] = event.Map()
 	}
 	value["events"] = ev
+	if len(events) > 0 {
+		seen := map[string]interface{}{}
+		for topic, t := range DeviceState.Seen(dev.Id) {
+			seen[topic] = t.Format(time.RFC3339)
+		}
+		value["seen"] = seen
+	}
 	return value
 }
 
+// notModified sets the ETag of the cache version, returning true if the client
+// already has it.
+func notModified(w http.ResponseWriter, r *http.Request, version uint64) bool {
+	etag := fmt.Sprintf(`"%s"`, DeviceState.Tag(version))
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
 func apiDevices(w http.ResponseWriter, r *http.Request) {
-	ret := getDevicesEvents()
+	// read the version first, so changes during the request are fetched next time
+	version := DeviceState.Version()
+	if notModified(w, r, version) {
+		return
+	}
+	var changed map[string]bool
+	if s := r.FormValue("since"); s != "" {
+		since, ok, err := DeviceState.ParseTag(strings.Trim(s, `"`))
+		if err != nil {
+			badRequest(w, fmt.Errorf("invalid since: %s", s))
+			return
+		}
+		if ok {
+			changed = DeviceState.ChangedSince(since)
+		}
+		// else from before a restart: all devices
+	}
+	ret := getDevicesEvents(changed)
 	jsonResponse(w, ret)
 }
 
 func apiDevicesSingle(w http.ResponseWriter, r *http.Request, params map[string]string) {
 	device := params["device"]
 	if dev, ok := services.Config.Devices[device]; ok {
-		ret := deviceEntry(dev, DeviceState[device])
+		if notModified(w, r, DeviceState.DeviceVersion(device)) {
+			return
+		}
+		ret := deviceEntry(dev)
 		jsonResponse(w, ret)
 	} else {
-		w.WriteHeader(http.StatusNotFound)
-		fmt.Fprintf(w, "not found: %s", device)
+		notFound(w, fmt.Errorf("not found: %s", device))
 	}
 }
 
+// controlEvents builds the command events to send to a device or target.
+func controlEvents(target string, fields pubsub.Fields) ([]*pubsub.Event, []string, error) {
+	devices, err := services.ResolveTarget(target)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var evs []*pubsub.Event
+	for _, device := range devices {
+		ev := pubsub.NewEvent("command", pubsub.Fields{
+			"topic":  "command",
+			"device": device,
+		})
+		for key, value := range fields {
+			ev.SetField(key, value)
+		}
+		if dev := services.Config.Devices[device]; light.IsLight(dev) {
+			// validate and normalise light commands
+			command, err := light.Parse(ev)
+			if err != nil {
+				return nil, nil, err
+			}
+			command = command.Restrict(light.DeviceCaps(dev))
+			ev = command.Event(device)
+		}
+		evs = append(evs, ev)
+	}
+	return evs, devices, nil
+}
+
 func apiDevicesControl(w http.ResponseWriter, r *http.Request) {
 	q := r.URL.Query()
-	device := q.Get("id")
-	matches := services.MatchDevices(device)
-	if len(matches) == 0 {
-		badRequest(w, errors.New("device not found"))
+	target := q.Get("id")
+	fields := pubsub.Fields{}
+	for key, values := range q {
+		if key != "id" {
+			fields[key] = util.ParseArg(values[0])
+		}
+	}
+	// send command to each device
+	evs, devices, err := controlEvents(target, fields)
+	if err != nil {
+		badRequest(w, err)
 		return
 	}
-	if len(matches) > 1 {
-		badRequest(w, errors.New("device is ambiguous"))
+	if err := checkControl(requestUser(r), devices); err != nil {
+		forbidden(w)
 		return
 	}
-	device = matches[0]
+	services.EmitCommands(evs)
+	if services.IsTarget(target) {
+		jsonResponse(w, devices)
+		return
+	}
+	jsonResponse(w, true)
+}
 
-	// send command
-	fields := pubsub.Fields{
-		"topic":  "command",
-		"device": device,
+func sceneEntry(name string, scene config.SceneConf) map[string]interface{} {
+	id := "scene." + name
+	value := deviceEntry(services.Config.Devices[id])
+	value["restore"] = scene.Restore
+	commands := []map[string]interface{}{}
+	for _, c := range scene.Commands {
+		command := map[string]interface{}{"device": c.Device}
+		if c.Command != "" {
+			command["command"] = c.Command
+		}
+		for k, v := range c.Fields {
+			command[k] = v
+		}
+		commands = append(commands, command)
 	}
-	ev := pubsub.NewEvent("command", fields)
-	for key, values := range q {
-		ev.SetField(key, util.ParseArg(values[0]))
+	value["commands"] = commands
+	return value
+}
+
+func apiScenes(w http.ResponseWriter, r *http.Request) {
+	ret := map[string]interface{}{}
+	for name, scene := range services.Config.Scenes {
+		ret["scene."+name] = sceneEntry(name, scene)
 	}
-	services.Publisher.Emit(ev)
-	jsonResponse(w, true)
+	jsonResponse(w, ret)
+}
+
+func apiScenesSingle(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	name := strings.TrimPrefix(params["scene"], "scene.")
+	scene, ok := services.Config.Scenes[name]
+	if !ok {
+		notFound(w, fmt.Errorf("not found: %s", params["scene"]))
+		return
+	}
+	if r.Method == "POST" {
+		if err := checkControl(requestUser(r), []string{"scene." + name}); err != nil {
+			forbidden(w)
+			return
+		}
+		command := r.URL.Query().Get("command")
+		if command == "" {
+			command = "on"
+		}
+		if command != "on" && command != "off" {
+			badRequest(w, errors.New("command should be on or off"))
+			return
+		}
+		ev := pubsub.NewCommand("scene."+name, command)
+		services.Publisher.Emit(ev)
+		jsonResponse(w, true)
+		return
+	}
+	jsonResponse(w, sceneEntry(name, scene))
 }
 
 func apiHeatingStatus(w http.ResponseWriter, r *http.Request) {
-	w.Header().Add("Content-Type", "application/json; charset=utf-8")
-	ch := services.QueryChannel("heating/status", 100*time.Millisecond)
+	ch := services.QueryChannel("heating/status", time.Duration(DefaultQueryTimeout)*time.Millisecond)
 	ev := <-ch
+	if ev == nil {
+		timeout(w)
+		return
+	}
 	ret := ev.Fields["json"]
 	jsonResponse(w, ret)
 }
 
+func apiHeatingProfile(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	arg := strings.TrimSpace(q.Get("name") + " " + q.Get("until"))
+	ch := services.QueryChannel("heating/profile "+arg, time.Duration(DefaultQueryTimeout)*time.Millisecond)
+	ev := <-ch
+	if ev == nil {
+		timeout(w)
+		return
+	}
+	if ret, ok := ev.Fields["json"]; ok {
+		jsonResponse(w, ret)
+		return
+	}
+	// not found or invalid
+	badRequest(w, errors.New(ev.StringField("message")))
+}
+
+func apiHeatingSchedule(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	zone := params["zone"]
+	zoneConf, ok := services.Config.Heating.Zones[zone]
+	if !ok {
+		notFound(w, fmt.Errorf("not found: %s", zone))
+		return
+	}
+	if r.Method == "PUT" {
+		var conf config.ScheduleConf
+		if err := json.NewDecoder(r.Body).Decode(&conf); err != nil {
+			badRequest(w, err)
+			return
+		}
+		err := services.EditConfig(services.Publisher, func(raw []byte) ([]byte, error) {
+			return schedule.Replace(raw, zone, conf)
+		})
+		if err != nil {
+			badRequest(w, err)
+			return
+		}
+		log.Printf("%s schedule changed, emitted config event", zone)
+		jsonResponse(w, conf)
+		return
+	}
+	jsonResponse(w, zoneConf.Schedule)
+}
+
 func apiHeatingSet(w http.ResponseWriter, r *http.Request) {
 	q := r.URL.Query()
 	for _, name := range []string{"id", "temp", "until"} {
@@ -258,7 +500,11 @@ func apiEventsFeed(w http.ResponseWriter, r *http.Request) {
 	}
 	defer services.Subscriber.Close(ch)
 
+	user := requestUser(r)
 	for ev := range ch {
+		if !user.CanSee(ev.Topic) {
+			continue
+		}
 		data := ev.Map()
 		encoder := json.NewEncoder(w)
 		err := encoder.Encode(data)
@@ -311,7 +557,18 @@ func apiConfig(w http.ResponseWriter, r *http.Request) {
 	// get existing value
 	value := services.Configurations.Get(path)
 
-	if r.Method == "GET" {
+	if r.Method == "GET" && isV1(w) {
+		if value == nil {
+			notFound(w, fmt.Errorf("not found: %s", path))
+			return
+		}
+		var data interface{}
+		if err := yaml.Unmarshal(value, &data); err != nil {
+			errorResponse(w, err)
+			return
+		}
+		jsonResponse(w, convertJSON(data))
+	} else if r.Method == "GET" {
 		w.Header().Add("Content-Type", "application/yaml; charset=utf-8")
 		w.Write(value)
 	} else if r.Method == "POST" {
@@ -349,22 +606,6 @@ func apiLogs(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func router() *mux.Router {
-	router := mux.NewRouter()
-	router.Path("/").HandlerFunc(apiIndex)
-	router.PathPrefix("/query/").HandlerFunc(apiQuery)
-	router.Path("/voice").HandlerFunc(apiVoice)
-	router.Path("/devices").HandlerFunc(apiDevices)
-	router.Path("/devices/control").HandlerFunc(apiDevicesControl)
-	router.Handle("/devices/{device}", VarsHandler(apiDevicesSingle))
-	router.Path("/heating/status").HandlerFunc(apiHeatingStatus)
-	router.Path("/heating/set").HandlerFunc(apiHeatingSet)
-	router.Path("/events/feed").HandlerFunc(apiEventsFeed)
-	router.Path("/config").HandlerFunc(apiConfig)
-	router.Path("/logs").HandlerFunc(apiLogs)
-	return router
-}
-
 type loggingHandler struct {
 	Handler http.Handler
 }
@@ -379,10 +620,12 @@ func (service loggingHandler) ServeHTTP(w http.ResponseWriter, req *http.Request
 func httpEndpoint() {
 	// disabled logger as this prevents ResponseWriter.Flush being accessed
 	// handler := handlers.LoggingHandler(os.Stdout, router())
-	var handler http.Handler = router()
-	handler = loggingHandler{Handler: handler}
+	handler := apiHandler()
+	if len(services.Config.Api.Users) == 0 {
+		log.Println("Warning: no api users configured, authentication disabled")
+	}
 	// Allow CORS+http auth (so the api can be placed behind http auth)
-	corsHandler := CORSHandler{Handler: handler}
+	corsHandler := CORSHandler{Handler: handler, AllowOrigin: allowedOrigin}
 	corsHandler.SupportsCredentials = true
 	corsHandler.AllowHeaders = func(headers []string) bool {
 		for _, header := range headers {
@@ -403,18 +646,17 @@ func httpEndpoint() {
 
 func recordEvents() {
 	for ev := range services.Subscriber.Channel() {
+		// live streams
+		Streams.Deliver(ev)
 		// record to store
-		if ev.Device() != "" {
-			if _, ok := DeviceState[ev.Device()]; !ok {
-				DeviceState[ev.Device()] = make(map[string]*pubsub.Event)
-			}
-			DeviceState[ev.Device()][ev.Topic] = ev
-		}
+		DeviceState.Update(ev, time.Now())
 	}
 }
 
 // Run the service
 func (service *Service) Run() error {
+	restoreState()
+	go saveState()
 	go recordEvents()
 	httpEndpoint()
 	return nil
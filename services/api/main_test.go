@@ -1,9 +1,11 @@
 package api
 
 import (
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -21,7 +23,12 @@ func TestIndex(t *testing.T) {
 	rec := httptest.NewRecorder()
 	r := http.Request{}
 	apiIndex(rec, &r)
-	assert.Equal(t, rec.Body.String(), `<html>Gohome is listening</html>`)
+	assert.Equal(t, "text/html; charset=utf-8", rec.Header().Get("Content-Type"))
+	assert.Contains(t, rec.Body.String(), "<title>gohome</title>")
+	// self-contained, no CDN
+	assert.NotContains(t, rec.Body.String(), "http://")
+	assert.NotContains(t, rec.Body.String(), "https://")
+	assert.NotContains(t, rec.Body.String(), "src=")
 }
 
 func TestDevices(t *testing.T) {
@@ -70,3 +77,72 @@ func TestDevicesControlMissing(t *testing.T) {
 	apiDevicesControl(rec, &r)
 	assert.Equal(t, rec.Body.String(), "device not found\n")
 }
+
+func TestScenes(t *testing.T) {
+	services.Config = config.ExampleConfig
+	rec := httptest.NewRecorder()
+	r := http.Request{}
+	apiScenes(rec, &r)
+	assert.Contains(t, rec.Body.String(), `"scene.movie":{"aliases":null,"caps":["scene","reversible"],"commands":[{"command":"on","device":"light.glowworm","level":20},{"command":"off","device":"light.kitchen"}],"events":{},"group":"scenes","id":"scene.movie","name":"Movie","restore":true}`)
+}
+
+func TestScenesActivate(t *testing.T) {
+	services.Config = config.ExampleConfig
+	me := dummy.Publisher{}
+	services.Publisher = &me
+	rec := httptest.NewRecorder()
+	uri, _ := url.Parse("http://example.com/scenes/movie?command=off")
+	r := http.Request{Method: "POST", URL: uri}
+	apiScenesSingle(rec, &r, map[string]string{"scene": "movie"})
+	assert.Equal(t, "true\n", rec.Body.String())
+	assert.Equal(t, "scene.movie", me.Events[0].Device())
+	assert.Equal(t, "off", me.Events[0].Command())
+}
+
+func TestScenesSingleNotFound(t *testing.T) {
+	services.Config = config.ExampleConfig
+	rec := httptest.NewRecorder()
+	r := http.Request{}
+	apiScenesSingle(rec, &r, map[string]string{"scene": "abc"})
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+var heatingYaml = `heating:
+  device: heater.boiler
+  zones:
+    hallway:
+      sensor: temp.hallway
+      # weekends only
+      schedule:
+        Weekends:
+        - 09:00-22:30: 15.5
+`
+
+func TestHeatingSchedule(t *testing.T) {
+	services.RawConfig = []byte(heatingYaml)
+	services.Config = config.Must(config.OpenRaw(services.RawConfig))
+	me := dummy.Publisher{}
+	services.Publisher = &me
+
+	rec := httptest.NewRecorder()
+	r := http.Request{Method: "GET"}
+	apiHeatingSchedule(rec, &r, map[string]string{"zone": "hallway"})
+	assert.Equal(t, `{"Weekends":[{"09:00-22:30":15.5}]}`+"\n", rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	r = http.Request{Method: "PUT", Body: ioutil.NopCloser(strings.NewReader(`{"All":[{"08:00-22:00":18}]}`))}
+	apiHeatingSchedule(rec, &r, map[string]string{"zone": "hallway"})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, 1, len(me.Events))
+	assert.Equal(t, "config", me.Events[0].Topic)
+	assert.Contains(t, string(me.Events[0].Raw), "      # weekends only\n      schedule:\n        All:\n        - 08:00-22:00: 18\n")
+
+	rec = httptest.NewRecorder()
+	r = http.Request{Method: "PUT", Body: ioutil.NopCloser(strings.NewReader(`{"All":[{"8am":18}]}`))}
+	apiHeatingSchedule(rec, &r, map[string]string{"zone": "hallway"})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = httptest.NewRecorder()
+	apiHeatingSchedule(rec, &r, map[string]string{"zone": "attic"})
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
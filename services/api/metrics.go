@@ -0,0 +1,169 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/barnybug/gohome/lib/graphite"
+	"github.com/barnybug/gohome/pubsub"
+	"github.com/barnybug/gohome/services"
+)
+
+// Events dropped by live stream clients not keeping up.
+var streamDropped pubsub.Counter
+
+type labels map[string]string
+
+type sample struct {
+	Labels labels
+	Value  float64
+}
+
+// metric is a Prometheus metric family.
+type metric struct {
+	Name    string
+	Help    string
+	Type    string
+	Samples []sample
+}
+
+// metrics collects metric families by name, written in name order.
+type metrics map[string]*metric
+
+func (self metrics) Add(name, help, typ string, value float64, ls labels) {
+	m, ok := self[name]
+	if !ok {
+		m = &metric{Name: name, Help: help, Type: typ}
+		self[name] = m
+	}
+	m.Samples = append(m.Samples, sample{Labels: ls, Value: value})
+}
+
+var reMetricName = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+func metricName(s string) string {
+	return reMetricName.ReplaceAllString(s, "_")
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (self labels) String() string {
+	if len(self) == 0 {
+		return ""
+	}
+	var keys []string
+	for key := range self {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var ps []string
+	for _, key := range keys {
+		ps = append(ps, fmt.Sprintf(`%s="%s"`, key, labelEscaper.Replace(self[key])))
+	}
+	return "{" + strings.Join(ps, ",") + "}"
+}
+
+// Write the metrics in the Prometheus text exposition format.
+func (self metrics) Write(w io.Writer) {
+	var names []string
+	for name := range self {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		m := self[name]
+		sort.SliceStable(m.Samples, func(i, j int) bool {
+			return m.Samples[i].Labels.String() < m.Samples[j].Labels.String()
+		})
+		fmt.Fprintf(w, "# HELP %s %s\n", name, m.Help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, m.Type)
+		for _, s := range m.Samples {
+			fmt.Fprintf(w, "%s%s %g\n", name, s.Labels, s.Value)
+		}
+	}
+}
+
+// automatonStates lists the states of the automaton from its state event,
+// including the current state.
+func automatonStates(ev *pubsub.Event) []string {
+	current := ev.StringField("state")
+	states := []string{}
+	found := false
+	switch vs := ev.Fields["states"].(type) {
+	case []string:
+		states = append(states, vs...)
+	case []interface{}:
+		// decoded from json
+		for _, v := range vs {
+			if s, ok := v.(string); ok {
+				states = append(states, s)
+			}
+		}
+	}
+	for _, state := range states {
+		found = found || state == current
+	}
+	if !found {
+		states = append(states, current)
+	}
+	return states
+}
+
+// collectMetrics gathers the metrics from the device state: numeric device
+// fields, service heartbeats and automata states; and the api's own pubsub
+// counters.
+func collectMetrics() metrics {
+	ms := metrics{}
+	for device, topics := range DeviceState.All() {
+		for topic, ev := range topics {
+			switch {
+			case topic == "heartbeat":
+				service := strings.TrimPrefix(device, "heartbeat.")
+				if uptime, ok := graphite.NumericValue(ev.Fields["uptime"]); ok {
+					ms.Add("gohome_service_uptime_seconds", "Service uptime at its last heartbeat.", "gauge", uptime, labels{"service": service})
+				}
+				ms.Add("gohome_service_heartbeat_timestamp_seconds", "Time of the service's last heartbeat.", "gauge", float64(ev.Timestamp.Unix()), labels{"service": service})
+			case topic == "state" && ev.Source() == "automata":
+				// StateSet: every state, 1 for the current and 0 for the others
+				current := ev.StringField("state")
+				for _, state := range automatonStates(ev) {
+					value := 0.0
+					if state == current {
+						value = 1
+					}
+					ms.Add("gohome_automaton_state", "Current state of an automaton.", "gauge", value, labels{"automaton": device, "state": state})
+				}
+			default:
+				dev, ok := services.Config.Devices[device]
+				if !ok {
+					continue
+				}
+				for field, value := range graphite.NumericFields(ev) {
+					name := "gohome_device_" + metricName(field)
+					ms.Add(name, fmt.Sprintf("Device %s reading.", field), "gauge", value, labels{
+						"device":   device,
+						"topic":    topic,
+						"group":    dev.Group,
+						"location": dev.Location,
+					})
+				}
+			}
+		}
+	}
+
+	// counted by this process only, not across services
+	ms.Add("gohome_api_pubsub_processed_total", "Events received and processed from pubsub by the api.", "counter", float64(pubsub.EventsReceived.Value()), nil)
+	ms.Add("gohome_api_pubsub_published_total", "Events published to pubsub by the api.", "counter", float64(pubsub.EventsPublished.Value()), nil)
+	ms.Add("gohome_api_pubsub_dropped_total", "Events dropped by the api as its publish queue was full.", "counter", float64(pubsub.EventsDropped.Value()), nil)
+	ms.Add("gohome_stream_dropped_total", "Events dropped by live stream clients not keeping up.", "counter", float64(streamDropped.Value()), nil)
+	return ms
+}
+
+func apiMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	collectMetrics().Write(w)
+}
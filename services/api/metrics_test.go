@@ -0,0 +1,76 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/barnybug/gohome/config"
+	"github.com/barnybug/gohome/pubsub"
+	"github.com/barnybug/gohome/services"
+)
+
+func TestMetrics(t *testing.T) {
+	services.Config = config.Must(config.OpenRaw([]byte(`
+devices:
+  temp.hallway:
+    name: Hallway
+    group: downstairs
+    location: hall
+  light.kitchen:
+    name: Kitchen
+`)))
+	at := time.Date(2014, 1, 4, 10, 0, 0, 0, time.UTC)
+	event := func(topic string, fields pubsub.Fields) *pubsub.Event {
+		ev := pubsub.NewEvent(topic, fields)
+		ev.Timestamp = at
+		return ev
+	}
+	DeviceState = NewStateCache()
+	for _, ev := range []*pubsub.Event{
+		event("temp", pubsub.Fields{"device": "temp.hallway", "temp": 18.5, "humidity": 40.0, "source": "ff01"}),
+		event("ack", pubsub.Fields{"device": "light.kitchen", "command": "on"}),
+		event("heartbeat", pubsub.Fields{"device": "heartbeat.heating", "pid": 123, "uptime": 3600.0}),
+		event("state", pubsub.Fields{"device": "bathroom.light", "state": "On", "trigger": "pir", "states": []interface{}{"Off", "On"}, "source": "automata"}),
+		event("state", pubsub.Fields{"device": "hallway.light", "state": "Off", "source": "automata"}),
+		event("state", pubsub.Fields{"device": "house.presence", "state": "Full"}),
+		event("temp", pubsub.Fields{"device": "unknown.device", "temp": 5.0}),
+	} {
+		DeviceState.Update(ev, at)
+	}
+	defer func() { DeviceState = NewStateCache() }()
+
+	rec := apiRequest("GET", "/metrics")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", rec.Header().Get("Content-Type"))
+	body := rec.Body.String()
+	assert.Contains(t, body, `# HELP gohome_automaton_state Current state of an automaton.
+# TYPE gohome_automaton_state gauge
+gohome_automaton_state{automaton="bathroom.light",state="Off"} 0
+gohome_automaton_state{automaton="bathroom.light",state="On"} 1
+gohome_automaton_state{automaton="hallway.light",state="Off"} 1
+`)
+	assert.Contains(t, body, `# TYPE gohome_device_temp gauge
+gohome_device_temp{device="temp.hallway",group="downstairs",location="hall",topic="temp"} 18.5
+`)
+	assert.Contains(t, body, `gohome_device_humidity{device="temp.hallway",group="downstairs",location="hall",topic="temp"} 40`)
+	assert.NotContains(t, body, "unknown.device")
+	// not from the automata service
+	assert.NotContains(t, body, "house.presence")
+	assert.NotContains(t, body, "gohome_device_source")
+	// on/off as 1/0
+	assert.Contains(t, body, `gohome_device_command{device="light.kitchen",group="",location="",topic="ack"} 1`)
+	assert.Contains(t, body, `gohome_service_uptime_seconds{service="heating"} 3600`)
+	assert.Contains(t, body, `gohome_service_heartbeat_timestamp_seconds{service="heating"} 1.3888296e+09`)
+	assert.Contains(t, body, "# TYPE gohome_api_pubsub_processed_total counter\ngohome_api_pubsub_processed_total ")
+	assert.Contains(t, body, "gohome_api_pubsub_dropped_total ")
+}
+
+func TestMetricsLabelEscaping(t *testing.T) {
+	assert.Equal(t, `{a="x\"y\\z\n",b="2"}`, labels{"b": "2", "a": "x\"y\\z\n"}.String())
+	assert.Equal(t, "", labels{}.String())
+	assert.Equal(t, "gohome_device_a_b", "gohome_device_"+metricName("a.b"))
+}
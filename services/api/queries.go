@@ -0,0 +1,112 @@
+package api
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/barnybug/gohome/lib/graphite"
+	"github.com/barnybug/gohome/pubsub"
+	"github.com/barnybug/gohome/services"
+)
+
+// QueryHandlers for the questions answered from the device state, used by
+// the built in voice and chat intents.
+func (service *Service) QueryHandlers() services.QueryHandlers {
+	return services.QueryHandlers{
+		"temperature": services.TextHandler(queryTemperature),
+		"presence":    services.TextHandler(queryPresence),
+		"intent":      queryIntent,
+		"help": services.StaticHandler("" +
+			"temperature device: latest temperature\n" +
+			"presence: who is home\n" +
+			"intent text: show the query text is understood as"),
+	}
+}
+
+func deviceName(id string) string {
+	if dev, ok := services.Config.Devices[id]; ok && dev.Name != "" {
+		return dev.Name
+	}
+	return id
+}
+
+// latestTemperature is the most recent temp reading of the device, on any
+// topic.
+func latestTemperature(device string) *pubsub.Event {
+	var latest *pubsub.Event
+	for _, ev := range DeviceState.Events(device) {
+		if _, ok := graphite.NumericValue(ev.Fields["temp"]); !ok {
+			continue
+		}
+		if latest == nil || ev.Timestamp.After(latest.Timestamp) {
+			latest = ev
+		}
+	}
+	return latest
+}
+
+func queryTemperature(q services.Question) string {
+	device := strings.TrimSpace(q.Args)
+	if device == "" {
+		return "device required"
+	}
+	if _, ok := services.Config.Devices[device]; !ok {
+		return fmt.Sprintf("device %s not found", device)
+	}
+	ev := latestTemperature(device)
+	if ev == nil {
+		return fmt.Sprintf("No temperature for %s", deviceName(device))
+	}
+	temp, _ := graphite.NumericValue(ev.Fields["temp"])
+	return fmt.Sprintf("%s is %g°C", deviceName(device), temp)
+}
+
+// joinNames joins names as "a, b and c".
+func joinNames(names []string) string {
+	if len(names) == 1 {
+		return names[0]
+	}
+	return strings.Join(names[:len(names)-1], ", ") + " and " + names[len(names)-1]
+}
+
+func queryPresence(q services.Question) string {
+	var people, home []string
+	for id, dev := range services.Config.Devices {
+		if dev.Cap["presence"] || dev.Prefix() == "person" {
+			people = append(people, id)
+		}
+	}
+	if len(people) == 0 {
+		return "No presence devices"
+	}
+	sort.Strings(people)
+	for _, id := range people {
+		if ev, ok := DeviceState.Events(id)["presence"]; ok && ev.Command() == "on" {
+			home = append(home, deviceName(id))
+		}
+	}
+	switch len(home) {
+	case 0:
+		return "Nobody is home"
+	case 1:
+		return home[0] + " is home"
+	}
+	return joinNames(home) + " are home"
+}
+
+func queryIntent(q services.Question) services.Answer {
+	match := services.MatchIntent(q.Args)
+	if match == nil {
+		return services.Answer{Text: fmt.Sprintf("Not understood: '%s'", q.Args)}
+	}
+	return services.Answer{
+		Text: fmt.Sprintf("%s: %s", match.Intent, match.Query),
+		Json: map[string]interface{}{
+			"intent": match.Intent,
+			"query":  match.Query,
+			"slots":  match.Slots,
+			"score":  match.Score,
+		},
+	}
+}
@@ -0,0 +1,96 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/barnybug/gohome/config"
+	"github.com/barnybug/gohome/pubsub"
+	"github.com/barnybug/gohome/services"
+)
+
+var queriesYaml = `
+devices:
+  light.kitchen:
+    name: Kitchen
+    caps: [switch]
+  temp.hallway:
+    name: Hallway
+  person.alice:
+    name: Alice
+    caps: [presence]
+  person.bob:
+    name: Bob
+    caps: [presence]
+  person.carol:
+    name: Carol
+    caps: [presence]
+`
+
+func setupQueries() {
+	services.Config = config.Must(config.OpenRaw([]byte(queriesYaml)))
+	DeviceState = NewStateCache()
+}
+
+func presence(device, command string) {
+	ev := pubsub.NewEvent("presence", pubsub.Fields{"device": device, "command": command})
+	DeviceState.Update(ev, time.Now())
+}
+
+func TestQueryTemperature(t *testing.T) {
+	setupQueries()
+	q := services.Question{Verb: "temperature", Args: "temp.hallway"}
+	assert.Equal(t, "No temperature for Hallway", queryTemperature(q))
+
+	ev := pubsub.NewEvent("temp", pubsub.Fields{"device": "temp.hallway", "temp": 18.5})
+	DeviceState.Update(ev, time.Now())
+	assert.Equal(t, "Hallway is 18.5°C", queryTemperature(q))
+
+	q.Args = "temp.garage"
+	assert.Equal(t, "device temp.garage not found", queryTemperature(q))
+}
+
+func TestQueryPresence(t *testing.T) {
+	setupQueries()
+	q := services.Question{Verb: "presence"}
+	assert.Equal(t, "Nobody is home", queryPresence(q))
+	presence("person.bob", "on")
+	assert.Equal(t, "Bob is home", queryPresence(q))
+	presence("person.alice", "on")
+	presence("person.carol", "on")
+	assert.Equal(t, "Alice, Bob and Carol are home", queryPresence(q))
+	presence("person.bob", "off")
+	assert.Equal(t, "Alice and Carol are home", queryPresence(q))
+}
+
+func TestQueryIntent(t *testing.T) {
+	setupQueries()
+	a := queryIntent(services.Question{Verb: "intent", Args: "turn the kitchen light on"})
+	assert.Equal(t, "switch: switch light.kitchen on", a.Text)
+	a = queryIntent(services.Question{Verb: "intent", Args: "make tea"})
+	assert.Equal(t, "Not understood: 'make tea'", a.Text)
+	assert.Nil(t, a.Json)
+}
+
+func TestVoice(t *testing.T) {
+	setupQueries()
+	publisher := answer(pubsub.Fields{"message": "Switched light.kitchen on"})
+	rec := apiRequest("GET", "/v1/voice?q=switch+on+the+kitchen+light")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `{"intent":"switch","query":"switch light.kitchen on","response":"Switched light.kitchen on"}`+"\n", rec.Body.String())
+	assert.Equal(t, "switch light.kitchen on", publisher.Events[0].StringField("query"))
+
+	publisher = answer(pubsub.Fields{"message": "Bob is home"})
+	rec = apiRequest("GET", "/voice?q=Is+anyone+home%3F")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "Bob is home", rec.Body.String())
+	assert.Equal(t, "api/presence", publisher.Events[0].StringField("query"))
+
+	rec = apiRequest("GET", "/v1/voice?q=make+tea")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = apiRequest("GET", "/voice?q=make+tea")
+	assert.Equal(t, "Not understood: 'make tea'", rec.Body.String())
+}
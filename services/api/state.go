@@ -0,0 +1,271 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/barnybug/gohome/config"
+	"github.com/barnybug/gohome/pubsub"
+)
+
+// File the device state is persisted to, so readings survive restarts. Empty
+// disables persistence.
+var stateFile = config.ConfigPath("api.state")
+
+// Interval between saves of the device state, when changed.
+var stateSaveInterval = time.Minute
+
+type stateEntry struct {
+	Event   *pubsub.Event
+	Seen    time.Time // when last received
+	Version uint64    // cache version when last changed
+}
+
+// StateCache is the latest event per device and topic, safe for concurrent
+// use. Every update increments the cache version, so clients can fetch only
+// the devices changed since a version they've seen.
+//
+// Versions are only comparable within the epoch of a cache: a restart can
+// restore an older snapshot, and so reuse versions clients have already seen.
+type StateCache struct {
+	mu      sync.RWMutex
+	epoch   string
+	devices map[string]map[string]*stateEntry
+	version uint64
+	saved   uint64
+}
+
+func NewStateCache() *StateCache {
+	return &StateCache{
+		epoch:   strconv.FormatInt(time.Now().UnixNano(), 36),
+		devices: map[string]map[string]*stateEntry{},
+	}
+}
+
+// DeviceState is the state of all devices, recorded from events.
+var DeviceState = NewStateCache()
+
+// Update records a device event.
+func (self *StateCache) Update(ev *pubsub.Event, now time.Time) {
+	device := ev.Device()
+	if device == "" {
+		return
+	}
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if _, ok := self.devices[device]; !ok {
+		self.devices[device] = map[string]*stateEntry{}
+	}
+	self.version++
+	self.devices[device][ev.Topic] = &stateEntry{Event: ev, Seen: now, Version: self.version}
+}
+
+// Events returns the latest event by topic for the device.
+func (self *StateCache) Events(device string) map[string]*pubsub.Event {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	ret := map[string]*pubsub.Event{}
+	for topic, entry := range self.devices[device] {
+		ret[topic] = entry.Event
+	}
+	return ret
+}
+
+// Seen returns when each topic was last received for the device.
+func (self *StateCache) Seen(device string) map[string]time.Time {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	ret := map[string]time.Time{}
+	for topic, entry := range self.devices[device] {
+		ret[topic] = entry.Seen
+	}
+	return ret
+}
+
+// All returns the latest events of all devices, by device and topic.
+func (self *StateCache) All() map[string]map[string]*pubsub.Event {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	ret := map[string]map[string]*pubsub.Event{}
+	for device, topics := range self.devices {
+		ret[device] = map[string]*pubsub.Event{}
+		for topic, entry := range topics {
+			ret[device][topic] = entry.Event
+		}
+	}
+	return ret
+}
+
+// Version returns the current cache version.
+func (self *StateCache) Version() uint64 {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	return self.version
+}
+
+// Tag returns the token given to clients for a version: the version qualified
+// by the epoch.
+func (self *StateCache) Tag(version uint64) string {
+	return fmt.Sprintf("%s-%d", self.epoch, version)
+}
+
+// ParseTag returns the version of a token. ok is false if the token is from
+// another epoch, so the version is unknown.
+func (self *StateCache) ParseTag(tag string) (version uint64, ok bool, err error) {
+	i := strings.LastIndex(tag, "-")
+	if i == -1 {
+		return 0, false, fmt.Errorf("invalid tag: %s", tag)
+	}
+	version, err = strconv.ParseUint(tag[i+1:], 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid tag: %s", tag)
+	}
+	return version, tag[:i] == self.epoch, nil
+}
+
+// DeviceVersion returns the version the device last changed at, 0 if never.
+func (self *StateCache) DeviceVersion(device string) uint64 {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	var version uint64
+	for _, entry := range self.devices[device] {
+		if entry.Version > version {
+			version = entry.Version
+		}
+	}
+	return version
+}
+
+// ChangedSince returns the devices changed after version.
+func (self *StateCache) ChangedSince(version uint64) map[string]bool {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	ret := map[string]bool{}
+	for device, topics := range self.devices {
+		for _, entry := range topics {
+			if entry.Version > version {
+				ret[device] = true
+				break
+			}
+		}
+	}
+	return ret
+}
+
+type persistedEntry struct {
+	Event   json.RawMessage `json:"event"`
+	Seen    time.Time       `json:"seen"`
+	Version uint64          `json:"version"`
+}
+
+type persistedCache struct {
+	Version uint64                               `json:"version"`
+	Devices map[string]map[string]persistedEntry `json:"devices"`
+}
+
+// Save a snapshot of the cache, if changed since last saved.
+func (self *StateCache) Save(path string) error {
+	self.mu.RLock()
+	if self.version == self.saved {
+		self.mu.RUnlock()
+		return nil
+	}
+	snapshot := persistedCache{Version: self.version, Devices: map[string]map[string]persistedEntry{}}
+	for device, topics := range self.devices {
+		snapshot.Devices[device] = map[string]persistedEntry{}
+		for topic, entry := range topics {
+			data, err := json.Marshal(entry.Event.Map())
+			if err != nil {
+				self.mu.RUnlock()
+				return err
+			}
+			snapshot.Devices[device][topic] = persistedEntry{Event: data, Seen: entry.Seen, Version: entry.Version}
+		}
+	}
+	self.mu.RUnlock()
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	// write atomically
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	self.mu.Lock()
+	self.saved = snapshot.Version
+	self.mu.Unlock()
+	return nil
+}
+
+// Restore the snapshot saved previously. Events already received are kept.
+func (self *StateCache) Restore(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var snapshot persistedCache
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return err
+	}
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	for device, topics := range snapshot.Devices {
+		if _, ok := self.devices[device]; !ok {
+			self.devices[device] = map[string]*stateEntry{}
+		}
+		for topic, pe := range topics {
+			if _, ok := self.devices[device][topic]; ok {
+				continue
+			}
+			ev := pubsub.Parse(string(pe.Event), topic)
+			if ev == nil {
+				continue
+			}
+			self.devices[device][topic] = &stateEntry{Event: ev, Seen: pe.Seen, Version: pe.Version}
+		}
+	}
+	// versions carry on past those restored
+	if snapshot.Version > self.version {
+		self.version = snapshot.Version
+	}
+	self.saved = self.version
+	return nil
+}
+
+// saveState saves the device state periodically.
+func saveState() {
+	if stateFile == "" {
+		return
+	}
+	for range time.Tick(stateSaveInterval) {
+		if err := DeviceState.Save(stateFile); err != nil {
+			log.Println("Saving device state failed:", err)
+		}
+	}
+}
+
+// restoreState restores the device state saved previously.
+func restoreState() {
+	if stateFile == "" {
+		return
+	}
+	if err := DeviceState.Restore(stateFile); err != nil {
+		log.Println("Restoring device state failed:", err)
+		return
+	}
+	log.Println("Restored device state")
+}
@@ -0,0 +1,146 @@
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/barnybug/gohome/config"
+	"github.com/barnybug/gohome/pubsub"
+	"github.com/barnybug/gohome/services"
+)
+
+var stateAt = time.Date(2014, 1, 4, 10, 0, 0, 0, time.UTC)
+
+func TestStateCache(t *testing.T) {
+	cache := NewStateCache()
+	cache.Update(pubsub.NewEvent("temp", pubsub.Fields{"device": "temp.hallway", "temp": 18.5}), stateAt)
+	cache.Update(pubsub.NewEvent("ack", pubsub.Fields{"device": "light.kitchen", "command": "on"}), stateAt.Add(time.Minute))
+	cache.Update(pubsub.NewEvent("alert", pubsub.Fields{"message": "no device"}), stateAt)
+	assert.Equal(t, uint64(2), cache.Version())
+	assert.Equal(t, uint64(1), cache.DeviceVersion("temp.hallway"))
+	assert.Equal(t, uint64(0), cache.DeviceVersion("light.other"))
+	assert.Equal(t, 18.5, cache.Events("temp.hallway")["temp"].Fields["temp"])
+	assert.Equal(t, map[string]time.Time{"ack": stateAt.Add(time.Minute)}, cache.Seen("light.kitchen"))
+
+	assert.Equal(t, map[string]bool{"temp.hallway": true, "light.kitchen": true}, cache.ChangedSince(0))
+	assert.Equal(t, map[string]bool{"light.kitchen": true}, cache.ChangedSince(1))
+	assert.Equal(t, map[string]bool{}, cache.ChangedSince(2))
+}
+
+func TestStateCacheConcurrent(t *testing.T) {
+	cache := NewStateCache()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				cache.Update(pubsub.NewEvent("temp", pubsub.Fields{"device": "temp.hallway", "temp": float64(j)}), stateAt)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				cache.All()
+				cache.Events("temp.hallway")
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, uint64(400), cache.Version())
+}
+
+func TestStateCachePersist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "api.state")
+
+	cache := NewStateCache()
+	ev := pubsub.NewEvent("temp", pubsub.Fields{"device": "temp.hallway", "temp": 18.5})
+	cache.Update(ev, stateAt)
+	require.NoError(t, cache.Save(file))
+
+	restored := NewStateCache()
+	require.NoError(t, restored.Restore(file))
+	assert.Equal(t, uint64(1), restored.Version())
+	events := restored.Events("temp.hallway")
+	require.Contains(t, events, "temp")
+	assert.Equal(t, 18.5, events["temp"].Fields["temp"])
+	assert.Equal(t, ev.Timestamp.Format(pubsub.TimeFormat), events["temp"].Timestamp.Format(pubsub.TimeFormat))
+	assert.True(t, stateAt.Equal(restored.Seen("temp.hallway")["temp"]))
+
+	// versions carry on
+	restored.Update(pubsub.NewEvent("temp", pubsub.Fields{"device": "temp.living", "temp": 20.0}), stateAt)
+	assert.Equal(t, uint64(2), restored.Version())
+	// but a restart's tags aren't comparable
+	_, ok, err := restored.ParseTag(cache.Tag(2))
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	// missing file is not an error
+	assert.NoError(t, NewStateCache().Restore(path.Join(dir, "missing")))
+}
+
+func TestDevicesSince(t *testing.T) {
+	services.Config = config.ExampleConfig
+	DeviceState = NewStateCache()
+	defer func() { DeviceState = NewStateCache() }()
+	DeviceState.Update(pubsub.NewEvent("ack", pubsub.Fields{"device": "light.kitchen", "command": "on"}), stateAt)
+
+	rec := apiRequest("GET", "/v1/devices")
+	require.Equal(t, http.StatusOK, rec.Code)
+	tag := DeviceState.Tag(1)
+	assert.Equal(t, `"`+tag+`"`, rec.Header().Get("ETag"))
+	var ret map[string]map[string]interface{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &ret))
+	assert.True(t, len(ret) > 1)
+	assert.Equal(t, map[string]interface{}{"ack": "2014-01-04T10:00:00Z"}, ret["light.kitchen"]["seen"])
+
+	// not modified
+	r := httptest.NewRequest("GET", "/v1/devices", nil)
+	r.Header.Set("If-None-Match", `"`+tag+`"`)
+	rec = httptest.NewRecorder()
+	apiHandler().ServeHTTP(rec, r)
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+
+	rec = apiRequest("GET", "/v1/devices?since="+tag)
+	assert.Equal(t, "{}\n", rec.Body.String())
+
+	DeviceState.Update(pubsub.NewEvent("ack", pubsub.Fields{"device": "light.glowworm", "command": "off"}), stateAt)
+	rec = apiRequest("GET", "/v1/devices?since="+tag)
+	assert.Equal(t, `"`+DeviceState.Tag(2)+`"`, rec.Header().Get("ETag"))
+	ret = nil
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &ret))
+	assert.Equal(t, []string{"light.glowworm"}, keys(ret))
+
+	rec = apiRequest("GET", "/v1/devices?since=x")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	// from before a restart: all devices
+	rec = apiRequest("GET", "/v1/devices?since=0ld3poch-1")
+	ret = nil
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &ret))
+	assert.True(t, len(ret) > 2)
+
+	rec = apiRequest("GET", "/v1/devices/light.kitchen")
+	assert.Equal(t, `"`+tag+`"`, rec.Header().Get("ETag"))
+}
+
+func keys(m map[string]map[string]interface{}) []string {
+	var ret []string
+	for k := range m {
+		ret = append(ret, k)
+	}
+	return ret
+}
@@ -0,0 +1,378 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/barnybug/gohome/pubsub"
+	"github.com/barnybug/gohome/services"
+)
+
+// Interval between heartbeat pings on live streams.
+var streamPing = 30 * time.Second
+
+// Events buffered per stream client, beyond which events are dropped rather
+// than holding up delivery to everyone else.
+const streamBuffer = 256
+
+// streamMessage is a message from a stream client: subscribe or unsubscribe
+// to topics/devices, or send a command.
+type streamMessage struct {
+	Action  string        `json:"action"`
+	Topics  []string      `json:"topics"`
+	Devices []string      `json:"devices"`
+	Device  string        `json:"device"`
+	Command string        `json:"command"`
+	Fields  pubsub.Fields `json:"fields"` // additional command fields, eg level
+}
+
+// streamClient is a live event stream, filtered by topic and device.
+type streamClient struct {
+	ID      string
+	User    *User
+	Events  chan *pubsub.Event
+	mu      sync.Mutex
+	topics  map[string]bool
+	devices map[string]bool
+	dropped int
+}
+
+func newStreamID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+func newStreamClient(user *User, topics, devices []string) *streamClient {
+	client := &streamClient{
+		ID:      newStreamID(),
+		User:    user,
+		Events:  make(chan *pubsub.Event, streamBuffer),
+		topics:  map[string]bool{},
+		devices: map[string]bool{},
+	}
+	client.subscribe(topics, devices)
+	return client
+}
+
+func (self *streamClient) subscribe(topics, devices []string) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	for _, topic := range topics {
+		self.topics[topic] = true
+	}
+	for _, device := range devices {
+		self.devices[device] = true
+	}
+}
+
+func (self *streamClient) unsubscribe(topics, devices []string) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	for _, topic := range topics {
+		delete(self.topics, topic)
+	}
+	for _, device := range devices {
+		delete(self.devices, device)
+	}
+}
+
+// Subscriptions returns the topics and devices subscribed to. Empty means all.
+func (self *streamClient) Subscriptions() map[string][]string {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	ret := map[string][]string{"topics": {}, "devices": {}}
+	for topic := range self.topics {
+		ret["topics"] = append(ret["topics"], topic)
+	}
+	for device := range self.devices {
+		ret["devices"] = append(ret["devices"], device)
+	}
+	return ret
+}
+
+// Match returns true if the client is subscribed to the event, and may see
+// it.
+func (self *streamClient) Match(ev *pubsub.Event) bool {
+	if !self.User.CanSee(ev.Topic) {
+		return false
+	}
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if len(self.topics) > 0 && !self.topics[ev.Topic] {
+		return false
+	}
+	if len(self.devices) > 0 && !self.devices[ev.Device()] {
+		return false
+	}
+	return true
+}
+
+// Deliver queues the event for the client, or drops it if the client is not
+// keeping up.
+func (self *streamClient) Deliver(ev *pubsub.Event) {
+	if !self.Match(ev) {
+		return
+	}
+	select {
+	case self.Events <- ev:
+	default:
+		streamDropped.Inc()
+		self.mu.Lock()
+		self.dropped++
+		self.mu.Unlock()
+	}
+}
+
+// Dropped returns and resets the count of events dropped.
+func (self *streamClient) Dropped() int {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	n := self.dropped
+	self.dropped = 0
+	return n
+}
+
+// Handle a message from the client, returning the reply.
+func (self *streamClient) Handle(msg streamMessage) (map[string]interface{}, error) {
+	switch msg.Action {
+	case "subscribe":
+		self.subscribe(msg.Topics, msg.Devices)
+	case "unsubscribe":
+		self.unsubscribe(msg.Topics, msg.Devices)
+	case "command":
+		fields := pubsub.Fields{}
+		for key, value := range msg.Fields {
+			fields[key] = value
+		}
+		if msg.Command != "" {
+			fields["command"] = msg.Command
+		}
+		devices, err := sendCommand(self.User, msg.Device, fields)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"type": "ack", "action": msg.Action, "devices": devices}, nil
+	default:
+		return nil, fmt.Errorf("unknown action: %s", msg.Action)
+	}
+	return map[string]interface{}{"type": "ack", "action": msg.Action, "subscriptions": self.Subscriptions()}, nil
+}
+
+// streams are the live stream clients connected.
+type streams struct {
+	sync.Mutex
+	clients map[string]*streamClient
+}
+
+var Streams = &streams{clients: map[string]*streamClient{}}
+
+func (self *streams) Add(client *streamClient) {
+	self.Lock()
+	defer self.Unlock()
+	self.clients[client.ID] = client
+}
+
+func (self *streams) Remove(client *streamClient) {
+	self.Lock()
+	defer self.Unlock()
+	delete(self.clients, client.ID)
+}
+
+func (self *streams) Get(id string) (*streamClient, bool) {
+	self.Lock()
+	defer self.Unlock()
+	client, ok := self.clients[id]
+	return client, ok
+}
+
+// Deliver an event to all the stream clients.
+func (self *streams) Deliver(ev *pubsub.Event) {
+	self.Lock()
+	defer self.Unlock()
+	for _, client := range self.clients {
+		client.Deliver(ev)
+	}
+}
+
+func errorMessage(err error) map[string]interface{} {
+	return map[string]interface{}{"type": "error", "message": err.Error()}
+}
+
+func pingMessage(dropped int) map[string]interface{} {
+	msg := map[string]interface{}{"type": "ping"}
+	if dropped > 0 {
+		msg["dropped"] = dropped
+	}
+	return msg
+}
+
+func eventMessage(ev *pubsub.Event) map[string]interface{} {
+	return map[string]interface{}{"type": "event", "event": ev.Map()}
+}
+
+func apiWebsocket(ws *websocket.Conn) {
+	q := ws.Request().URL.Query()
+	client := newStreamClient(requestUser(ws.Request()), splitList(q.Get("topics")), splitList(q.Get("devices")))
+	Streams.Add(client)
+	defer Streams.Remove(client)
+
+	// read client messages
+	replies := make(chan map[string]interface{}, 16)
+	done := make(chan bool)
+	quit := make(chan bool)
+	defer close(quit)
+	go func() {
+		defer close(done)
+		for {
+			var msg streamMessage
+			var reply map[string]interface{}
+			if err := websocket.JSON.Receive(ws, &msg); err != nil {
+				if _, ok := err.(*json.SyntaxError); !ok {
+					return
+				}
+				reply = errorMessage(err)
+			} else if reply, err = client.Handle(msg); err != nil {
+				reply = errorMessage(err)
+			}
+			select {
+			case replies <- reply:
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(streamPing)
+	defer ping.Stop()
+	var err error
+	err = websocket.JSON.Send(ws, map[string]interface{}{"type": "hello", "id": client.ID, "subscriptions": client.Subscriptions()})
+	for err == nil {
+		select {
+		case ev := <-client.Events:
+			err = websocket.JSON.Send(ws, eventMessage(ev))
+		case reply := <-replies:
+			err = websocket.JSON.Send(ws, reply)
+		case <-ping.C:
+			err = websocket.JSON.Send(ws, pingMessage(client.Dropped()))
+		case <-done:
+			return
+		}
+	}
+}
+
+func writeSSE(w http.ResponseWriter, event string, data interface{}) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, b); err != nil {
+		return err
+	}
+	w.(http.Flusher).Flush()
+	return nil
+}
+
+func apiEventsSSE(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	client := newStreamClient(requestUser(r), splitList(q.Get("topics")), splitList(q.Get("devices")))
+	Streams.Add(client)
+	defer Streams.Remove(client)
+
+	w.Header().Add("Content-Type", "text/event-stream")
+	w.Header().Add("Cache-Control", "no-cache")
+	ping := time.NewTicker(streamPing)
+	defer ping.Stop()
+	// the id is used to change the subscription: POST /events/sse/{id}
+	err := writeSSE(w, "hello", map[string]interface{}{"id": client.ID, "subscriptions": client.Subscriptions()})
+	for err == nil {
+		select {
+		case ev := <-client.Events:
+			err = writeSSE(w, ev.Topic, ev.Map())
+		case <-ping.C:
+			err = writeSSE(w, "ping", pingMessage(client.Dropped()))
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func apiEventsSSEControl(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	client, ok := Streams.Get(params["id"])
+	if user := requestUser(r); ok && user != nil && client.User != nil && user.Name != client.User.Name {
+		// only the user's own streams
+		ok = false
+	}
+	if !ok {
+		notFound(w, fmt.Errorf("not found: %s", params["id"]))
+		return
+	}
+	if r.Method != "POST" {
+		jsonResponse(w, client.Subscriptions())
+		return
+	}
+	var msg streamMessage
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		badRequest(w, err)
+		return
+	}
+	reply, err := client.Handle(msg)
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+	jsonResponse(w, reply)
+}
+
+// sendCommand sends a command to a device or target, as /devices/control.
+func sendCommand(user *User, target string, fields pubsub.Fields) ([]string, error) {
+	if target == "" {
+		return nil, errors.New("device required")
+	}
+	evs, devices, err := controlEvents(target, fields)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkControl(user, devices); err != nil {
+		return nil, err
+	}
+	services.EmitCommands(evs)
+	return devices, nil
+}
+
+// websocketHandshake checks the Origin browsers send, allowing the api's own
+// host and the origins allowed cross-origin requests, so other sites can't
+// open a stream with the user's credentials.
+func websocketHandshake(conf *websocket.Config, r *http.Request) error {
+	var err error
+	conf.Origin, err = websocket.Origin(conf, r)
+	if err != nil {
+		return err
+	}
+	if conf.Origin == nil {
+		// not a browser
+		return nil
+	}
+	if conf.Origin.Host == r.Host || allowedOrigin(conf.Origin.Scheme+"://"+conf.Origin.Host) {
+		return nil
+	}
+	return ErrForbidden
+}
+
+var websocketServer = websocket.Server{Handler: apiWebsocket, Handshake: websocketHandshake}
@@ -0,0 +1,137 @@
+package api
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/websocket"
+
+	"github.com/barnybug/gohome/config"
+	"github.com/barnybug/gohome/pubsub"
+	"github.com/barnybug/gohome/pubsub/dummy"
+	"github.com/barnybug/gohome/services"
+)
+
+func waitForStreams(t *testing.T, n int) {
+	for i := 0; i < 100; i++ {
+		Streams.Lock()
+		count := len(Streams.clients)
+		Streams.Unlock()
+		if count == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expected %d streams", n)
+}
+
+func TestStreamClient(t *testing.T) {
+	client := newStreamClient(nil, []string{"temp"}, nil)
+	client.Deliver(pubsub.NewEvent("temp", pubsub.Fields{"device": "temp.hallway"}))
+	client.Deliver(pubsub.NewEvent("power", pubsub.Fields{"device": "power.house"}))
+	assert.Equal(t, 1, len(client.Events))
+
+	client.Handle(streamMessage{Action: "subscribe", Devices: []string{"temp.living"}})
+	client.Deliver(pubsub.NewEvent("temp", pubsub.Fields{"device": "temp.hallway"}))
+	assert.Equal(t, 1, len(client.Events))
+	client.Handle(streamMessage{Action: "unsubscribe", Topics: []string{"temp"}, Devices: []string{"temp.living"}})
+	client.Deliver(pubsub.NewEvent("power", pubsub.Fields{"device": "power.house"}))
+	assert.Equal(t, 2, len(client.Events))
+
+	// full clients drop rather than block
+	for i := 0; i < streamBuffer; i++ {
+		client.Deliver(pubsub.NewEvent("power", pubsub.Fields{}))
+	}
+	assert.Equal(t, streamBuffer, len(client.Events))
+	assert.Equal(t, 2, client.Dropped())
+	assert.Equal(t, 0, client.Dropped())
+
+	_, err := client.Handle(streamMessage{Action: "explode"})
+	assert.EqualError(t, err, "unknown action: explode")
+}
+
+func TestStreamCommand(t *testing.T) {
+	services.Config = config.ExampleConfig
+	me := dummy.Publisher{}
+	services.Publisher = &me
+	client := newStreamClient(nil, nil, nil)
+	reply, err := client.Handle(streamMessage{Action: "command", Device: "light.kitchen", Command: "on"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"light.kitchen"}, reply["devices"])
+	require.Equal(t, 1, len(me.Events))
+	assert.Equal(t, "on", me.Events[0].Command())
+
+	_, err = client.Handle(streamMessage{Action: "command", Device: "x", Command: "on"})
+	assert.Equal(t, services.ErrDeviceNotFound, err)
+}
+
+func TestWebsocket(t *testing.T) {
+	server := httptest.NewServer(router())
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?topics=temp"
+	ws, err := websocket.Dial(url, "", server.URL)
+	require.NoError(t, err)
+	defer ws.Close()
+
+	var msg map[string]interface{}
+	require.NoError(t, websocket.JSON.Receive(ws, &msg))
+	assert.Equal(t, "hello", msg["type"])
+
+	require.NoError(t, websocket.JSON.Send(ws, map[string]interface{}{"action": "subscribe", "topics": []string{"power"}}))
+	require.NoError(t, websocket.JSON.Receive(ws, &msg))
+	assert.Equal(t, "ack", msg["type"])
+
+	waitForStreams(t, 1)
+	Streams.Deliver(pubsub.NewEvent("rain", pubsub.Fields{"device": "rain.outside"}))
+	Streams.Deliver(pubsub.NewEvent("power", pubsub.Fields{"device": "power.house", "power": 1.0}))
+	msg = nil
+	require.NoError(t, websocket.JSON.Receive(ws, &msg))
+	assert.Equal(t, "event", msg["type"])
+	assert.Equal(t, "power", msg["event"].(map[string]interface{})["topic"])
+}
+
+func TestWebsocketOrigin(t *testing.T) {
+	services.Config = config.Must(config.OpenRaw([]byte(authYaml)))
+	defer func() { services.Config = config.ExampleConfig }()
+	server := httptest.NewServer(router())
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+	_, err := websocket.Dial(url, "", "https://evil.example.com")
+	assert.Error(t, err)
+	ws, err := websocket.Dial(url, "", "https://dash.example.com")
+	require.NoError(t, err)
+	ws.Close()
+	ws, err = websocket.Dial(url, "", server.URL)
+	require.NoError(t, err)
+	ws.Close()
+}
+
+func TestEventsSSE(t *testing.T) {
+	server := httptest.NewServer(router())
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/events/sse?devices=temp.hallway")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	reader := bufio.NewReader(resp.Body)
+	line, _ := reader.ReadString('\n')
+	assert.Equal(t, "event: hello\n", line)
+	line, _ = reader.ReadString('\n')
+	assert.Contains(t, line, `"subscriptions":{"devices":["temp.hallway"],"topics":[]}`)
+	reader.ReadString('\n')
+
+	waitForStreams(t, 1)
+	Streams.Deliver(pubsub.NewEvent("temp", pubsub.Fields{"device": "temp.living"}))
+	Streams.Deliver(pubsub.NewEvent("temp", pubsub.Fields{"device": "temp.hallway", "temp": 18.5}))
+	line, _ = reader.ReadString('\n')
+	assert.Equal(t, "event: temp\n", line)
+	line, _ = reader.ReadString('\n')
+	assert.Contains(t, line, `"device":"temp.hallway"`)
+}
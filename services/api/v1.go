@@ -0,0 +1,268 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// The /v1 api serves the same routes as the unversioned api (kept for
+// compatibility), but with JSON error bodies and JSON throughout.
+
+var ErrTimeout = errors.New("service not responding")
+
+// v1Writer marks responses to /v1 requests.
+type v1Writer struct {
+	http.ResponseWriter
+}
+
+func (self *v1Writer) Flush() {
+	if f, ok := self.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (self *v1Writer) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := self.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, errors.New("hijack not supported")
+}
+
+func isV1(w http.ResponseWriter) bool {
+	_, ok := w.(*v1Writer)
+	return ok
+}
+
+// versionHandler marks /v1 requests, so errors are returned as JSON.
+type versionHandler struct {
+	Handler http.Handler
+}
+
+func (self versionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/v1/") {
+		w = &v1Writer{w}
+	}
+	self.Handler.ServeHTTP(w, r)
+}
+
+// writeError writes an error response: JSON {"error": message, "status":
+// status} for /v1, plain text otherwise.
+func writeError(w http.ResponseWriter, status int, err error) {
+	if !isV1(w) {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	writeJSON(w, map[string]interface{}{"error": err.Error(), "status": status})
+}
+
+func writeJSON(w http.ResponseWriter, obj interface{}) {
+	json.NewEncoder(w).Encode(obj)
+}
+
+func notFound(w http.ResponseWriter, err error) {
+	if !isV1(w) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	writeError(w, http.StatusNotFound, err)
+}
+
+func timeout(w http.ResponseWriter) {
+	writeError(w, http.StatusGatewayTimeout, ErrTimeout)
+}
+
+type route struct {
+	Path    string
+	Prefix  bool // match all paths beginning with Path
+	Handler http.Handler
+	Methods []string // documented methods, defaults to GET
+	Summary string
+	Params  []string // query parameters
+	Read    Role     // role required for GET
+	Write   Role     // role required for other methods
+	V1      bool     // /v1 only
+}
+
+func routes() []route {
+	return []route{
+		{Path: "/", Handler: http.HandlerFunc(apiIndex), Summary: "Web dashboard"},
+		{Path: "/query/", Prefix: true, Handler: authorizeQuery(http.HandlerFunc(apiQuery)), Summary: "Query a service, eg /query/heating/status. The role required depends on the verb: admin for schedule edits, logs, scripts and unknown verbs", Params: []string{"q", "timeout", "responses"}},
+		{Path: "/voice", Handler: http.HandlerFunc(apiVoice), Summary: "Perform a voice command, matched to an intent", Params: []string{"q"}, Read: RoleControl, Write: RoleControl},
+		{Path: "/devices", Handler: http.HandlerFunc(apiDevices), Summary: "List devices and their events. The ETag is the state version: pass it as since to fetch only devices changed", Params: []string{"since"}, Read: RoleRead, Write: RoleRead},
+		{Path: "/devices/control", Handler: http.HandlerFunc(apiDevicesControl), Summary: "Control a device or group:, location: or cap: target", Params: []string{"id", "command", "level"}, Read: RoleControl, Write: RoleControl},
+		{Path: "/devices/{device}/history", Handler: VarsHandler(apiDevicesHistory), Summary: "Device events logged by the datalogger, or a numeric field series, optionally downsampled (min/max/avg) into buckets", Params: []string{"topic", "from", "to", "field", "bucket", "limit"}, Read: RoleRead, Write: RoleRead},
+		{Path: "/devices/{device}", Handler: VarsHandler(apiDevicesSingle), Summary: "Single device with events", Read: RoleRead, Write: RoleRead},
+		{Path: "/scenes", Handler: http.HandlerFunc(apiScenes), Summary: "List scenes", Read: RoleRead, Write: RoleRead},
+		{Path: "/scenes/{scene}", Handler: VarsHandler(apiScenesSingle), Methods: []string{"GET", "POST"}, Summary: "Single scene, POST to activate (on) or restore (off)", Params: []string{"command"}, Read: RoleRead, Write: RoleControl},
+		{Path: "/heating/status", Handler: http.HandlerFunc(apiHeatingStatus), Summary: "Heating status", Read: RoleRead, Write: RoleRead},
+		{Path: "/heating/set", Handler: http.HandlerFunc(apiHeatingSet), Summary: "Set a heating zone to temp until a time", Params: []string{"id", "temp", "until"}, Read: RoleControl, Write: RoleControl},
+		{Path: "/heating/profile", Handler: http.HandlerFunc(apiHeatingProfile), Summary: "Get or switch the heating schedule profile", Params: []string{"name", "until"}, Read: RoleControl, Write: RoleControl},
+		{Path: "/heating/schedule/{zone}", Handler: VarsHandler(apiHeatingSchedule), Methods: []string{"GET", "PUT"}, Summary: "Get or replace a zone schedule", Read: RoleRead, Write: RoleAdmin},
+		{Path: "/automata", Handler: http.HandlerFunc(apiAutomata), Summary: "List automata with their states, since times and transitions", Read: RoleRead, Write: RoleRead},
+		{Path: "/automata/{name}/state", Handler: VarsHandler(apiAutomataState), Methods: []string{"POST"}, Summary: `Force an automaton's state, {"state": "..."} or the state parameter`, Params: []string{"state"}, Read: RoleControl, Write: RoleControl},
+		{Path: "/automata/{name}", Handler: VarsHandler(apiAutomataSingle), Summary: "Single automaton", Read: RoleRead, Write: RoleRead},
+		{Path: "/events/feed", Handler: http.HandlerFunc(apiEventsFeed), Summary: "Live stream of events (line delimited)", Params: []string{"topics"}, Read: RoleRead, Write: RoleRead},
+		{Path: "/events/sse", Handler: http.HandlerFunc(apiEventsSSE), Summary: "Live stream of events as Server-Sent Events", Params: []string{"topics", "devices"}, Read: RoleRead, Write: RoleRead},
+		{Path: "/events/sse/{id}", Handler: VarsHandler(apiEventsSSEControl), Methods: []string{"GET", "POST"}, Summary: "Get or change an sse stream's subscription", Read: RoleRead, Write: RoleRead},
+		{Path: "/ws", Handler: websocketServer, Summary: "Live stream of events over a WebSocket", Params: []string{"topics", "devices"}, Read: RoleRead, Write: RoleRead},
+		{Path: "/config", Handler: http.HandlerFunc(apiConfig), Methods: []string{"GET", "POST"}, Summary: "Get or update configuration", Params: []string{"path"}, Read: RoleAdmin, Write: RoleAdmin},
+		{Path: "/logs", Handler: http.HandlerFunc(apiLogs), Summary: "Stream logs, until disconnect", Read: RoleAdmin, Write: RoleAdmin},
+		{Path: "/hooks/{name}", Handler: VarsHandler(apiHook), Methods: []string{"POST"}, Summary: "Inbound webhook, publishing the payload mapped to an event. Verified by the hook's secret or HMAC signature, not api credentials"},
+		{Path: "/metrics", Handler: http.HandlerFunc(apiMetrics), Summary: "Prometheus metrics: device readings, service uptime, automata states and the api's pubsub counters", Read: RoleRead, Write: RoleRead},
+		{Path: "/openapi.json", Handler: http.HandlerFunc(apiOpenAPI), Summary: "OpenAPI description of the api", V1: true},
+	}
+}
+
+func addRoutes(router *mux.Router, prefix string) {
+	for _, rt := range routes() {
+		if rt.V1 && prefix == "" {
+			continue
+		}
+		handler := authorize(rt.Read, rt.Write, rt.Handler)
+		if rt.Prefix {
+			router.PathPrefix(prefix + rt.Path).Handler(handler)
+		} else {
+			router.Path(prefix + rt.Path).Handler(handler)
+		}
+	}
+}
+
+func router() *mux.Router {
+	router := mux.NewRouter()
+	addRoutes(router, "/v1")
+	addRoutes(router, "")
+	router.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		notFound(w, errors.New("not found: "+r.URL.Path))
+	})
+	return router
+}
+
+// apiHandler returns the api handler: versioned, authenticated and routed.
+func apiHandler() http.Handler {
+	var handler http.Handler = router()
+	handler = loggingHandler{Handler: handler}
+	handler = authHandler{Handler: handler}
+	handler = versionHandler{Handler: handler}
+	return handler
+}
+
+var rePathParam = regexp.MustCompile(`\{(\w+)\}`)
+
+var roleDescriptions = map[Role]string{
+	RoleNone:    "any user",
+	RoleRead:    "read",
+	RoleControl: "control",
+	RoleAdmin:   "admin",
+}
+
+// OpenAPI generates an OpenAPI 3 description of the /v1 api.
+func OpenAPI() map[string]interface{} {
+	errorResponse := map[string]interface{}{"$ref": "#/components/responses/Error"}
+	paths := map[string]interface{}{}
+	for _, rt := range routes() {
+		path := "/v1" + rt.Path
+		var params []interface{}
+		for _, m := range rePathParam.FindAllStringSubmatch(rt.Path, -1) {
+			params = append(params, map[string]interface{}{
+				"name": m[1], "in": "path", "required": true,
+				"schema": map[string]interface{}{"type": "string"},
+			})
+		}
+		if rt.Prefix {
+			path += "{path}"
+			params = append(params, map[string]interface{}{
+				"name": "path", "in": "path", "required": true,
+				"schema": map[string]interface{}{"type": "string"},
+			})
+		}
+		for _, name := range rt.Params {
+			params = append(params, map[string]interface{}{
+				"name": name, "in": "query",
+				"schema": map[string]interface{}{"type": "string"},
+			})
+		}
+
+		methods := rt.Methods
+		if len(methods) == 0 {
+			methods = []string{"GET"}
+		}
+		ops := map[string]interface{}{}
+		for _, method := range methods {
+			role := rt.Write
+			if method == "GET" {
+				role = rt.Read
+			}
+			op := map[string]interface{}{
+				"summary":     rt.Summary,
+				"description": "Requires role: " + roleDescriptions[role],
+				"responses": map[string]interface{}{
+					"200":     map[string]interface{}{"description": "OK"},
+					"default": errorResponse,
+				},
+			}
+			if params != nil {
+				op["parameters"] = params
+			}
+			ops[strings.ToLower(method)] = op
+		}
+		paths[path] = ops
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.0",
+		"info": map[string]interface{}{
+			"title":   "gohome",
+			"version": "1",
+		},
+		"paths": paths,
+		"security": []interface{}{
+			map[string]interface{}{"bearer": []string{}},
+			map[string]interface{}{"basic": []string{}},
+		},
+		"components": map[string]interface{}{
+			"securitySchemes": map[string]interface{}{
+				"bearer": map[string]interface{}{"type": "http", "scheme": "bearer"},
+				"basic":  map[string]interface{}{"type": "http", "scheme": "basic"},
+			},
+			"schemas": map[string]interface{}{
+				"Error": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"error":  map[string]interface{}{"type": "string"},
+						"status": map[string]interface{}{"type": "integer"},
+					},
+				},
+			},
+			"responses": map[string]interface{}{
+				"Error": map[string]interface{}{
+					"description": "Error",
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{
+							"schema": map[string]interface{}{"$ref": "#/components/schemas/Error"},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// queryEndpoint returns the service/verb queried.
+func queryEndpoint(r *http.Request) string {
+	return strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/v1"), "/query/")
+}
+
+func apiOpenAPI(w http.ResponseWriter, r *http.Request) {
+	jsonResponse(w, OpenAPI())
+}
@@ -0,0 +1,106 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/barnybug/gohome/config"
+	"github.com/barnybug/gohome/pubsub"
+	"github.com/barnybug/gohome/pubsub/dummy"
+	"github.com/barnybug/gohome/services"
+)
+
+func apiRequest(method, url string) *httptest.ResponseRecorder {
+	return apiRequestBody(method, url, nil)
+}
+
+func apiRequestBody(method, url string, body io.Reader) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	r := httptest.NewRequest(method, url, body)
+	apiHandler().ServeHTTP(rec, r)
+	return rec
+}
+
+func TestV1Errors(t *testing.T) {
+	services.Config = config.ExampleConfig
+
+	rec := apiRequest("GET", "/v1/devices/abc")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Equal(t, "application/json; charset=utf-8", rec.Header().Get("Content-Type"))
+	assert.Equal(t, `{"error":"not found: abc","status":404}`+"\n", rec.Body.String())
+
+	rec = apiRequest("GET", "/v1/devices/control?id=x")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Equal(t, `{"error":"device not found","status":400}`+"\n", rec.Body.String())
+
+	rec = apiRequest("GET", "/v1/nothing")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Equal(t, `{"error":"not found: /v1/nothing","status":404}`+"\n", rec.Body.String())
+
+	// compatibility
+	rec = apiRequest("GET", "/devices/abc")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Equal(t, "not found: abc", rec.Body.String())
+}
+
+func TestV1Devices(t *testing.T) {
+	services.Config = config.ExampleConfig
+	rec := apiRequest("GET", "/v1/devices/light.kitchen")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `{"aliases":null,"caps":["switch"],"events":{},"group":"downstairs","id":"light.kitchen","name":"Kitchen"}`+"\n", rec.Body.String())
+}
+
+func TestV1Timeout(t *testing.T) {
+	services.Config = config.ExampleConfig
+	services.Publisher = &dummy.Publisher{}
+	services.Subscriber = &dummy.Subscriber{}
+
+	rec := apiRequest("GET", "/v1/heating/status")
+	assert.Equal(t, http.StatusGatewayTimeout, rec.Code)
+	assert.Equal(t, `{"error":"service not responding","status":504}`+"\n", rec.Body.String())
+
+	// previously panicked
+	rec = apiRequest("GET", "/heating/status")
+	assert.Equal(t, http.StatusGatewayTimeout, rec.Code)
+
+	rec = apiRequest("GET", "/v1/query/heating/status")
+	assert.Equal(t, http.StatusGatewayTimeout, rec.Code)
+}
+
+func TestV1Query(t *testing.T) {
+	services.Config = config.ExampleConfig
+	services.Publisher = &dummy.Publisher{}
+	services.Subscriber = &dummy.Subscriber{Events: []*pubsub.Event{
+		pubsub.NewEvent("_rpc.1", pubsub.Fields{"message": "Heating: false", "source": "heating"}),
+	}}
+	rec := apiRequest("GET", "/v1/query/heating/status")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var ret []map[string]interface{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &ret))
+	require.Equal(t, 1, len(ret))
+	assert.Equal(t, "Heating: false", ret[0]["message"])
+}
+
+func TestOpenAPI(t *testing.T) {
+	services.Config = config.ExampleConfig
+	rec := apiRequest("GET", "/v1/openapi.json")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var doc map[string]interface{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &doc))
+	assert.Equal(t, "3.0.0", doc["openapi"])
+	paths := doc["paths"].(map[string]interface{})
+	assert.Contains(t, paths, "/v1/devices/{device}")
+	assert.Contains(t, paths, "/v1/query/{path}")
+	schedule := paths["/v1/heating/schedule/{zone}"].(map[string]interface{})
+	assert.Contains(t, schedule, "put")
+	assert.Equal(t, "Requires role: admin", schedule["put"].(map[string]interface{})["description"])
+
+	// only under /v1
+	assert.Equal(t, http.StatusNotFound, apiRequest("GET", "/openapi.json").Code)
+}
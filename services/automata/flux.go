@@ -5,6 +5,7 @@ import (
 	"regexp"
 	"time"
 
+	"github.com/barnybug/gohome/lib/light"
 	"github.com/barnybug/gohome/pubsub"
 )
 
@@ -59,21 +60,15 @@ func fluxParse(args []interface{}) (p fluxParams, err error) {
 }
 
 func fluxCommand(p fluxParams, device string) *pubsub.Event {
-	fields := pubsub.Fields{
-		"command": "on",
-		"device":  device,
-	}
+	command := light.Command{On: true}
 	if p.kStart != 0 {
-		k := tinterpolate(p.tStart, p.tEnd, p.kStart, p.kEnd)
-		fields["temp"] = int(k)
+		command.Temp = tinterpolate(p.tStart, p.tEnd, p.kStart, p.kEnd)
 	}
 	if p.lStart != 0 {
 		l := tinterpolate(p.tStart, p.tEnd, p.lStart, p.lEnd)
-		fields["level"] = int(l)
+		command.Level = &l
 	}
-
-	ev := pubsub.NewEvent("command", fields)
-	return ev
+	return command.Event(device)
 }
 
 func tinterpolate(start time.Time, end time.Time, tempStart int, tempEnd int) int {
@@ -19,6 +19,9 @@
 //
 // - a presence based smart burglar alarm system (when the house is empty, turn on the burglar alarm)
 //
+// - telling arrivals from departures by the order of door and PIR events,
+// eg: Within(30, 'door.front', 'pir.hall')
+//
 // The automata are configured via yaml configuration format configured under:
 //
 // http://localhost:8723/config?path=gohome/config/automata
@@ -77,6 +80,8 @@ type Service struct {
 	functions         map[string]govaluate.ExpressionFunction
 	restoredAutomaton map[string]bool
 	rand              *rand.Rand
+	window            *eventWindow
+	scenes            *sceneManager
 }
 
 var automata *gofsm.Automata
@@ -148,6 +153,8 @@ func (self *Service) defineFunctions() {
 		"Script":      self.Script,
 		"Snapshot":    self.Snapshot,
 		"StartTimer":  self.StartTimer,
+		"Within":      self.Within,
+		"WithinAny":   self.WithinAny,
 	}
 }
 
@@ -222,21 +229,52 @@ func (self *Service) RestoreFile(automata *gofsm.Automata) {
 
 func (self *Service) QueryHandlers() services.QueryHandlers {
 	return services.QueryHandlers{
-		"status": services.TextHandler(self.queryStatus),
+		"status": self.queryStatus,
 		"switch": services.TextHandler(self.querySwitch),
 		"logs":   services.TextHandler(self.queryLogs),
 		"script": services.TextHandler(self.queryScript),
-		"state":  services.TextHandler(self.queryState),
+		"state":  self.queryState,
 		"help": services.StaticHandler("" +
 			"status: get status\n" +
-			"switch device on|off: switch device\n" +
+			"switch device on|off: switch device (or group:, location:, cap:)\n" +
 			"logs: get recent event logs\n" +
 			"script: run a script\n" +
 			"state: get or set automaton state"),
 	}
 }
 
-func (self *Service) queryStatus(q services.Question) string {
+// automatonJson describes an automaton: its state, and the states and
+// transitions available.
+// stateNames lists the automaton's states, sorted.
+func stateNames(aut *gofsm.Automaton) []string {
+	states := []string{}
+	for state := range aut.States {
+		states = append(states, state)
+	}
+	sort.Strings(states)
+	return states
+}
+
+func automatonJson(name string, aut *gofsm.Automaton) map[string]interface{} {
+	states := stateNames(aut)
+	transitions := []map[string]interface{}{}
+	for _, step := range aut.State.Steps {
+		transitions = append(transitions, map[string]interface{}{"when": step.When, "next": step.Next})
+	}
+	ret := map[string]interface{}{
+		"name":        name,
+		"state":       aut.State.Name,
+		"since":       aut.Since.Format(time.RFC3339),
+		"states":      states,
+		"transitions": transitions,
+	}
+	if dev, ok := services.Config.Devices[name]; ok {
+		ret["device"] = dev.Name
+	}
+	return ret
+}
+
+func (self *Service) queryStatus(q services.Question) services.Answer {
 	var out string
 	now := time.Now()
 	var keys []string
@@ -246,6 +284,7 @@ func (self *Service) queryStatus(q services.Question) string {
 	sort.Strings(keys)
 
 	group := ""
+	data := map[string]interface{}{}
 	for _, k := range keys {
 		if k == "events" {
 			continue
@@ -261,35 +300,42 @@ func (self *Service) queryStatus(q services.Question) string {
 		aut := automata.Automaton[k]
 		du := util.ShortDuration(now.Sub(aut.Since))
 		out += fmt.Sprintf("- %s: %s for %s\n", device, aut.State.Name, du)
+		data[k] = automatonJson(k, aut)
 	}
-	return out
+	return services.Answer{Text: out, Json: data}
 }
 
-func (self *Service) queryState(q services.Question) string {
-	args := strings.Split(q.Args, " ")
+func (self *Service) queryState(q services.Question) services.Answer {
+	args := util.SplitArgs(q.Args)
 	if len(args) < 1 || len(args) > 2 {
-		return "usage: state automata [state]"
+		return services.Answer{Text: "usage: state automata [state]"}
 	}
 
 	aut, ok := automata.Automaton[args[0]]
 	if !ok {
-		return fmt.Sprintf("automata: '%s' not found", args[0])
+		return services.Answer{Text: fmt.Sprintf("automata: '%s' not found", args[0]), Error: services.ErrAutomatonNotFound}
 	}
 	if len(args) == 1 {
 		// getting state
 		now := time.Now()
 		du := util.ShortDuration(now.Sub(aut.Since))
-		return fmt.Sprintf("%s: %s for %s\n", args[0], aut.State.Name, du)
+		return services.Answer{
+			Text: fmt.Sprintf("%s: %s for %s\n", args[0], aut.State.Name, du),
+			Json: automatonJson(args[0], aut),
+		}
 	} else {
 		// setting state
 		_, ok = aut.States[args[1]]
 		if !ok {
-			return fmt.Sprintf("automata state: '%s' not found", args[1])
+			return services.Answer{Text: fmt.Sprintf("automata state: '%s' not found", args[1]), Error: services.ErrStateNotFound}
 		}
 		dummy := pubsub.NewEvent("user", pubsub.Fields{})
 		event := NewEventContext(self, dummy)
 		aut.ChangeState(args[1], event)
-		return fmt.Sprintf("Change %s state to %s", args[0], args[1])
+		return services.Answer{
+			Text: fmt.Sprintf("Change %s state to %s", args[0], args[1]),
+			Json: automatonJson(args[0], aut),
+		}
 	}
 }
 
@@ -310,20 +356,31 @@ func (self *Service) querySwitch(q services.Question) string {
 		sort.Strings(devices)
 		return strings.Join(devices, ", ")
 	}
-	args := strings.Split(q.Args, " ")
-	name := args[0]
-	matches := services.MatchDevices(name)
-	if len(matches) == 0 {
+	name, args, err := services.SplitCommand(q.Args)
+	if err == services.ErrDeviceNotFound {
+		return fmt.Sprintf("device %s not found", name)
+	}
+	if err != nil {
+		return fmt.Sprintf("%s\nusage: switch device command [key=value...]", err)
+	}
+	if len(args) == 0 || strings.Contains(args[0], "=") {
+		return "usage: switch device command [key=value...]"
+	}
+	matches, err := services.ResolveTarget(name)
+	if err == services.ErrDeviceNotFound {
 		return fmt.Sprintf("device %s not found", name)
 	}
-	if len(matches) > 1 {
+	if err == services.ErrDeviceAmbiguous {
 		return fmt.Sprintf("device %s is ambiguous", strings.Join(matches, ", "))
 	}
 
+	if services.IsTarget(name) {
+		sendCommand(name, args)
+		return fmt.Sprintf("Switched %s %s (%d devices)", name, args[0], len(matches))
+	}
 	dev := services.Config.Devices[matches[0]]
-	args[0] = matches[0]
-	sendCommand(args)
-	return fmt.Sprintf("Switched %s %s", dev.Name, args[1])
+	sendCommand(matches[0], args)
+	return fmt.Sprintf("Switched %s %s", dev.Name, args[0])
 }
 
 func parseArgs(args []string) (string, pubsub.Fields) {
@@ -334,17 +391,19 @@ func parseArgs(args []string) (string, pubsub.Fields) {
 	return command, fields
 }
 
-func createCommand(args []string) *pubsub.Event {
-	command, fields := parseArgs(args[1:])
+func createCommand(target string, args []string) *pubsub.Event {
+	command, fields := parseArgs(args)
 	ev := pubsub.NewEvent("command", fields)
 	ev.SetField("command", command)
-	ev.SetField("device", args[0])
+	ev.SetField("device", target)
 	return ev
 }
 
-func sendCommand(args []string) {
-	ev := createCommand(args)
-	services.Publisher.Emit(ev)
+func sendCommand(target string, args []string) {
+	ev := createCommand(target, args)
+	if err := services.EmitCommand(ev); err != nil {
+		log.Printf("Command %s failed: %s", ev.Device(), err)
+	}
 }
 
 func (self *Service) queryScript(q services.Question) string {
@@ -465,7 +524,11 @@ func (self *Service) restoreState(ev *pubsub.Event) {
 	}
 }
 
-func handleCommand(ev *pubsub.Event) {
+func (self *Service) handleCommand(ev *pubsub.Event) {
+	if self.scenes.Command(ev) {
+		// configured scene - acked once the devices have responded
+		return
+	}
 	if strings.HasPrefix(ev.Device(), "scene.") {
 		// simply ack the scene. This allows automata to handle running scripts,
 		// and perform state changes as necessary to the ack event.
@@ -523,6 +586,13 @@ func publishState(device, state, trigger string) {
 		"device":  device,
 		"state":   state,
 		"trigger": trigger,
+		"source":  "automata",
+	}
+	if automata != nil {
+		if aut, ok := automata.Automaton[device]; ok {
+			// all the states, for metrics
+			fields["states"] = stateNames(aut)
+		}
 	}
 	ev := pubsub.NewEvent("state", fields)
 	ev.SetRetained(true)
@@ -541,6 +611,8 @@ func (self *Service) Run() error {
 	self.configUpdated = make(chan bool, 2)
 	self.restoredAutomaton = map[string]bool{}
 	self.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	self.window = &eventWindow{}
+	self.scenes = newSceneManager()
 	// load templated automata
 	err := self.loadAutomata()
 	if err != nil {
@@ -557,8 +629,9 @@ func (self *Service) Run() error {
 	for {
 		select {
 		case ev := <-ch:
+			self.scenes.Record(ev)
 			if ev.Topic == "command" {
-				handleCommand(ev)
+				self.handleCommand(ev)
 				// ignore direct commands - ack/homeeasy events indicate commands completing.
 				continue
 			}
@@ -579,6 +652,9 @@ func (self *Service) Run() error {
 				services.Config.AddDeviceToEvent(ev)
 			}
 
+			// record in the rolling window for Within/WithinAny
+			self.window.Add(ev)
+
 			// send relevant events to the automata
 			event := NewEventContext(self, ev)
 			automata.Process(event)
@@ -589,6 +665,9 @@ func (self *Service) Run() error {
 		case action := <-automata.Actions:
 			self.performAction(action)
 
+		case scene := <-self.scenes.timeouts:
+			self.scenes.Timeout(scene)
+
 		case <-self.configUpdated:
 			// live reload the automata!
 			log.Println("Automata config updated, reloading")
@@ -752,7 +831,10 @@ func (self *Service) Script(args ...interface{}) (interface{}, error) {
 }
 
 func script(command string) (string, error) {
-	args := strings.Split(command, " ")
+	args := util.SplitArgs(command)
+	if len(args) == 0 {
+		return "", errors.New("Expected a script name argument")
+	}
 	name := path.Base(args[0])
 	if name == "" {
 		return "", errors.New("Expected a script name argument")
@@ -808,8 +890,12 @@ func (self *Service) Command(args ...interface{}) (interface{}, error) {
 	context := args[0].(ChangeContext)
 	text := args[1].(string)
 	text = context.Format(text)
-	argv := strings.Split(text, " ")
-	sendCommand(argv)
+	target, cmd, err := services.SplitCommand(text)
+	if err != nil && err != services.ErrDeviceNotFound {
+		// devices unknown to the config are still sent the command
+		return nil, fmt.Errorf("%s: %s", text, err)
+	}
+	sendCommand(target, cmd)
 	return nil, nil
 }
 
@@ -823,8 +909,11 @@ func (self *Service) Delay(args ...interface{}) (interface{}, error) {
 	duration := args[3].(float64)
 
 	text = context.Format(text)
-	argv := strings.Split(text, " ")
-	command := createCommand(argv)
+	target, cmd, err := services.SplitCommand(text)
+	if err != nil && err != services.ErrDeviceNotFound {
+		return nil, fmt.Errorf("%s: %s", text, err)
+	}
+	command := createCommand(target, cmd)
 	// emit command when timer goes off
 	self.startTimerEvent(timer, duration, command)
 	return nil, nil
@@ -856,6 +945,12 @@ func (self *Service) startTimerEvent(name string, d float64, ev *pubsub.Event) {
 
 	timer := time.AfterFunc(duration, func() {
 		ev.Timestamp = time.Now().UTC()
+		if ev.Topic == "command" {
+			if err := services.EmitCommand(ev); err != nil {
+				log.Printf("Command %s failed: %s", ev.Device(), err)
+			}
+			return
+		}
 		services.Publisher.Emit(ev)
 	})
 	self.timers[name] = timer
@@ -178,3 +178,72 @@ func TestCheckArguments(t *testing.T) {
 	assert.Error(checkArguments([]interface{}{"x"}, "int"))
 	assert.Error(checkArguments([]interface{}{}, "string", "..."))
 }
+
+var PorchAutomata = `
+light.porch:
+  start: Off
+  states:
+    Off: {}
+    On: {}
+  transitions:
+    Off->On:
+    - when: device=='pir.porch'
+    On->Off:
+    - when: device=='timer.porch'
+`
+
+func TestQueryJson(t *testing.T) {
+	services.Config = config.ExampleConfig
+	automata, _ = gofsm.Load([]byte(PorchAutomata))
+
+	answer := service.queryStatus(services.Question{Verb: "status"})
+	assert.Contains(t, answer.Text, "- light.porch: Off for")
+	status := answer.Json.(map[string]interface{})
+	porch := status["light.porch"].(map[string]interface{})
+	assert.Equal(t, "Off", porch["state"])
+	assert.Equal(t, []string{"Off", "On"}, porch["states"])
+	assert.Equal(t, []map[string]interface{}{{"when": "device=='pir.porch'", "next": "On"}}, porch["transitions"])
+
+	answer = service.queryState(services.Question{Verb: "state", Args: "light.porch On"})
+	assert.Equal(t, "Change light.porch state to On", answer.Text)
+	assert.Equal(t, "On", answer.Json.(map[string]interface{})["state"])
+
+	answer = service.queryState(services.Question{Verb: "state", Args: "light.porch"})
+	assert.Equal(t, "On", answer.Json.(map[string]interface{})["state"])
+
+	answer = service.queryState(services.Question{Verb: "state", Args: "light.porch Dim"})
+	assert.Equal(t, "automata state: 'Dim' not found", answer.Text)
+	assert.Equal(t, services.ErrStateNotFound, answer.Error)
+	assert.Nil(t, answer.Json)
+	answer = service.queryState(services.Question{Verb: "state", Args: "light.x"})
+	assert.Equal(t, "automata: 'light.x' not found", answer.Text)
+	assert.Equal(t, services.ErrAutomatonNotFound, answer.Error)
+}
+
+func TestQuerySwitch(t *testing.T) {
+	services.Config = config.ExampleConfig
+	publisher := &dummy.Publisher{}
+	services.Publisher = publisher
+
+	assert.Equal(t, "usage: switch device command [key=value...]", service.querySwitch(services.Question{Verb: "switch", Args: "kitchen"}))
+	assert.Empty(t, publisher.Events)
+
+	assert.Equal(t, "Switched Kitchen off", service.querySwitch(services.Question{Verb: "switch", Args: "kitchen off"}))
+	assert.Equal(t, "Switched group:Downstairs on (2 devices)", service.querySwitch(services.Question{Verb: "switch", Args: "group:Downstairs on level=50"}))
+	assert.Equal(t, "unexpected argument: off\nusage: switch device command [key=value...]", service.querySwitch(services.Question{Verb: "switch", Args: "kitchen lights off now"}))
+	assert.Equal(t, "device light.hall not found", service.querySwitch(services.Question{Verb: "switch", Args: "light.hall on"}))
+	assert.Equal(t, 3, len(publisher.Events))
+	assert.Equal(t, 50.0, publisher.Events[1].Fields["level"])
+}
+
+func TestPublishState(t *testing.T) {
+	automata, _ = gofsm.Load([]byte(PorchAutomata))
+	em := &dummy.Publisher{}
+	services.Publisher = em
+	publishState("light.porch", "On", "pir")
+	ev := em.Events[0]
+	assert.Equal(t, "On", ev.StringField("state"))
+	assert.True(t, ev.Retained)
+	// all the states, for metrics
+	assert.Equal(t, []string{"Off", "On"}, ev.Fields["states"])
+}
@@ -0,0 +1,276 @@
+package automata
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/barnybug/gohome/config"
+	"github.com/barnybug/gohome/pubsub"
+	"github.com/barnybug/gohome/services"
+)
+
+const defaultSceneTimeout = 10 * time.Second
+
+// Fields recorded per device, to be able to restore state after a scene.
+var sceneStateFields = []string{"command", "level", "temp", "colour"}
+
+type sceneActivation struct {
+	device    string
+	command   string
+	pending   map[string]pubsub.Fields // state commanded, by device
+	completed []string
+	timer     *time.Timer
+}
+
+// sceneManager fans out scene commands to devices, tracks their completion
+// and remembers device states so reversible scenes can be restored.
+type sceneManager struct {
+	states    map[string]pubsub.Fields
+	snapshots map[string][]*pubsub.Event
+	active    map[string]*sceneActivation
+	timeouts  chan *sceneActivation
+}
+
+func newSceneManager() *sceneManager {
+	return &sceneManager{
+		states:    map[string]pubsub.Fields{},
+		snapshots: map[string][]*pubsub.Event{},
+		active:    map[string]*sceneActivation{},
+		timeouts:  make(chan *sceneActivation, 8),
+	}
+}
+
+func sceneConf(device string) (config.SceneConf, bool) {
+	if !strings.HasPrefix(device, "scene.") {
+		return config.SceneConf{}, false
+	}
+	conf, ok := services.Config.Scenes[device[len("scene."):]]
+	return conf, ok
+}
+
+// Record the last known state of a device, and check any scenes waiting on it.
+func (self *sceneManager) Record(ev *pubsub.Event) {
+	device := ev.Device()
+	if device == "" || ev.Topic == "command" {
+		return
+	}
+	if ev.Topic == "thermostat" && ev.IsSet("target") {
+		self.state(device)["target"] = ev.Fields["target"]
+	} else if command := ev.Command(); command == "on" || command == "off" {
+		state := self.state(device)
+		for _, field := range sceneStateFields {
+			if value, ok := ev.Fields[field]; ok {
+				state[field] = value
+			}
+		}
+	}
+
+	for scene, activation := range self.active {
+		if expected, ok := activation.pending[device]; ok && reached(ev, expected) {
+			delete(activation.pending, device)
+			activation.completed = append(activation.completed, device)
+			if len(activation.pending) == 0 {
+				self.finish(scene)
+			}
+		}
+	}
+}
+
+// expectedState is the state a device is commanded to: its command, or for a
+// thermostat its target.
+func expectedState(ev *pubsub.Event) pubsub.Fields {
+	if command := ev.Command(); command != "" {
+		return pubsub.Fields{"command": command}
+	}
+	if ev.IsSet("temp") {
+		return pubsub.Fields{"target": ev.Fields["temp"]}
+	}
+	return pubsub.Fields{}
+}
+
+// reached returns true if the event reports the state commanded.
+func reached(ev *pubsub.Event, expected pubsub.Fields) bool {
+	if command, ok := expected["command"]; ok && ev.Command() != command {
+		return false
+	}
+	if target, ok := expected["target"]; ok {
+		if ev.Topic != "thermostat" {
+			return false
+		}
+		want, ok := sceneNumber(target)
+		got, gotOk := sceneNumber(ev.Fields["target"])
+		if !ok || !gotOk || got != want {
+			return false
+		}
+	}
+	return true
+}
+
+// sceneNumber returns a number irrespective of int/float encoding.
+func sceneNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+func (self *sceneManager) state(device string) pubsub.Fields {
+	if _, ok := self.states[device]; !ok {
+		self.states[device] = pubsub.Fields{}
+	}
+	return self.states[device]
+}
+
+// Command handles a command for a configured scene, returning false if the
+// device is not a configured scene.
+func (self *sceneManager) Command(ev *pubsub.Event) bool {
+	conf, ok := sceneConf(ev.Device())
+	if !ok {
+		return false
+	}
+	switch ev.Command() {
+	case "off":
+		if snapshot, ok := self.snapshots[ev.Device()]; ok {
+			log.Printf("Restoring %s", ev.Device())
+			delete(self.snapshots, ev.Device())
+			self.run(ev.Device(), "off", snapshot, conf.Timeout)
+		} else {
+			// nothing to restore
+			self.run(ev.Device(), "off", nil, conf.Timeout)
+		}
+	default:
+		if _, ok := self.snapshots[ev.Device()]; conf.Restore && !ok {
+			// keep the state from before the scene, if already on
+			self.snapshots[ev.Device()] = self.snapshot(conf)
+		}
+		log.Printf("Activating %s", ev.Device())
+		self.run(ev.Device(), "on", sceneCommands(conf), conf.Timeout)
+	}
+	return true
+}
+
+func sceneCommands(conf config.SceneConf) []*pubsub.Event {
+	var commands []*pubsub.Event
+	for _, c := range conf.Commands {
+		fields := pubsub.Fields{"device": c.Device}
+		for k, v := range c.Fields {
+			fields[k] = v
+		}
+		command := c.Command
+		if command == "" && !services.Config.Devices[c.Device].Cap["thermostat"] {
+			command = "on"
+		}
+		if command != "" {
+			fields["command"] = command
+		}
+		commands = append(commands, pubsub.NewEvent("command", fields))
+	}
+	return commands
+}
+
+// snapshot builds the commands to return devices in the scene to their
+// current state.
+func (self *sceneManager) snapshot(conf config.SceneConf) []*pubsub.Event {
+	var commands []*pubsub.Event
+	for _, c := range conf.Commands {
+		state, ok := self.states[c.Device]
+		if !ok {
+			continue
+		}
+		fields := pubsub.Fields{"device": c.Device}
+		if target, ok := state["target"]; ok {
+			fields["temp"] = target
+		} else {
+			for k, v := range state {
+				if k != "target" {
+					fields[k] = v
+				}
+			}
+			if state["command"] == "off" {
+				// no point restoring levels on a light that's off
+				fields = pubsub.Fields{"device": c.Device, "command": "off"}
+			}
+		}
+		commands = append(commands, pubsub.NewEvent("command", fields))
+	}
+	return commands
+}
+
+func (self *sceneManager) run(device, command string, commands []*pubsub.Event, timeout config.Duration) {
+	if previous, ok := self.active[device]; ok && previous.timer != nil {
+		previous.timer.Stop()
+	}
+
+	activation := &sceneActivation{
+		device:  device,
+		command: command,
+		pending: map[string]pubsub.Fields{},
+	}
+	for _, ev := range commands {
+		activation.pending[ev.Device()] = expectedState(ev)
+		services.Publisher.Emit(ev)
+	}
+	self.active[device] = activation
+	if len(activation.pending) == 0 {
+		self.finish(device)
+		return
+	}
+
+	d := timeout.Duration
+	if d == 0 {
+		d = defaultSceneTimeout
+	}
+	activation.timer = time.AfterFunc(d, func() {
+		self.timeouts <- activation
+	})
+}
+
+// Timeout completes a scene that has devices still not responded.
+func (self *sceneManager) Timeout(activation *sceneActivation) {
+	if self.active[activation.device] != activation {
+		// superseded or already completed
+		return
+	}
+	var failed []string
+	for d := range activation.pending {
+		failed = append(failed, d)
+	}
+	sort.Strings(failed)
+	log.Printf("%s timed out waiting for: %s", activation.device, strings.Join(failed, ", "))
+	self.finish(activation.device)
+}
+
+func (self *sceneManager) finish(device string) {
+	activation, ok := self.active[device]
+	if !ok {
+		return
+	}
+	delete(self.active, device)
+	if activation.timer != nil {
+		activation.timer.Stop()
+	}
+
+	failed := []string{}
+	for d := range activation.pending {
+		failed = append(failed, d)
+	}
+	sort.Strings(failed)
+	completed := append([]string{}, activation.completed...)
+	sort.Strings(completed)
+
+	fields := pubsub.Fields{
+		"device":    device,
+		"command":   activation.command,
+		"completed": completed,
+		"failed":    failed,
+	}
+	ev := pubsub.NewEvent("ack", fields)
+	services.Publisher.Emit(ev)
+}
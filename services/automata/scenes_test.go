@@ -0,0 +1,100 @@
+package automata
+
+import (
+	"testing"
+
+	"github.com/barnybug/gohome/config"
+	"github.com/barnybug/gohome/pubsub"
+	"github.com/barnybug/gohome/pubsub/dummy"
+	"github.com/barnybug/gohome/services"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSceneActivate(t *testing.T) {
+	assert := assert.New(t)
+	services.Config = config.ExampleConfig
+	pub := &dummy.Publisher{}
+	services.Publisher = pub
+	m := newSceneManager()
+
+	assert.False(m.Command(pubsub.NewCommand("scene.unknown", "on")))
+	assert.True(m.Command(pubsub.NewCommand("scene.movie", "on")))
+	assert.Equal(2, len(pub.Events))
+	assert.Equal("light.glowworm", pub.Events[0].Device())
+	assert.Equal("on", pub.Events[0].Command())
+	assert.Equal(20, pub.Events[0].Fields["level"])
+	assert.Equal("light.kitchen", pub.Events[1].Device())
+	assert.Equal("off", pub.Events[1].Command())
+
+	// completes once both devices respond with the state commanded
+	m.Record(pubsub.NewEvent("ack", pubsub.Fields{"device": "light.kitchen", "command": "on"}))
+	assert.Equal(2, len(pub.Events))
+	m.Record(pubsub.NewEvent("ack", pubsub.Fields{"device": "light.glowworm", "command": "on", "level": 20.0}))
+	assert.Equal(2, len(pub.Events))
+	m.Record(pubsub.NewEvent("ack", pubsub.Fields{"device": "light.kitchen", "command": "off"}))
+	assert.Equal(3, len(pub.Events))
+	ack := pub.Events[2]
+	assert.Equal("ack", ack.Topic)
+	assert.Equal("scene.movie", ack.Device())
+	assert.Equal([]string{"light.glowworm", "light.kitchen"}, ack.Fields["completed"])
+}
+
+func TestSceneRestore(t *testing.T) {
+	assert := assert.New(t)
+	services.Config = config.ExampleConfig
+	pub := &dummy.Publisher{}
+	services.Publisher = pub
+	m := newSceneManager()
+
+	m.Record(pubsub.NewEvent("ack", pubsub.Fields{"device": "light.glowworm", "command": "on", "level": 80.0}))
+	m.Record(pubsub.NewEvent("ack", pubsub.Fields{"device": "light.kitchen", "command": "on"}))
+	m.Command(pubsub.NewCommand("scene.movie", "on"))
+	m.Record(pubsub.NewEvent("ack", pubsub.Fields{"device": "light.glowworm", "command": "on", "level": 20.0}))
+	m.Record(pubsub.NewEvent("ack", pubsub.Fields{"device": "light.kitchen", "command": "off"}))
+	// activated again, keeps the state from before the scene
+	m.Command(pubsub.NewCommand("scene.movie", "on"))
+	pub.Events = nil
+
+	m.Command(pubsub.NewCommand("scene.movie", "off"))
+	assert.Equal(2, len(pub.Events))
+	for _, ev := range pub.Events {
+		switch ev.Device() {
+		case "light.glowworm":
+			assert.Equal("on", ev.Command())
+			assert.Equal(80.0, ev.Fields["level"])
+		case "light.kitchen":
+			assert.Equal("on", ev.Command())
+		default:
+			t.Errorf("Unexpected device: %s", ev.Device())
+		}
+	}
+
+	// nothing more to restore
+	pub.Events = nil
+	m.Command(pubsub.NewCommand("scene.movie", "off"))
+	assert.Equal(1, len(pub.Events))
+	assert.Equal("ack", pub.Events[0].Topic)
+}
+
+func TestSceneTimeout(t *testing.T) {
+	assert := assert.New(t)
+	services.Config = config.ExampleConfig
+	pub := &dummy.Publisher{}
+	services.Publisher = pub
+	m := newSceneManager()
+
+	m.Command(pubsub.NewCommand("scene.movie", "on"))
+	m.Record(pubsub.NewEvent("ack", pubsub.Fields{"device": "light.kitchen", "command": "off"}))
+	m.Timeout(m.active["scene.movie"])
+	ack := pub.Events[len(pub.Events)-1]
+	assert.Equal([]string{"light.kitchen"}, ack.Fields["completed"])
+	assert.Equal([]string{"light.glowworm"}, ack.Fields["failed"])
+}
+
+func TestSceneReached(t *testing.T) {
+	assert := assert.New(t)
+	target := expectedState(pubsub.NewEvent("command", pubsub.Fields{"device": "thermostat.living", "temp": 18}))
+	assert.True(reached(pubsub.NewEvent("thermostat", pubsub.Fields{"device": "thermostat.living", "target": 18.0}), target))
+	assert.False(reached(pubsub.NewEvent("thermostat", pubsub.Fields{"device": "thermostat.living", "target": 16.0}), target))
+	assert.False(reached(pubsub.NewEvent("temp", pubsub.Fields{"device": "thermostat.living", "temp": 18.0}), target))
+}
@@ -0,0 +1,179 @@
+package automata
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/barnybug/gohome/pubsub"
+)
+
+// Maximum age of events kept in the rolling window, and so the longest
+// period Within/WithinAny can correlate over.
+const maxWindow = 10 * time.Minute
+
+// Maximum number of events kept in the rolling window.
+const maxWindowEvents = 256
+
+type windowEvent struct {
+	Device    string
+	Command   string
+	State     string
+	Timestamp time.Time
+}
+
+// A pattern is a device name, optionally followed by ':' and a command or
+// state, eg "door.front" or "door.front:on".
+func (e windowEvent) matches(pattern string) bool {
+	ps := strings.SplitN(pattern, ":", 2)
+	if ps[0] != e.Device {
+		return false
+	}
+	if len(ps) == 2 {
+		return ps[1] == e.Command || ps[1] == e.State
+	}
+	return true
+}
+
+// eventWindow is a short rolling history of device events, used to correlate
+// events happening close together in time.
+type eventWindow struct {
+	events []windowEvent
+}
+
+func (w *eventWindow) Add(ev *pubsub.Event) {
+	if ev.Device() == "" {
+		return
+	}
+	e := windowEvent{
+		Device:    ev.Device(),
+		Command:   ev.Command(),
+		State:     ev.State(),
+		Timestamp: ev.Timestamp,
+	}
+	w.events = append(w.events, e)
+	w.expire(ev.Timestamp)
+}
+
+func (w *eventWindow) expire(now time.Time) {
+	cutoff := now.Add(-maxWindow)
+	i := 0
+	for i < len(w.events) && (w.events[i].Timestamp.Before(cutoff) || len(w.events)-i > maxWindowEvents) {
+		i++
+	}
+	w.events = w.events[i:]
+}
+
+func (w *eventWindow) last() (windowEvent, bool) {
+	if len(w.events) == 0 {
+		return windowEvent{}, false
+	}
+	return w.events[len(w.events)-1], true
+}
+
+// Sequence returns true if the latest event matches the final pattern, and
+// the preceding patterns were seen in order within d of it.
+func (w *eventWindow) Sequence(d time.Duration, patterns []string) bool {
+	latest, ok := w.last()
+	if !ok || len(patterns) == 0 || !latest.matches(patterns[len(patterns)-1]) {
+		return false
+	}
+	cutoff := latest.Timestamp.Add(-d)
+	p := len(patterns) - 2
+	for i := len(w.events) - 2; i >= 0 && p >= 0; i-- {
+		e := w.events[i]
+		if e.Timestamp.Before(cutoff) {
+			break
+		}
+		if e.matches(patterns[p]) {
+			p--
+		}
+	}
+	return p < 0
+}
+
+// Unordered returns true if the latest event matches one of the patterns, and
+// all the other patterns were seen in any order within d of it.
+func (w *eventWindow) Unordered(d time.Duration, patterns []string) bool {
+	latest, ok := w.last()
+	if !ok {
+		return false
+	}
+	seen := make([]bool, len(patterns))
+	triggered := false
+	for i, pattern := range patterns {
+		if latest.matches(pattern) {
+			seen[i] = true
+			triggered = true
+		}
+	}
+	if !triggered {
+		return false
+	}
+	cutoff := latest.Timestamp.Add(-d)
+	for i := len(w.events) - 2; i >= 0; i-- {
+		e := w.events[i]
+		if e.Timestamp.Before(cutoff) {
+			break
+		}
+		for j, pattern := range patterns {
+			if !seen[j] && e.matches(pattern) {
+				seen[j] = true
+			}
+		}
+	}
+	for _, s := range seen {
+		if !s {
+			return false
+		}
+	}
+	return true
+}
+
+func parseWindowArgs(name string, args []interface{}) (time.Duration, []string, error) {
+	if err := checkArguments(args, "float64", "string", "..."); err != nil {
+		return 0, nil, fmt.Errorf("%s(): %s", name, err)
+	}
+	d := time.Duration(args[0].(float64) * float64(time.Second))
+	if d <= 0 || d > maxWindow {
+		return 0, nil, fmt.Errorf("%s(): seconds must be between 0 and %.0f", name, maxWindow.Seconds())
+	}
+	var patterns []string
+	for _, arg := range args[1:] {
+		s, ok := arg.(string)
+		if !ok {
+			return 0, nil, fmt.Errorf("%s(): expected string pattern, but got %v", name, arg)
+		}
+		patterns = append(patterns, s)
+	}
+	return d, patterns, nil
+}
+
+// Within(seconds, pattern...) matches when the patterns occurred in order
+// within seconds, ending with the current event.
+//
+// eg: Within(30, 'door.front:on', 'pir.hall')
+func (self *Service) Within(args ...interface{}) (interface{}, error) {
+	if self.window == nil {
+		return nil, errors.New("Within(): event window not initialised")
+	}
+	d, patterns, err := parseWindowArgs("Within", args)
+	if err != nil {
+		return nil, err
+	}
+	return self.window.Sequence(d, patterns), nil
+}
+
+// WithinAny(seconds, pattern...) matches when all the patterns occurred in
+// any order within seconds, one of them being the current event.
+func (self *Service) WithinAny(args ...interface{}) (interface{}, error) {
+	if self.window == nil {
+		return nil, errors.New("WithinAny(): event window not initialised")
+	}
+	d, patterns, err := parseWindowArgs("WithinAny", args)
+	if err != nil {
+		return nil, err
+	}
+	return self.window.Unordered(d, patterns), nil
+}
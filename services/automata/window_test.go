@@ -0,0 +1,70 @@
+package automata
+
+import (
+	"testing"
+	"time"
+
+	"github.com/barnybug/gohome/pubsub"
+	"github.com/stretchr/testify/assert"
+)
+
+func windowEv(device, command, timestamp string) *pubsub.Event {
+	return pubsub.NewEvent("door", pubsub.Fields{"device": device, "command": command, "timestamp": timestamp})
+}
+
+func TestWindowSequence(t *testing.T) {
+	assert := assert.New(t)
+	w := &eventWindow{}
+	w.Add(windowEv("door.front", "on", "2017-09-26 19:24:00.000"))
+	w.Add(windowEv("light.porch", "on", "2017-09-26 19:24:05.000"))
+	w.Add(windowEv("pir.hall", "on", "2017-09-26 19:24:20.000"))
+
+	assert.True(w.Sequence(30*time.Second, []string{"door.front", "pir.hall"}))
+	assert.True(w.Sequence(30*time.Second, []string{"door.front:on", "pir.hall"}))
+	assert.False(w.Sequence(30*time.Second, []string{"door.front:off", "pir.hall"}))
+	assert.False(w.Sequence(10*time.Second, []string{"door.front", "pir.hall"}))
+	// wrong order
+	assert.False(w.Sequence(30*time.Second, []string{"pir.hall", "door.front"}))
+	// current event must complete the sequence
+	assert.False(w.Sequence(30*time.Second, []string{"door.front", "light.porch"}))
+}
+
+func TestWindowUnordered(t *testing.T) {
+	assert := assert.New(t)
+	w := &eventWindow{}
+	w.Add(windowEv("pir.hall", "on", "2017-09-26 19:24:00.000"))
+	w.Add(windowEv("door.front", "on", "2017-09-26 19:24:20.000"))
+
+	assert.True(w.Unordered(30*time.Second, []string{"door.front", "pir.hall"}))
+	assert.True(w.Unordered(30*time.Second, []string{"pir.hall", "door.front"}))
+	assert.False(w.Unordered(10*time.Second, []string{"door.front", "pir.hall"}))
+	assert.False(w.Unordered(30*time.Second, []string{"pir.hall", "light.porch"}))
+}
+
+func TestWindowExpire(t *testing.T) {
+	w := &eventWindow{}
+	w.Add(windowEv("door.front", "on", "2017-09-26 19:00:00.000"))
+	w.Add(windowEv("pir.hall", "on", "2017-09-26 19:24:00.000"))
+	assert.Equal(t, 1, len(w.events))
+}
+
+func TestWithin(t *testing.T) {
+	assert := assert.New(t)
+	s := &Service{window: &eventWindow{}}
+	s.window.Add(windowEv("door.front", "on", "2017-09-26 19:24:00.000"))
+	s.window.Add(windowEv("pir.hall", "on", "2017-09-26 19:24:20.000"))
+
+	result, err := s.Within(30, "door.front", "pir.hall")
+	assert.NoError(err)
+	assert.Equal(true, result)
+	result, err = s.WithinAny(int64(30), "pir.hall", "door.front")
+	assert.NoError(err)
+	assert.Equal(true, result)
+
+	_, err = s.Within("a", "door.front")
+	assert.Error(err)
+	_, err = s.Within(30)
+	assert.Error(err)
+	_, err = s.Within(3600, "door.front")
+	assert.Error(err)
+}
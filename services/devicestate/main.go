@@ -0,0 +1,334 @@
+// Service to track the desired state of devices, from the commands sent to
+// them, against their reported state, from the events they emit.
+//
+// Desired state is recorded from on/off commands, and from thermostat target
+// events (eg heating setting eTRVs) not sent by the device itself.
+//
+// Devices on protocols configured under devicestate.protocols have their
+// desired state re-issued every reconcile interval while they are out of sync.
+// A thermostat.X without a source is on the protocol of its trv.X.
+// Protocols marked unacknowledged (eg energenie eTRVs, 433MHz sockets) only
+// ever confirm transmission, so are re-issued every interval regardless.
+//
+// A retained devicestate event is published per device on any change:
+//
+//	{"device": "light.kitchen", "desired": {"command": "on"}, "reported": {"command": "off"}, "in_sync": false}
+package devicestate
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/barnybug/gohome/pubsub"
+	"github.com/barnybug/gohome/services"
+	"github.com/barnybug/gohome/util"
+)
+
+// Fields compared between desired and reported state.
+var stateFields = []string{"command", "level", "temp", "colour"}
+
+// Fields compared for thermostats.
+var targetFields = []string{"target"}
+
+var tickInterval = 10 * time.Second
+
+type DeviceState struct {
+	Desired  pubsub.Fields
+	Reported pubsub.Fields
+	InSync   bool
+	Changed  time.Time // desired state last changed
+	LastSent time.Time // desired state last (re-)issued
+	Reissued int
+}
+
+// Service devicestate
+type Service struct {
+	devices map[string]*DeviceState
+}
+
+func (self *Service) ID() string {
+	return "devicestate"
+}
+
+func stateOf(ev *pubsub.Event) pubsub.Fields {
+	if !ev.IsSet("command") {
+		return pickFields(ev, targetFields)
+	}
+	return pickFields(ev, stateFields)
+}
+
+func pickFields(ev *pubsub.Event, names []string) pubsub.Fields {
+	fields := pubsub.Fields{}
+	for _, field := range names {
+		if value, ok := ev.Fields[field]; ok {
+			fields[field] = value
+		}
+	}
+	return fields
+}
+
+func equal(a, b interface{}) bool {
+	// compare numbers irrespective of int/float encoding
+	if fa, ok := number(a); ok {
+		fb, ok := number(b)
+		return ok && fa == fb
+	}
+	return a == b
+}
+
+func number(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+func inSync(desired, reported pubsub.Fields) bool {
+	if reported == nil {
+		return false
+	}
+	if desired["command"] == "off" {
+		// level, colour, etc. are irrelevant once off
+		return reported["command"] == "off"
+	}
+	for k, v := range desired {
+		if !equal(v, reported[k]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (self *Service) device(device string) *DeviceState {
+	if _, ok := self.devices[device]; !ok {
+		self.devices[device] = &DeviceState{}
+	}
+	return self.devices[device]
+}
+
+// Event records desired state from commands and reported state from device
+// events.
+func (self *Service) Event(ev *pubsub.Event, now time.Time) {
+	device := ev.Device()
+	if device == "" {
+		return
+	}
+	switch ev.Topic {
+	case "devicestate":
+		// restore desired state from the retained events on startup
+		if _, ok := self.devices[device]; ok {
+			return
+		}
+		var desired pubsub.Fields
+		switch d := ev.Fields["desired"].(type) {
+		case map[string]interface{}:
+			desired = d
+		case pubsub.Fields:
+			desired = d
+		}
+		if desired != nil {
+			state := self.device(device)
+			state.Desired = desired
+			state.Changed = now
+			state.InSync = inSync(state.Desired, state.Reported)
+		}
+		return
+	case "command":
+		if _, ok := services.Config.Devices[device]; !ok {
+			return
+		}
+		command := ev.Command()
+		if command != "on" && command != "off" {
+			return
+		}
+		if !self.desire(device, stateOf(ev), now) {
+			return
+		}
+	case "thermostat":
+		dev, ok := services.Config.Devices[device]
+		if !ok || !ev.IsSet("target") {
+			return
+		}
+		if dev.Source != "" && ev.Source() == dev.Source {
+			// reported by the thermostat itself
+			if !self.report(device, ev) {
+				return
+			}
+		} else if !self.desire(device, pickFields(ev, targetFields), now) {
+			return
+		}
+	default:
+		if !self.report(device, ev) {
+			return
+		}
+	}
+	self.publish(device)
+}
+
+// desire records the desired state sent to a device, returning true if it
+// changed.
+func (self *Service) desire(device string, desired pubsub.Fields, now time.Time) bool {
+	state := self.device(device)
+	state.LastSent = now
+	if reflect.DeepEqual(desired, state.Desired) {
+		return false
+	}
+	state.Desired = desired
+	state.Changed = now
+	state.Reissued = 0
+	return true
+}
+
+// report records the state a device reports, returning true if it changed.
+func (self *Service) report(device string, ev *pubsub.Event) bool {
+	if !ev.IsSet("command") && !ev.IsSet("target") {
+		return false
+	}
+	state, ok := self.devices[device]
+	if !ok {
+		return false
+	}
+	reported := pubsub.Fields{}
+	for k, v := range state.Reported {
+		reported[k] = v
+	}
+	for k, v := range stateOf(ev) {
+		reported[k] = v
+	}
+	if reflect.DeepEqual(reported, state.Reported) {
+		return false
+	}
+	state.Reported = reported
+	return true
+}
+
+func (self *Service) publish(device string) {
+	state := self.devices[device]
+	state.InSync = inSync(state.Desired, state.Reported)
+
+	fields := pubsub.Fields{
+		"device":   device,
+		"desired":  state.Desired,
+		"reported": state.Reported,
+		"in_sync":  state.InSync,
+	}
+	ev := pubsub.NewEvent("devicestate", fields)
+	ev.SetRetained(true)
+	services.Publisher.Emit(ev)
+}
+
+// Reconcile re-issues the desired state of devices that are out of sync, or
+// on unacknowledged protocols.
+func (self *Service) Reconcile(now time.Time) {
+	for device, state := range self.devices {
+		if state.Desired == nil {
+			continue
+		}
+		if _, ok := services.Config.Devices[device]; !ok {
+			continue
+		}
+		conf, ok := services.Config.Reconciled(device)
+		if !ok {
+			continue
+		}
+		if state.InSync && !conf.Unacknowledged {
+			continue
+		}
+		if now.Sub(state.LastSent) < conf.Reconcile.Duration {
+			continue
+		}
+
+		if !conf.Unacknowledged {
+			log.Printf("%s out of sync, re-issuing: %v", device, state.Desired)
+		}
+		fields := pubsub.Fields{"device": device}
+		for k, v := range state.Desired {
+			fields[k] = v
+		}
+		topic := "command"
+		if _, ok := state.Desired["command"]; !ok {
+			topic = "thermostat"
+			fields["source"] = "devicestate"
+		}
+		ev := pubsub.NewEvent(topic, fields)
+		services.Publisher.Emit(ev)
+		state.LastSent = now
+		state.Reissued++
+	}
+}
+
+func (self *Service) QueryHandlers() services.QueryHandlers {
+	return services.QueryHandlers{
+		"status": services.TextHandler(self.queryStatus),
+		"help":   services.StaticHandler("status: get status\n"),
+	}
+}
+
+func formatFields(fields pubsub.Fields) string {
+	if fields == nil {
+		return "unknown"
+	}
+	var keys []string
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var ps []string
+	for _, k := range keys {
+		if k == "command" {
+			ps = append([]string{fmt.Sprint(fields[k])}, ps...)
+		} else {
+			ps = append(ps, fmt.Sprintf("%s=%v", k, fields[k]))
+		}
+	}
+	return strings.Join(ps, " ")
+}
+
+func (self *Service) queryStatus(q services.Question) string {
+	var devices []string
+	for device := range self.devices {
+		devices = append(devices, device)
+	}
+	sort.Strings(devices)
+
+	now := time.Now()
+	var out string
+	for _, device := range devices {
+		state := self.devices[device]
+		symbol := "✔️"
+		if !state.InSync {
+			symbol = "✖️"
+		}
+		out += fmt.Sprintf("%s %-20s desired: %s reported: %s (%s, reissued %d)\n",
+			symbol, device, formatFields(state.Desired), formatFields(state.Reported),
+			util.ShortDuration(now.Sub(state.Changed)), state.Reissued)
+	}
+	return out
+}
+
+func (self *Service) Init() error {
+	self.devices = map[string]*DeviceState{}
+	return nil
+}
+
+func (self *Service) Run() error {
+	ticker := time.NewTicker(tickInterval)
+	events := services.Subscriber.Channel()
+	for {
+		select {
+		case ev := <-events:
+			self.Event(ev, time.Now())
+		case now := <-ticker.C:
+			self.Reconcile(now)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package devicestate
+
+import (
+	"testing"
+	"time"
+
+	"github.com/barnybug/gohome/config"
+	"github.com/barnybug/gohome/pubsub"
+	"github.com/barnybug/gohome/pubsub/dummy"
+	"github.com/barnybug/gohome/services"
+	"github.com/stretchr/testify/assert"
+)
+
+func ExampleInterfaces() {
+	var _ services.Service = (*Service)(nil)
+	var _ services.ServiceInit = (*Service)(nil)
+	// Output:
+}
+
+var t0 = time.Date(2014, 1, 2, 3, 4, 5, 0, time.UTC)
+
+func setup() (*Service, *dummy.Publisher) {
+	// copy, as the example config is shared
+	conf := *config.ExampleConfig
+	conf.Devicestate = config.DevicestateConf{
+		Protocols: map[string]config.DevicestateProtocolConf{
+			"homeeasy":  {Reconcile: config.Duration{Duration: time.Minute}},
+			"x10":       {Reconcile: config.Duration{Duration: time.Minute}, Unacknowledged: true},
+			"energenie": {Reconcile: config.Duration{Duration: time.Minute}, Unacknowledged: true},
+		},
+	}
+	services.Config = &conf
+	pub := &dummy.Publisher{}
+	services.Publisher = pub
+	service := &Service{}
+	service.Init()
+	return service, pub
+}
+
+func TestDesiredReported(t *testing.T) {
+	assert := assert.New(t)
+	service, pub := setup()
+
+	command := pubsub.NewCommand("light.glowworm", "on")
+	command.SetField("level", 50)
+	service.Event(command, t0)
+	assert.Equal(1, len(pub.Events))
+	ev := pub.Events[0]
+	assert.Equal("devicestate", ev.Topic)
+	assert.True(ev.Retained)
+	assert.Equal(false, ev.Fields["in_sync"])
+
+	ack := pubsub.NewEvent("ack", pubsub.Fields{"device": "light.glowworm", "command": "on", "level": 50.0})
+	service.Event(ack, t0)
+	assert.Equal(2, len(pub.Events))
+	assert.Equal(true, pub.Events[1].Fields["in_sync"])
+
+	// no change, nothing published
+	service.Event(ack, t0)
+	assert.Equal(2, len(pub.Events))
+
+	// in sync, not re-issued
+	service.Reconcile(t0.Add(time.Hour))
+	assert.Equal(2, len(pub.Events))
+}
+
+func TestReconcile(t *testing.T) {
+	assert := assert.New(t)
+	service, pub := setup()
+
+	service.Event(pubsub.NewCommand("light.glowworm", "off"), t0)
+	service.Event(pubsub.NewEvent("homeeasy", pubsub.Fields{"device": "light.glowworm", "command": "on"}), t0)
+	pub.Events = nil
+
+	service.Reconcile(t0.Add(30 * time.Second))
+	assert.Equal(0, len(pub.Events))
+	service.Reconcile(t0.Add(time.Minute))
+	assert.Equal(1, len(pub.Events))
+	assert.Equal("command", pub.Events[0].Topic)
+	assert.Equal("light.glowworm", pub.Events[0].Device())
+	assert.Equal("off", pub.Events[0].Command())
+	assert.Equal(1, service.devices["light.glowworm"].Reissued)
+}
+
+func TestReconcileUnacknowledged(t *testing.T) {
+	assert := assert.New(t)
+	service, pub := setup()
+
+	service.Event(pubsub.NewCommand("light.kitchen", "on"), t0)
+	service.Event(pubsub.NewEvent("ack", pubsub.Fields{"device": "light.kitchen", "command": "on"}), t0)
+	pub.Events = nil
+
+	service.Reconcile(t0.Add(time.Minute))
+	assert.Equal(1, len(pub.Events))
+	assert.Equal("on", pub.Events[0].Command())
+}
+
+func TestRestore(t *testing.T) {
+	assert := assert.New(t)
+	service, pub := setup()
+
+	retained := pubsub.NewEvent("devicestate", pubsub.Fields{
+		"device":  "light.kitchen",
+		"desired": map[string]interface{}{"command": "off"},
+		"in_sync": true,
+	})
+	service.Event(retained, t0)
+	assert.Equal(0, len(pub.Events))
+	assert.Equal(pubsub.Fields{"command": "off"}, service.devices["light.kitchen"].Desired)
+
+	service.Reconcile(t0.Add(time.Minute))
+	assert.Equal(1, len(pub.Events))
+	assert.Equal("off", pub.Events[0].Command())
+}
+
+func TestThermostatTarget(t *testing.T) {
+	assert := assert.New(t)
+	service, pub := setup()
+
+	target := pubsub.NewEvent("thermostat", pubsub.Fields{"device": "trv.living", "source": "ch", "target": 18.5})
+	service.Event(target, t0)
+	assert.Equal(1, len(pub.Events))
+	assert.Equal(pubsub.Fields{"target": 18.5}, service.devices["trv.living"].Desired)
+
+	// temperature readings aren't reported state
+	service.Event(pubsub.NewEvent("temp", pubsub.Fields{"device": "trv.living", "temp": 17.0}), t0)
+	assert.Equal(1, len(pub.Events))
+
+	// unchanged target repeated
+	service.Event(target, t0.Add(30*time.Second))
+	assert.Equal(1, len(pub.Events))
+
+	pub.Events = nil
+	service.Reconcile(t0.Add(time.Minute))
+	assert.Equal(0, len(pub.Events))
+	service.Reconcile(t0.Add(90 * time.Second))
+	assert.Equal(1, len(pub.Events))
+	ev := pub.Events[0]
+	assert.Equal("thermostat", ev.Topic)
+	assert.Equal("trv.living", ev.Device())
+	assert.Equal(18.5, ev.Fields["target"])
+
+	// re-issued event is recognised as the same desired state
+	service.Event(ev, t0.Add(90*time.Second))
+	assert.Equal(1, len(pub.Events))
+}
+
+func TestThermostatZoneTarget(t *testing.T) {
+	assert := assert.New(t)
+	service, pub := setup()
+
+	// thermostat.living has no source, its targets go to trv.living
+	service.Event(pubsub.NewEvent("thermostat", pubsub.Fields{"device": "thermostat.living", "source": "ch", "target": 19.0}), t0)
+	pub.Events = nil
+	service.Reconcile(t0.Add(time.Minute))
+	assert.Equal(1, len(pub.Events))
+	assert.Equal("thermostat.living", pub.Events[0].Device())
+	assert.Equal(19.0, pub.Events[0].Fields["target"])
+}
+
+func TestThermostatReported(t *testing.T) {
+	assert := assert.New(t)
+	service, pub := setup()
+
+	service.Event(pubsub.NewEvent("thermostat", pubsub.Fields{"device": "trv.living", "source": "ch", "target": 18.5}), t0)
+	service.Event(pubsub.NewEvent("thermostat", pubsub.Fields{"device": "trv.living", "source": "energenie.00097f", "target": 18.5}), t0)
+	assert.Equal(2, len(pub.Events))
+	assert.Equal(true, pub.Events[1].Fields["in_sync"])
+	assert.Equal(pubsub.Fields{"target": 18.5}, service.devices["trv.living"].Reported)
+}
@@ -0,0 +1,57 @@
+package services
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+
+	"github.com/barnybug/gohome/pubsub"
+)
+
+// config edits emitted, but not yet received back as the config.
+var configEdits struct {
+	sync.Mutex
+	base    []byte   // config the edits were made on
+	emitted [][]byte // oldest first
+}
+
+// EditConfig applies edit to the raw config and emits the result as the
+// retained config. Edits are serialised and made on top of any earlier edit
+// not yet received back, so quick successive edits aren't lost.
+func EditConfig(publisher pubsub.Publisher, edit func(raw []byte) ([]byte, error)) error {
+	configEdits.Lock()
+	defer configEdits.Unlock()
+	if !bytes.Equal(RawConfig, configEdits.base) {
+		// received since: drop the edits up to it, or all of them if the
+		// config was changed elsewhere
+		received := 0
+		for i, data := range configEdits.emitted {
+			if bytes.Equal(data, RawConfig) {
+				received = i + 1
+			}
+		}
+		if received == 0 {
+			configEdits.emitted = nil
+		} else {
+			configEdits.emitted = configEdits.emitted[received:]
+		}
+		configEdits.base = RawConfig
+	}
+
+	raw := RawConfig
+	if n := len(configEdits.emitted); n > 0 {
+		raw = configEdits.emitted[n-1]
+	}
+	if len(raw) == 0 {
+		return errors.New("No config loaded")
+	}
+	data, err := edit(raw)
+	if err != nil {
+		return err
+	}
+	ev := pubsub.NewRawEvent("config", data)
+	ev.SetRetained(true) // config messages are retained
+	publisher.Emit(ev)
+	configEdits.emitted = append(configEdits.emitted, data)
+	return nil
+}
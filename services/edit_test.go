@@ -0,0 +1,39 @@
+package services
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/barnybug/gohome/pubsub/dummy"
+)
+
+func appendEdit(s string) func([]byte) ([]byte, error) {
+	return func(raw []byte) ([]byte, error) {
+		return append(append([]byte{}, raw...), s...), nil
+	}
+}
+
+func TestEditConfig(t *testing.T) {
+	RawConfig = []byte("a")
+	em := &dummy.Publisher{}
+	assert.NoError(t, EditConfig(em, appendEdit("b")))
+	// on top of the edit still pending
+	assert.NoError(t, EditConfig(em, appendEdit("c")))
+	assert.Equal(t, "abc", string(em.Events[1].Raw))
+	assert.True(t, em.Events[1].Retained)
+
+	// first edit received back, the second still pending
+	RawConfig = []byte("ab")
+	assert.NoError(t, EditConfig(em, appendEdit("d")))
+	assert.Equal(t, "abcd", string(em.Events[2].Raw))
+
+	// changed elsewhere
+	RawConfig = []byte("x")
+	assert.NoError(t, EditConfig(em, appendEdit("e")))
+	assert.Equal(t, "xe", string(em.Events[3].Raw))
+
+	assert.Error(t, EditConfig(em, func([]byte) ([]byte, error) { return nil, errors.New("invalid") }))
+	assert.Equal(t, 4, len(em.Events))
+}
@@ -6,8 +6,10 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/RangelReale/osin"
 	"github.com/barnybug/gohome/pubsub"
@@ -74,9 +76,16 @@ type QueryRequestPayload struct {
 	}
 }
 
+type HSVState struct {
+	Hue        float64 `json:"hue"`
+	Saturation float64 `json:"saturation"`
+	Value      float64 `json:"value"`
+}
+
 type ColorState struct {
-	Temperature int `json:"temperature,omitempty"`
-	SpectrumRGB int `json:"spectrumRGB,omitempty"`
+	Temperature int       `json:"temperature,omitempty"`
+	SpectrumRGB int       `json:"spectrumRGB,omitempty"`
+	SpectrumHSV *HSVState `json:"spectrumHSV,omitempty"`
 }
 
 type DeviceState struct {
@@ -161,8 +170,8 @@ var types = map[string]string{
 	"switch": "action.devices.types.OUTLET",
 }
 
-func syncRequest() (*SyncResponsePayload, error) {
-	log.Println("Received sync request")
+// syncDevices returns the devices exposed to Google Home.
+func syncDevices() []Device {
 	out := []Device{}
 	for _, device := range services.Config.Devices {
 		if device.Group == "" {
@@ -183,13 +192,14 @@ func syncRequest() (*SyncResponsePayload, error) {
 			typ = "action.devices.types.LIGHT"
 			traits = append(traits, "action.devices.traits.Brightness")
 		}
-		if contains(device.Caps, "colourtemp") || contains(device.Caps, "colour") {
+		colourTemp := contains(device.Caps, "ct") || contains(device.Caps, "colourtemp")
+		if colourTemp || contains(device.Caps, "colour") {
 			typ = "action.devices.types.LIGHT"
 			traits = append(traits, "action.devices.traits.ColorSetting")
 			if contains(device.Caps, "colour") {
 				attributes["colorModel"] = "rgb"
 			}
-			if contains(device.Caps, "colourtemp") {
+			if colourTemp {
 				attributes["colorTemperatureRange"] = map[string]interface{}{
 					"temperatureMinK": 2200,
 					"temperatureMaxK": 6700,
@@ -230,13 +240,37 @@ func syncRequest() (*SyncResponsePayload, error) {
 		}
 		out = append(out, o)
 	}
+	return out
+}
+
+func syncRequest() (*SyncResponsePayload, error) {
+	log.Println("Received sync request")
 	payload := SyncResponsePayload{
 		AgentUserId: "gohome",
-		Devices:     out,
+		Devices:     syncDevices(),
 	}
 	return &payload, nil
 }
 
+// checkControl returns an error unless the query only switches devices
+// exposed to Google Home.
+func checkControl(query string) error {
+	devices, ok, err := services.QueryDevices(query)
+	if err != nil || !ok {
+		return err
+	}
+	exposed := map[string]bool{}
+	for _, device := range syncDevices() {
+		exposed[device.Id] = true
+	}
+	for _, device := range devices {
+		if !exposed[device] {
+			return fmt.Errorf("%s is not controllable", device)
+		}
+	}
+	return nil
+}
+
 const ApplicationJson = "application/json"
 
 func errorResponse(w http.ResponseWriter, code int, err error, message string) {
@@ -367,6 +401,13 @@ func executeCommands(device string, executions []Execution) ExecuteResult {
 				} else if color.SpectrumRGB != 0 {
 					colour := fmt.Sprintf("#%06x", color.SpectrumRGB)
 					command.SetField("colour", colour)
+				} else if color.SpectrumHSV != nil {
+					command.SetField("hue", color.SpectrumHSV.Hue)
+					command.SetField("saturation", color.SpectrumHSV.Saturation*100)
+					if color.SpectrumHSV.Value != 0 {
+						// brightness, as the level
+						command.SetField("level", int(math.Round(color.SpectrumHSV.Value*100)))
+					}
 				}
 				states.Color = execution.Params.Color
 			}
@@ -482,6 +523,48 @@ func actionsEndpoint(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// TextRequest is a conversational fulfillment request (Dialogflow), with the
+// text spoken.
+type TextRequest struct {
+	QueryResult struct {
+		QueryText string `json:"queryText"`
+	} `json:"queryResult"`
+}
+
+type TextResponse struct {
+	FulfillmentText string `json:"fulfillmentText"`
+}
+
+// textEndpoint answers spoken text, matched to an intent and queried.
+func textEndpoint(w http.ResponseWriter, r *http.Request) {
+	err := checkAuthorization(r)
+	if err != nil {
+		errorResponse(w, http.StatusUnauthorized, err, "Authorization failed")
+		return
+	}
+	var request TextRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		errorResponse(w, http.StatusBadRequest, err, "Failed to decode request")
+		return
+	}
+	text := request.QueryResult.QueryText
+	log.Printf("-> %s", text)
+
+	var response TextResponse
+	if match := services.MatchIntent(text); match == nil {
+		response.FulfillmentText = fmt.Sprintf("Sorry, I didn't understand %s", text)
+	} else if err := checkControl(match.Query); err != nil {
+		response.FulfillmentText = fmt.Sprintf("Sorry, %s", err)
+	} else if resp, err := services.RPC(match.Query, time.Second*5); err != nil {
+		response.FulfillmentText = fmt.Sprintf("Sorry, %s", err)
+	} else {
+		response.FulfillmentText = resp
+	}
+	log.Printf("<- %s", response.FulfillmentText)
+	w.Header().Add("Content-Type", ApplicationJson)
+	json.NewEncoder(w).Encode(&response)
+}
+
 type loggingHandler struct {
 	handler http.Handler
 }
@@ -566,6 +649,7 @@ func (self *Service) Run() error {
 		osin.OutputJSON(resp, w, r)
 	})
 	http.HandleFunc("/actions", actionsEndpoint)
+	http.HandleFunc("/text", textEndpoint)
 	http.ListenAndServe(":8085", loggingHandler{http.DefaultServeMux})
 	return nil
 }
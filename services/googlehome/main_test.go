@@ -8,8 +8,10 @@ import (
 
 	"github.com/barnybug/gohome/config"
 	"github.com/barnybug/gohome/pubsub"
+	"github.com/barnybug/gohome/pubsub/dummy"
 	"github.com/barnybug/gohome/services"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestMissingAuthorization(t *testing.T) {
@@ -45,6 +47,7 @@ func TestSync(t *testing.T) {
 	assert.Equal(t, ApplicationJson, rr.Header().Get("Content-Type"))
 	assert.Contains(t, rr.Body.String(), `{"id":"light.kitchen","type":"action.devices.types.LIGHT","traits":["action.devices.traits.OnOff"],"name":{"name":"Kitchen","nicknames":["Kitchen"]},"willReportState":false}`)
 	assert.Contains(t, rr.Body.String(), `{"id":"light.glowworm","type":"action.devices.types.LIGHT","traits":["action.devices.traits.Brightness"],"name":{"name":"Glowworm","nicknames":["Glowworm","glow worm"]},"willReportState":false}`)
+	assert.Contains(t, rr.Body.String(), `{"id":"scene.movie","type":"action.devices.types.SCENE","traits":["action.devices.traits.Scene"],"name":{"name":"Movie","nicknames":["Movie"]},"willReportState":false,"attributes":{"sceneReversible":true}}`)
 	assert.Contains(t, rr.Body.String(), `{"id":"thermostat.living","type":"action.devices.types.THERMOSTAT","traits":["action.devices.traits.TemperatureSetting"],"name":{"name":"Living room thermostat","nicknames":["Living room thermostat"]},"willReportState":false,"attributes":{"availableThermostatModes":"heat","thermostatTemperatureUnit":"C"},"roomHint":"Living Room"}`)
 }
 
@@ -85,3 +88,59 @@ func TestQueryThermostat(t *testing.T) {
 	assert.Equal(t, `{"requestId":"123","payload":{"devices":{"thermostat.living":{"online":true,"thermostatMode":"heat","thermostatTemperatureSetpoint":17,"thermostatTemperatureAmbient":19.5}}}}
 `, rr.Body.String())
 }
+
+func TestTextNotUnderstood(t *testing.T) {
+	services.Config = config.ExampleConfig
+
+	body := `{"queryResult":{"queryText":"make me a sandwich"}}`
+	req, _ := http.NewRequest("POST", "/text", strings.NewReader(body))
+	req.Header.Add("Authorization", "Bearer xyz")
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(textEndpoint)
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, `{"fulfillmentText":"Sorry, I didn't understand make me a sandwich"}`+"\n", rr.Body.String())
+}
+
+func TestTextCheckControl(t *testing.T) {
+	services.Config = config.Must(config.OpenRaw([]byte(`
+devices:
+  light.kitchen:
+    name: Kitchen
+    group: downstairs
+    caps: [switch]
+  light.shed:
+    name: Shed
+    caps: [switch]
+`)))
+	assert.NoError(t, checkControl("switch light.kitchen on"))
+	assert.NoError(t, checkControl("api/presence"))
+	// not synced, having no group
+	assert.EqualError(t, checkControl("switch light.shed on"), "light.shed is not controllable")
+	assert.EqualError(t, checkControl("switch cap:switch off"), "light.shed is not controllable")
+}
+
+func TestExecuteColourHSV(t *testing.T) {
+	services.Config = config.ExampleConfig
+	em := &dummy.Publisher{}
+	services.Publisher = em
+
+	for _, tc := range []struct {
+		value float64
+		level interface{}
+	}{
+		{1.0, 100},
+		{0.5, 50},
+		{0.25, 25},
+	} {
+		em.Events = nil
+		color := &ColorState{SpectrumHSV: &HSVState{Hue: 240, Saturation: 0.5, Value: tc.value}}
+		executeCommands("light.glowworm", []Execution{{Command: "action.devices.commands.ColorAbsolute", Params: DeviceState{Color: color}}})
+		require.Equal(t, 1, len(em.Events))
+		ev := em.Events[0]
+		assert.Equal(t, 240.0, ev.Fields["hue"])
+		assert.Equal(t, 50.0, ev.Fields["saturation"])
+		assert.Equal(t, tc.level, ev.Fields["level"], "value %v", tc.value)
+	}
+}
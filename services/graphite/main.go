@@ -16,16 +16,6 @@ var (
 
 var graphiteAggs = []string{"avg", "max", "min"}
 
-var ignoredFields = map[string]bool{
-	"topic":     true,
-	"timestamp": true,
-	"source":    true,
-	"sensor":    true,
-	"origin":    true,
-	"device":    true,
-	"repeat":    true,
-}
-
 var eventsTotal = map[string]int{}
 
 func sendToGraphite(ev *pubsub.Event) {
@@ -39,34 +29,7 @@ func sendToGraphite(ev *pubsub.Event) {
 	}
 
 	timestamp := ev.Timestamp.UTC().Unix()
-	for metric, value := range ev.Fields {
-		if ignoredFields[metric] {
-			continue
-		}
-
-		var floatValue float64
-		switch value.(type) {
-		case bool:
-			if value == true {
-				floatValue = 1
-			} else {
-				floatValue = 0
-			}
-		case uint8, uint16, uint32, uint64, int8, int16, int32, int64, float32, float64:
-			floatValue = value.(float64)
-		case string:
-			if value == "off" {
-				floatValue = 0
-			} else if value == "on" {
-				floatValue = 1
-			} else {
-				continue
-			}
-		default:
-			// ignore non-numeric values
-			continue
-		}
-
+	for metric, floatValue := range graphite.NumericFields(ev) {
 		for _, x := range graphiteAggs {
 			path := fmt.Sprintf("sensor.%s.%s.%s", device, metric, x)
 			gr.Add(path, timestamp, floatValue)
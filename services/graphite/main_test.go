@@ -1,6 +1,8 @@
 package graphite
 
-import "github.com/barnybug/gohome/services"
+import (
+	"github.com/barnybug/gohome/services"
+)
 
 func ExampleInterfaces() {
 	var _ services.Service = (*Service)(nil)
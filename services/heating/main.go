@@ -2,19 +2,53 @@
 // Supports multiple temperature points on a daily schedule, temporary
 // override ('party mode'), hibernation when the house is empty and advanced
 // preheating ('holiday mode').
+//
+// With heating.preheat set, zones are heated early (optimum start) to reach
+// the next scheduled temperature on time, up to the given maximum lead. The
+// warm-up rate is learnt per zone from the rate the temperature rises while
+// the heating is on, banded by outside temperature if a weather temp sensor
+// is configured.
+//
+// Open windows are detected by a rapid temperature drop (heating.window.drop
+// in °C/min) or a window contact device on the zone, and heating the zone
+// is suspended while open, or for heating.window.suspend.
+//
+// With the weather temp sensor configured, heating.weather compensates
+// scheduled targets for the outside temperature, turns the heating off above
+// a summer threshold, and protects an empty house from frost.
+//
+// Should a zone sensor go stale (or give no reading after starting), a
+// heating_fault event is emitted and the zone falls back to a second sensor, a
+// duty cycle or holding the trv at target within a duty cycle, as configured
+// by the zone fallback.
+//
+// Zones may have alternative named schedule profiles (eg 'wfh'), switched
+// between house-wide with the profile query, optionally until a given time.
+//
+// Boiler on-time, zone demand, degree-minutes below target and outside
+// temperature are accumulated per day, published as a heating_report event at
+// the end of each day and available from the report query.
+//
+// Zone schedules can be edited with the schedule query, which writes the
+// change back to the retained config.
+//
+// A zone may declare its own heaters (eg an electric heater), which are
+// switched by the zone rather than the boiler, zone valves opened along with
+// the boiler, and trvs to be set to the zone target.
 package heating
 
 import (
 	"errors"
 	"fmt"
 	"log"
-	"regexp"
+	"math"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/barnybug/gohome/config"
+	"github.com/barnybug/gohome/lib/schedule"
 	"github.com/barnybug/gohome/pubsub"
 	"github.com/barnybug/gohome/services"
 	"github.com/barnybug/gohome/util"
@@ -25,172 +59,157 @@ var Clock = func() time.Time {
 }
 
 var maxTempAge, _ = time.ParseDuration("6m")
+var maxOutsideAge, _ = time.ParseDuration("1h")
 
-type Schedule struct {
-	Days map[time.Weekday][]ScheduleTemp
+type Zone struct {
+	Thermostat   string
+	Temp         float64
+	Rate         float64
+	At           time.Time
+	Schedule     *schedule.Schedule
+	Profiles     map[string]*schedule.Schedule
+	Heaters      []string
+	Valves       []string
+	Trvs         []string
+	Demand       bool // zone heating demand, after overrides
+	PartyTemp    float64
+	PartyUntil   time.Time
+	Sensor       string
+	Warmup       WarmupRates
+	Hysteresis   config.HysteresisConf
+	Calling      bool      // zone calling for heat
+	Contact      string    // window contact device
+	Window       bool      // window open - heating suspended
+	WindowUntil  time.Time // suspended until, zero while contact is open
+	Fallback     config.FallbackConf
+	FallbackTemp float64
+	FallbackAt   time.Time
+	Duty         float64 // learnt fraction of time calling for heat
+	Fault        bool    // zone sensor stale
+	FaultSince   time.Time
 }
 
-type ScheduleTemp struct {
-	Start int
-	End   int
-	Temp  float64
+// Reading returns the current temperature of the zone, from the zone sensor
+// or the fallback sensor, if either is recent.
+func (self *Zone) Reading(now time.Time) (float64, bool) {
+	if now.Sub(self.At) < maxTempAge {
+		return self.Temp, true
+	}
+	if self.Fallback.Sensor != "" && now.Sub(self.FallbackAt) < maxTempAge {
+		return self.FallbackTemp, true
+	}
+	return 0, false
 }
 
-const (
-	MinimumTemperature = 1.0
-	MaximumTemperature = 25.0
-)
+const dutyPeriod = 30 * time.Minute
 
-var reHourMinuteRange = regexp.MustCompile(`^(\d+):(\d+)-(\d+):(\d+)$`)
+// boiler duty cycle holding a trv at target, if not configured or learnt.
+const defaultTrvDuty = 0.5
 
-func ParseHourMinuteRange(s string) (int, int, error) {
-	m := reHourMinuteRange.FindStringSubmatch(s)
-	if m == nil {
-		return 0, 0, errors.New("Expected hh:mm-hh:mm")
+// FallbackCall decides if a zone without any temperature reading should call
+// for heat.
+func (self *Zone) FallbackCall(now time.Time, target, minimum float64) bool {
+	if target <= minimum {
+		return false
+	}
+	switch self.Fallback.Mode {
+	case "duty", "trv":
+		// a trv regulates the room itself, but is bounded by a duty cycle
+		// too in case it doesn't
+		phase := now.Sub(self.FaultSince) % dutyPeriod
+		return phase < time.Duration(self.FallbackDuty()*float64(dutyPeriod))
 	}
-	sh, _ := strconv.Atoi(m[1])
-	sm, _ := strconv.Atoi(m[2])
-	eh, _ := strconv.Atoi(m[3])
-	em, _ := strconv.Atoi(m[4])
-	return sh*60 + sm, eh*60 + em, nil
+	return false
 }
 
-func WeekdayRange(start, end time.Weekday) []time.Weekday {
-	var days []time.Weekday
-	i := start
-	for {
-		days = append(days, i)
-		if i == end {
-			break
-		}
-		i = NextWeekday(i)
+// FallbackDuty is the duty cycle while faulty: as configured, otherwise that
+// learnt, with a default for trvs.
+func (self *Zone) FallbackDuty() float64 {
+	duty := self.Fallback.Duty
+	if duty == 0 {
+		duty = self.Duty
 	}
-	return days
+	if duty == 0 && self.Fallback.Mode == "trv" {
+		duty = defaultTrvDuty
+	}
+	return duty
 }
 
-func NextWeekday(w time.Weekday) time.Weekday {
-	if w == time.Saturday {
-		return time.Sunday
-	} else {
-		return w + 1
+// Update the zone temperature, returning the rate of change since the last
+// update (°C/s).
+func (self *Zone) Update(temp float64, at time.Time) float64 {
+	var rate float64
+	if !self.At.IsZero() && !self.At.Equal(at) {
+		gap := at.Sub(self.At).Seconds()
+		rate = (temp - self.Temp) / gap
+		// weighted rolling average
+		self.Rate = rate*0.8 + self.Rate*0.2
 	}
+	self.Temp = temp
+	self.At = at
+	return rate
 }
 
-const Midnight = 24 * 60
+// Warm-up rates (°C/s) learnt while heating, overall and by outside
+// temperature band.
+type WarmupRates struct {
+	All   float64
+	Bands map[int]float64
+}
 
-func ParseWeekdays(s string) ([]time.Weekday, error) {
-	var weekdays []time.Weekday
-	for _, d := range strings.Split(s, ",") {
-		if d == "Weekdays" {
-			weekdays = append(weekdays, WeekdayRange(time.Monday, time.Friday)...)
-		} else if d == "Weekends" {
-			weekdays = append(weekdays, WeekdayRange(time.Saturday, time.Sunday)...)
-		} else if d == "All" {
-			weekdays = append(weekdays, WeekdayRange(time.Monday, time.Sunday)...)
-		} else if strings.Contains(d, "-") {
-			ps := strings.SplitN(d, "-", 2)
-			if len(ps) != 2 {
-				return nil, fmt.Errorf("Invalid range: %s", d)
-			}
-			var start, end time.Weekday
-			var ok bool
-			if start, ok = util.DOW[ps[0]]; !ok {
-				return nil, fmt.Errorf("Invalid weekday: %s", ps[0])
-			}
-			if end, ok = util.DOW[ps[1]]; !ok {
-				return nil, fmt.Errorf("Invalid weekday: %s", ps[1])
-			}
-			weekdays = append(weekdays, WeekdayRange(start, end)...)
-		} else {
-			if weekday, ok := util.DOW[d]; ok {
-				weekdays = append(weekdays, weekday)
-			} else {
-				return nil, fmt.Errorf("Invalid weekday: %s", weekday)
-			}
-		}
-	}
-	return weekdays, nil
+const warmupBandWidth = 5.0 // °C
+
+func warmupBand(outside float64) int {
+	return int(math.Floor(outside / warmupBandWidth))
 }
 
-func NewSchedule(conf config.ScheduleConf) (*Schedule, error) {
-	days := map[time.Weekday][]ScheduleTemp{}
-	for _, day := range WeekdayRange(time.Sunday, time.Saturday) {
-		days[day] = []ScheduleTemp{}
-	}
-	for weekdays, mts := range conf {
-		wds, err := ParseWeekdays(weekdays)
-		if err != nil {
-			return nil, err
-		}
-		for _, weekday := range wds {
-			for _, arr := range mts {
-				for at, temp := range arr {
-					start, end, err := ParseHourMinuteRange(at)
-					if err != nil {
-						return nil, err
-					}
-					if temp < MinimumTemperature || temp > MaximumTemperature {
-						return nil, fmt.Errorf("Temperature %.1f outside range %.1f <= t <= %.1f", temp, MinimumTemperature, MaximumTemperature)
-					}
-					if start > end {
-						// spanning midnight, split
-						tomorrow := NextWeekday(weekday)
-						s2 := ScheduleTemp{0, end, temp}
-						days[tomorrow] = append(days[tomorrow], s2)
-						end = Midnight
-					}
-					s := ScheduleTemp{start, end, temp}
-					days[weekday] = append(days[weekday], s)
-				}
-			}
-		}
+func learn(current, rate float64) float64 {
+	if current == 0 {
+		return rate
 	}
-	return &Schedule{Days: days}, nil
+	// slow moving average - warm-up varies reading to reading
+	return current*0.9 + rate*0.1
 }
 
-func (self *Schedule) Target(at time.Time, def float64) float64 {
-	day_mins := at.Hour()*60 + at.Minute()
-	target := def
-	if sts, ok := self.Days[at.Weekday()]; ok {
-		var specific = 86401
-		for _, st := range sts {
-			if st.Start <= day_mins && day_mins < st.End && st.End-st.Start < specific {
-				target = st.Temp
-				specific = st.End - st.Start
-			}
+func (self *WarmupRates) Learn(rate float64, outside *float64) {
+	self.All = learn(self.All, rate)
+	if outside != nil {
+		if self.Bands == nil {
+			self.Bands = map[int]float64{}
 		}
+		band := warmupBand(*outside)
+		self.Bands[band] = learn(self.Bands[band], rate)
 	}
-	return target
 }
 
-type Zone struct {
-	Thermostat string
-	Temp       float64
-	Rate       float64
-	At         time.Time
-	Schedule   *Schedule
-	PartyTemp  float64
-	PartyUntil time.Time
-	Sensor     string
+// Rate estimates the warm-up rate, given the outside temperature if known.
+func (self *WarmupRates) Rate(outside *float64) float64 {
+	if outside != nil {
+		if rate, ok := self.Bands[warmupBand(*outside)]; ok {
+			return rate
+		}
+	}
+	return self.All
 }
 
-func (self *Zone) Update(temp float64, at time.Time) {
-	if !self.At.IsZero() && !self.At.Equal(at) {
-		gap := at.Sub(self.At).Seconds()
-		rate := (temp - self.Temp) / gap
-		// weighted rolling average
-		self.Rate = rate*0.8 + self.Rate*0.2
-	}
-	self.Temp = temp
-	self.At = at
+type Preheat struct {
+	At   time.Time
+	Temp float64
 }
 
+// Check if the zone is calling for heat. Once calling the zone continues until
+// above target + hysteresis off, and otherwise starts below target -
+// hysteresis on, to avoid toggling on sensor jitter.
 func (self *Zone) Check(now time.Time, target float64) bool {
-	valid := now.Sub(self.At) < maxTempAge
-	if !valid {
-		return false
+	temp, valid := self.Reading(now)
+	if !valid || self.Window {
+		self.Calling = false
+	} else if self.Calling {
+		self.Calling = temp < target+self.Hysteresis.Off
+	} else {
+		self.Calling = temp < target-self.Hysteresis.On
 	}
-	return (self.Temp < target)
+	return self.Calling
 }
 
 func (self *Zone) setParty(temp float64, duration time.Duration, at time.Time) {
@@ -210,11 +229,36 @@ type Service struct {
 	Minimum       float64
 	Unoccupied    float64
 	Holiday       time.Time
+	MaxPreheat    time.Duration
+	MinOn         time.Duration
+	MinOff        time.Duration
+	Reason        string // why the heating is on or off
+	Window        config.WindowConf
+	Contacts      map[string]*Zone
+	Fallbacks     map[string]*Zone
+	Compensation  config.CompensationConf
+	Outside       *float64
+	OutsideAt     time.Time
+	Outputs       map[string]bool // zone heaters and valves state
+	Profile       string          // active schedule profile, empty for default
+	ProfileUntil  time.Time
+	Report        *DayReport            // today's runtime report
+	ReportAt      time.Time             // last accumulated
+	Reports       map[string]*DayReport // previous days, by date
 	Publisher     pubsub.Publisher
+	targets       map[string]float64 // thermostat targets last emitted, by device
+	started       time.Time
 }
 
 func (self *Service) Heartbeat() {
+	self.learnDuty(Clock())
 	self.Check(true)
+	self.accumulate(Clock())
+	// repeat the state to devices devicestate doesn't re-issue it to
+	if !reconciled(self.HeatingDevice) {
+		self.Command()
+	}
+	self.repeatOutputs()
 	// emit event for datalogging
 	fields := pubsub.Fields{
 		"device":  self.HeatingDevice,
@@ -224,11 +268,147 @@ func (self *Service) Heartbeat() {
 	}
 	ev := pubsub.NewEvent("heating", fields)
 	self.Publisher.Emit(ev)
-	// repeat current state
-	self.Command()
+}
+
+func zoneName(zone *Zone) string {
+	return strings.Replace(zone.Thermostat, "thermostat.", "", 1)
+}
+
+const defaultWindowSuspend = 30 * time.Minute
+
+func (self *Service) windowEvent(zone *Zone, command, reason string) {
+	fields := pubsub.Fields{
+		"device":  zone.Thermostat,
+		"source":  "ch",
+		"command": command,
+		"reason":  reason,
+	}
+	ev := pubsub.NewEvent("window", fields)
+	self.Publisher.Emit(ev)
+}
+
+// openWindow suspends heating a zone, until the given time or until the
+// contact closes if zero.
+func (self *Service) openWindow(zone *Zone, reason string, until time.Time) {
+	wasOpen := zone.Window
+	zone.Window = true
+	zone.WindowUntil = until
+	if wasOpen {
+		return
+	}
+	name := zoneName(zone)
+	log.Printf("Window open in %s (%s), suspending heating", name, reason)
+	self.windowEvent(zone, "open", reason)
+	if self.Window.Alert != "" {
+		message := fmt.Sprintf("Window open in %s (%s), heating suspended", name, reason)
+		services.SendAlert(message, self.Window.Alert, "", 0)
+	}
+}
+
+func (self *Service) closeWindow(zone *Zone, reason string) {
+	if !zone.Window {
+		return
+	}
+	zone.Window = false
+	zone.WindowUntil = time.Time{}
+	log.Printf("Window closed in %s (%s), resuming heating", zoneName(zone), reason)
+	self.windowEvent(zone, "closed", reason)
+}
+
+// checkWindows resumes zones suspended for a period that has passed.
+func (self *Service) checkWindows(now time.Time) {
+	for _, zone := range self.Zones {
+		if zone.Window && !zone.WindowUntil.IsZero() && !now.Before(zone.WindowUntil) {
+			self.closeWindow(zone, "suspension ended")
+		}
+	}
+}
+
+func (self *Service) windowSuspend() time.Duration {
+	if self.Window.Suspend.Duration != 0 {
+		return self.Window.Suspend.Duration
+	}
+	return defaultWindowSuspend
+}
+
+// learnDuty learns the fraction of time each zone calls for heat during
+// heating periods, for the duty cycle fallback.
+func (self *Service) learnDuty(now time.Time) {
+	for _, zone := range self.Zones {
+		if zone.Fault || now.Sub(zone.At) >= maxTempAge || self.Target(zone, now) <= self.Minimum {
+			continue
+		}
+		calling := 0.0
+		if zone.Calling {
+			calling = 1
+		}
+		zone.Duty = zone.Duty*0.99 + calling*0.01
+	}
+}
+
+func (self *Service) faultEvent(zone *Zone, state, message string) {
+	fields := pubsub.Fields{
+		"device":   zone.Thermostat,
+		"source":   "ch",
+		"sensor":   zone.Sensor,
+		"state":    state,
+		"message":  message,
+		"fallback": self.fallbackDescription(zone),
+	}
+	ev := pubsub.NewEvent("heating_fault", fields)
+	self.Publisher.Emit(ev)
+}
+
+func (self *Service) fallbackDescription(zone *Zone) string {
+	if zone.Fallback.Sensor != "" && Clock().Sub(zone.FallbackAt) < maxTempAge {
+		return "sensor " + zone.Fallback.Sensor
+	}
+	switch zone.Fallback.Mode {
+	case "duty":
+		return fmt.Sprintf("duty %.0f%%", zone.FallbackDuty()*100)
+	case "trv":
+		return fmt.Sprintf("trv, duty %.0f%%", zone.FallbackDuty()*100)
+	}
+	return "none"
+}
+
+// checkFault raises or clears the fault on a zone with a stale sensor.
+func (self *Service) checkFault(zone *Zone, now time.Time) {
+	// no reading since starting counts as stale too
+	last := zone.At
+	if last.IsZero() {
+		last = self.started
+	}
+	stale := now.Sub(last) >= maxTempAge
+	if stale && !zone.Fault {
+		zone.Fault = true
+		zone.FaultSince = now
+		message := fmt.Sprintf("%s sensor %s stale since %s", zoneName(zone), zone.Sensor, zone.At.Format(time.Stamp))
+		if zone.At.IsZero() {
+			message = fmt.Sprintf("%s sensor %s no reading since %s", zoneName(zone), zone.Sensor, last.Format(time.Stamp))
+		}
+		log.Printf("Heating fault: %s, fallback: %s", message, self.fallbackDescription(zone))
+		self.faultEvent(zone, "fault", message)
+	} else if !stale && zone.Fault {
+		zone.Fault = false
+		message := fmt.Sprintf("%s sensor %s recovered", zoneName(zone), zone.Sensor)
+		log.Printf("Heating fault cleared: %s", message)
+		self.faultEvent(zone, "ok", message)
+	}
 }
 
 func (self *Service) Event(ev *pubsub.Event) {
+	if zone, ok := self.Contacts[ev.Device()]; ok && ev.Topic != "command" && ev.IsSet("command") {
+		switch ev.Command() {
+		case "on", "open":
+			self.openWindow(zone, "contact", time.Time{})
+		case "off", "closed":
+			self.closeWindow(zone, "contact")
+		}
+		self.Check(false)
+		return
+	}
+
 	switch ev.Topic {
 	case "temp":
 		// temperature device update
@@ -236,7 +416,29 @@ func (self *Service) Event(ev *pubsub.Event) {
 		if zone, ok := self.Sensors[device]; ok {
 			temp, _ := ev.Fields["temp"].(float64)
 			timestamp := ev.Timestamp.Local() // must use Local time, as schedule is in local
-			zone.Update(temp, timestamp)
+			// learn from every reading while heat was delivered to the zone,
+			// including any that fell, so the estimate isn't biased upward
+			heating := zone.Demand && (len(zone.Heaters) > 0 || self.State) && !zone.Window
+			previous := !zone.At.IsZero()
+			rate := zone.Update(temp, timestamp)
+			if heating && previous {
+				zone.Warmup.Learn(rate, self.freshOutside(timestamp))
+			}
+			// on the smoothed rate, so a single noisy reading doesn't trip it
+			if self.Window.Drop > 0 && previous && zone.Rate*60 <= -self.Window.Drop {
+				self.openWindow(zone, fmt.Sprintf("temperature drop %.1f°C/min", -zone.Rate*60), timestamp.Add(self.windowSuspend()))
+			}
+			self.Check(false)
+		}
+		if zone, ok := self.Fallbacks[device]; ok {
+			zone.FallbackTemp, _ = ev.Fields["temp"].(float64)
+			zone.FallbackAt = ev.Timestamp.Local()
+			self.Check(false)
+		}
+		if device != "" && device == services.Config.Weather.Sensors.Temp {
+			temp, _ := ev.Fields["temp"].(float64)
+			self.Outside = &temp
+			self.OutsideAt = ev.Timestamp.Local()
 			self.Check(false)
 		}
 	case "state":
@@ -248,6 +450,7 @@ func (self *Service) Event(ev *pubsub.Event) {
 			if self.Occupied && !self.Holiday.IsZero() {
 				// back from holiday - zero
 				self.Holiday = time.Time{}
+				self.Save()
 			}
 			self.Check(false)
 		}
@@ -262,10 +465,25 @@ func (self *Service) Event(ev *pubsub.Event) {
 			zone.setParty(temp, duration, now)
 			log.Printf("Set %s to %v°C for %s", z, temp, util.FriendlyDuration(duration))
 			self.Check(true)
+			self.Save()
 		}
 	}
 }
 
+func (self *Service) cancelParty(name string) error {
+	if name == "all" {
+		for _, zone := range self.Zones {
+			zone.PartyUntil = time.Time{}
+		}
+		return nil
+	} else if zone, ok := self.Zones[name]; ok {
+		zone.PartyUntil = time.Time{}
+		return nil
+	} else {
+		return errors.New("Zone not found")
+	}
+}
+
 func (self *Service) setParty(name string, temp float64, duration time.Duration, at time.Time) error {
 	if name == "all" {
 		for _, zone := range self.Zones {
@@ -280,38 +498,178 @@ func (self *Service) setParty(name string, temp float64, duration time.Duration,
 	}
 }
 
+// outsideTemp returns the outside temperature, if recently known.
+func (self *Service) outsideTemp(now time.Time) (float64, bool) {
+	if self.Outside == nil || now.Sub(self.OutsideAt) >= maxOutsideAge {
+		return 0, false
+	}
+	return *self.Outside, true
+}
+
+// freshOutside is the outside temperature, or nil if unknown or stale.
+func (self *Service) freshOutside(now time.Time) *float64 {
+	if outside, ok := self.outsideTemp(now); ok {
+		return &outside
+	}
+	return nil
+}
+
+// compensate adjusts a scheduled target for the outside temperature.
+func (self *Service) compensate(target float64, now time.Time) float64 {
+	conf := self.Compensation
+	outside, ok := self.outsideTemp(now)
+	if !ok || conf.Factor == 0 || target <= self.Minimum {
+		return target
+	}
+	adjust := (conf.Reference - outside) * conf.Factor
+	if conf.Max > 0 {
+		adjust = math.Max(-conf.Max, math.Min(conf.Max, adjust))
+	}
+	return math.Max(schedule.MinimumTemperature, math.Min(schedule.MaximumTemperature, target+adjust))
+}
+
+// Summer returns true if it is warm enough outside to not need heating.
+func (self *Service) Summer(now time.Time) bool {
+	outside, ok := self.outsideTemp(now)
+	return ok && self.Compensation.Summer != nil && outside > *self.Compensation.Summer
+}
+
+// Frost returns true if it is cold enough outside to protect an empty house.
+func (self *Service) Frost(now time.Time) bool {
+	outside, ok := self.outsideTemp(now)
+	return ok && self.Compensation.Frost != nil && outside < *self.Compensation.Frost
+}
+
+// Schedule returns the zone schedule for the active profile.
+func (self *Service) Schedule(zone *Zone, now time.Time) *schedule.Schedule {
+	if self.Profile != "" && (self.ProfileUntil.IsZero() || now.Before(self.ProfileUntil)) {
+		if profile, ok := zone.Profiles[self.Profile]; ok {
+			return profile
+		}
+	}
+	return zone.Schedule
+}
+
+// Profiles lists the schedule profiles available across all zones.
+func (self *Service) Profiles() []string {
+	profiles := []string{}
+	seen := map[string]bool{}
+	for _, zone := range self.Zones {
+		for name := range zone.Profiles {
+			if !seen[name] {
+				seen[name] = true
+				profiles = append(profiles, name)
+			}
+		}
+	}
+	sort.Strings(profiles)
+	return profiles
+}
+
+func (self *Service) setProfile(name string, until time.Time) {
+	self.Profile = name
+	self.ProfileUntil = until
+	self.Save()
+}
+
+func (self *Service) checkProfile(now time.Time) {
+	if self.Profile != "" && !self.ProfileUntil.IsZero() && !now.Before(self.ProfileUntil) {
+		log.Printf("Profile %s expired", self.Profile)
+		self.setProfile("", time.Time{})
+	}
+}
+
 func (self *Service) Target(zone *Zone, now time.Time) float64 {
 	if now.Before(zone.PartyUntil) {
 		return zone.PartyTemp
 	} else if self.Occupied || (!self.Holiday.IsZero() && now.After(self.Holiday)) {
-		return zone.Schedule.Target(now, self.Minimum)
+		if preheat := self.Preheat(zone, now); preheat != nil {
+			return self.compensate(preheat.Temp, now)
+		}
+		return self.compensate(self.Schedule(zone, now).Target(now, self.Minimum), now)
+	} else if self.Frost(now) {
+		return math.Max(self.Unoccupied, self.Minimum)
 	} else {
 		return self.Unoccupied
 	}
 }
 
+// Preheat returns the upcoming scheduled target the zone should be heating
+// towards early to reach on time, or nil.
+func (self *Service) Preheat(zone *Zone, now time.Time) *Preheat {
+	if self.MaxPreheat == 0 || zone.At.IsZero() || now.Sub(zone.At) >= maxTempAge {
+		return nil
+	}
+	rate := zone.Warmup.Rate(self.freshOutside(now))
+	if rate <= 0 {
+		// not learnt yet, or not warming
+		return nil
+	}
+	at, temp, ok := self.Schedule(zone, now).Next(now, self.MaxPreheat, self.Minimum)
+	if !ok || zone.Temp >= temp {
+		return nil
+	}
+	needed := time.Duration((temp - zone.Temp) / rate * float64(time.Second))
+	if now.Add(needed).Before(at) {
+		return nil
+	}
+	return &Preheat{At: at, Temp: temp}
+}
+
 func (self *Service) Check(emitEvents bool) {
 	now := Clock()
+	self.checkProfile(now)
+	self.checkWindows(now)
 	state := false
 	trigger := ""
-	for id, zone := range self.Zones {
+	var ids []string
+	for id := range self.Zones {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	reason := "no zones calling for heat"
+	summer := self.Summer(now)
+	if summer {
+		reason = fmt.Sprintf("summer mode (outside %.1f°C)", *self.Outside)
+	}
+	for _, id := range ids {
+		zone := self.Zones[id]
 		target := self.Target(zone, now)
-		if zone.Check(now, target) {
+		self.checkFault(zone, now)
+		calling := zone.Check(now, target)
+		if _, valid := zone.Reading(now); zone.Fault && !valid && !zone.Window {
+			calling = zone.FallbackCall(now, target, self.Minimum)
+		}
+		zone.Demand = calling && (!summer || now.Before(zone.PartyUntil))
+		if zone.Demand && len(zone.Heaters) == 0 {
+			// boiler demand
+			if !state {
+				reason = fmt.Sprintf("%s calling for heat (%.1f°C, target %.1f°C)", id, zone.Temp, target)
+			}
 			state = true
 			trigger = id
 		}
 		if emitEvents {
-			// emit target event
-			fields := pubsub.Fields{
-				"device": zone.Thermostat,
-				"source": "ch",
-				"target": target,
-				"temp":   zone.Temp,
+			self.emitTarget(zone.Thermostat, target, pubsub.Fields{"temp": zone.Temp})
+			for _, trv := range zone.Trvs {
+				self.emitTarget(trv, target, pubsub.Fields{})
 			}
-			ev := pubsub.NewEvent("thermostat", fields)
-			self.Publisher.Emit(ev)
 		}
 	}
+	self.updateOutputs()
+
+	// protect the boiler from short cycling
+	if !self.StateChanged.IsZero() && state != self.State {
+		running := now.Sub(self.StateChanged)
+		if self.State && running < self.MinOn {
+			state = true
+			reason = fmt.Sprintf("minimum on time (%s remaining)", util.ShortDuration(self.MinOn-running))
+		} else if !self.State && running < self.MinOff {
+			state = false
+			reason = fmt.Sprintf("minimum off time (%s remaining)", util.ShortDuration(self.MinOff-running))
+		}
+	}
+	self.Reason = reason
 
 	if !self.State && state {
 		log.Println("Turning on heating for:", trigger)
@@ -323,10 +681,35 @@ func (self *Service) Check(emitEvents bool) {
 		self.State = state
 		self.StateChanged = now
 		self.Command()
+		self.updateOutputs()
+		self.Save()
 	}
 
 }
 
+// reconciled returns true if devicestate re-issues the device's desired
+// state, so heating needn't repeat it.
+func reconciled(device string) bool {
+	_, ok := services.Config.Reconciled(device)
+	return ok
+}
+
+// emitTarget emits a thermostat target event for the device, when changed
+// since last emitted, or every time if devicestate doesn't re-issue it.
+func (self *Service) emitTarget(device string, target float64, fields pubsub.Fields) {
+	if self.targets == nil {
+		self.targets = map[string]float64{}
+	}
+	if previous, ok := self.targets[device]; ok && previous == target && reconciled(device) {
+		return
+	}
+	self.targets[device] = target
+	fields["device"] = device
+	fields["source"] = "ch"
+	fields["target"] = target
+	self.Publisher.Emit(pubsub.NewEvent("thermostat", fields))
+}
+
 func (self *Service) Command() {
 	command := "off"
 	if self.State {
@@ -336,6 +719,63 @@ func (self *Service) Command() {
 	self.Publisher.Emit(ev)
 }
 
+// updateOutputs switches zone heaters and valves to match zone demand. A
+// device shared by zones is on if any of them demand heat.
+func (self *Service) updateOutputs() {
+	outputs := map[string]bool{}
+	for _, zone := range self.Zones {
+		for _, device := range zone.Heaters {
+			outputs[device] = outputs[device] || zone.Demand
+		}
+		for _, device := range zone.Valves {
+			// valves are only useful with the boiler on
+			outputs[device] = outputs[device] || (zone.Demand && self.State)
+		}
+	}
+	var devices []string
+	for device := range outputs {
+		devices = append(devices, device)
+	}
+	sort.Strings(devices)
+
+	if self.Outputs == nil {
+		self.Outputs = map[string]bool{}
+	}
+	for _, device := range devices {
+		on := outputs[device]
+		if previous, ok := self.Outputs[device]; ok && previous == on {
+			continue
+		}
+		log.Printf("Switching %s %v", device, on)
+		self.Outputs[device] = on
+		command := "off"
+		if on {
+			command = "on"
+		}
+		self.Publisher.Emit(pubsub.NewCommand(device, command))
+	}
+}
+
+// repeatOutputs repeats the commands to zone heaters and valves devicestate
+// doesn't re-issue them to.
+func (self *Service) repeatOutputs() {
+	var devices []string
+	for device := range self.Outputs {
+		devices = append(devices, device)
+	}
+	sort.Strings(devices)
+	for _, device := range devices {
+		if reconciled(device) {
+			continue
+		}
+		command := "off"
+		if self.Outputs[device] {
+			command = "on"
+		}
+		self.Publisher.Emit(pubsub.NewCommand(device, command))
+	}
+}
+
 func (self *Service) ShortStatus(now time.Time) string {
 	du := "unknown"
 	if !self.StateChanged.IsZero() {
@@ -372,18 +812,47 @@ func (self *Service) Status(now time.Time) string {
 			// pad names to same length
 			msg += fmt.Sprintf(f+" %.1f°C %+.1f°C/hr at %s [%.1f°C]%s", name, zone.Temp, zone.Rate*3600, zone.At.Format(time.Stamp), target, star)
 		}
+		if preheat := self.Preheat(zone, now); preheat != nil && !now.Before(zone.PartyUntil) {
+			msg += fmt.Sprintf(" preheating for %s (%.1f°C)", preheat.At.Format("15:04"), preheat.Temp)
+		}
+		if zone.Fault {
+			msg += fmt.Sprintf(" FAULT: stale sensor (fallback: %s)", self.fallbackDescription(zone))
+		}
+		if zone.Window {
+			if zone.WindowUntil.IsZero() {
+				msg += " window open"
+			} else {
+				msg += fmt.Sprintf(" window open until %s", zone.WindowUntil.Format("15:04"))
+			}
+		}
 	}
 
 	if !self.Holiday.IsZero() {
 		msg += fmt.Sprintf("\nHoliday until: %s", self.Holiday.Format(time.ANSIC))
 	}
 
+	if self.Profile != "" {
+		msg += "\n" + self.profileStatus()
+	}
+
+	if outside, ok := self.outsideTemp(now); ok {
+		msg += fmt.Sprintf("\nOutside: %.1f°C", outside)
+		if self.Summer(now) {
+			msg += " (summer mode)"
+		} else if self.Frost(now) {
+			msg += " (frost protection)"
+		}
+	}
+
 	return msg
 }
 
 func (self *Service) Json(now time.Time) interface{} {
 	data := map[string]interface{}{}
 	data["heating"] = self.State
+	if self.Reason != "" {
+		data["reason"] = self.Reason
+	}
 	if !self.StateChanged.IsZero() {
 		data["changed"] = self.StateChanged
 	}
@@ -396,15 +865,46 @@ func (self *Service) Json(now time.Time) interface{} {
 				"target": target,
 			}
 		} else {
-			devices[name] = map[string]interface{}{
+			device := map[string]interface{}{
 				"temp":   zone.Temp,
 				"rate":   zone.Rate,
 				"at":     zone.At.Format(time.RFC3339),
 				"target": target,
 			}
+			if preheat := self.Preheat(zone, now); preheat != nil && !now.Before(zone.PartyUntil) {
+				device["preheat"] = map[string]interface{}{
+					"at":     preheat.At.Format(time.RFC3339),
+					"target": preheat.Temp,
+				}
+			}
+			if zone.Fault {
+				device["fault"] = map[string]interface{}{
+					"since":    zone.FaultSince.Format(time.RFC3339),
+					"fallback": self.fallbackDescription(zone),
+				}
+			}
+			if zone.Window {
+				window := map[string]interface{}{"open": true}
+				if !zone.WindowUntil.IsZero() {
+					window["until"] = zone.WindowUntil.Format(time.RFC3339)
+				}
+				device["window"] = window
+			}
+			devices[name] = device
 		}
 	}
 	data["devices"] = devices
+	if len(self.Outputs) > 0 {
+		data["outputs"] = self.Outputs
+	}
+	if self.Profile != "" {
+		data["profile"] = self.profileJson()
+	}
+	if outside, ok := self.outsideTemp(now); ok {
+		data["outside"] = outside
+		data["summer"] = self.Summer(now)
+		data["frost"] = self.Frost(now)
+	}
 	return data
 }
 
@@ -415,28 +915,54 @@ func (self *Service) ID() string {
 func (self *Service) Init() error {
 	self.State = false
 	self.Occupied = false // updated by retained state topic
+	self.started = Clock()
 	if self.Publisher == nil {
 		self.Publisher = services.Publisher
 	}
 	self.ConfigUpdated("config")
+	self.Restore()
+	self.RestoreReports()
 	return nil
 }
 
 // Run the service
 func (self *Service) Run() error {
 	ticker := util.NewScheduler(time.Duration(0), time.Minute)
-	events := services.Subscriber.FilteredChannel("temp", "state", "command")
+	topics := self.Topics()
+	events := services.Subscriber.FilteredChannel(topics...)
 	for {
 		select {
 		case ev := <-events:
 			self.Event(ev)
 		case <-ticker.C:
 			self.Heartbeat()
+			// window contacts may have changed with the config
+			if t := self.Topics(); strings.Join(t, " ") != strings.Join(topics, " ") {
+				services.Subscriber.Close(events)
+				topics = t
+				events = services.Subscriber.FilteredChannel(topics...)
+			}
 		}
 	}
 	return nil
 }
 
+// Topics subscribed to: temperatures, boiler state, commands and the window
+// contacts' topics.
+func (self *Service) Topics() []string {
+	set := map[string]bool{"temp": true, "state": true, "command": true}
+	for device := range self.Contacts {
+		// topic by device type, eg door.hallway on door
+		set[strings.SplitN(device, ".", 2)[0]] = true
+	}
+	var topics []string
+	for topic := range set {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
 func (self *Service) ConfigUpdated(path string) {
 	if path != "config" {
 		return
@@ -444,17 +970,39 @@ func (self *Service) ConfigUpdated(path string) {
 	conf := services.Config.Heating
 	zones := map[string]*Zone{}
 	sensors := map[string]*Zone{}
+	contacts := map[string]*Zone{}
+	fallbacks := map[string]*Zone{}
 	for zone, zoneConf := range conf.Zones {
 		thermostat := "thermostat." + zone
-		schedule, err := NewSchedule(zoneConf.Schedule)
+		sched, err := schedule.New(zoneConf.Schedule)
 		if err != nil {
 			log.Printf("Failed to load configuration: %s\n", err)
 			return
 		}
+		hysteresis := config.HysteresisConf{Off: conf.Slop}
+		if zoneConf.Hysteresis != nil {
+			hysteresis = *zoneConf.Hysteresis
+		}
+		profiles := map[string]*schedule.Schedule{}
+		for name, profileConf := range zoneConf.Profiles {
+			profile, err := schedule.New(profileConf)
+			if err != nil {
+				log.Printf("Failed to load configuration: %s profile %s: %s\n", zone, name, err)
+				return
+			}
+			profiles[name] = profile
+		}
 		z := &Zone{
-			Schedule:   schedule,
+			Schedule:   sched,
+			Profiles:   profiles,
 			Sensor:     zoneConf.Sensor,
 			Thermostat: thermostat,
+			Hysteresis: hysteresis,
+			Contact:    zoneConf.Window,
+			Fallback:   zoneConf.Fallback,
+			Heaters:    zoneConf.Heaters,
+			Valves:     zoneConf.Valves,
+			Trvs:       zoneConf.Trvs,
 		}
 		if old, ok := self.Zones[zone]; ok {
 			// preserve temp/party when live reloading
@@ -463,29 +1011,61 @@ func (self *Service) ConfigUpdated(path string) {
 			z.At = old.At
 			z.PartyTemp = old.PartyTemp
 			z.PartyUntil = old.PartyUntil
+			z.Warmup = old.Warmup
+			z.Calling = old.Calling
+			z.Window = old.Window
+			z.WindowUntil = old.WindowUntil
+			z.FallbackTemp = old.FallbackTemp
+			z.FallbackAt = old.FallbackAt
+			z.Duty = old.Duty
+			z.Fault = old.Fault
+			z.FaultSince = old.FaultSince
 		}
 		zones[zone] = z
 		sensors[zoneConf.Sensor] = z
+		if zoneConf.Window != "" {
+			contacts[zoneConf.Window] = z
+		}
+		if zoneConf.Fallback.Sensor != "" {
+			fallbacks[zoneConf.Fallback.Sensor] = z
+		}
 	}
 	self.HeatingDevice = conf.Device
 	self.Slop = conf.Slop
 	self.Zones = zones
 	self.Sensors = sensors
+	self.Contacts = contacts
+	self.Fallbacks = fallbacks
+	self.Window = conf.Window
+	self.Compensation = conf.Weather
 	self.Minimum = conf.Minimum
 	self.Unoccupied = conf.Unoccupied
+	self.MaxPreheat = conf.Preheat.Duration
+	self.MinOn = conf.Min_On.Duration
+	self.MinOff = conf.Min_Off.Duration
 	log.Printf("%d zones configured", len(self.Zones))
 }
 
 func (self *Service) QueryHandlers() services.QueryHandlers {
 	return services.QueryHandlers{
-		"status":  self.queryStatus,
-		"ch":      services.TextHandler(self.queryParty),
-		"party":   services.TextHandler(self.queryParty),
-		"holiday": services.TextHandler(self.queryHoliday),
+		"status":   self.queryStatus,
+		"ch":       services.TextHandler(self.queryParty),
+		"party":    services.TextHandler(self.queryParty),
+		"holiday":  services.TextHandler(self.queryHoliday),
+		"profile":  self.queryProfile,
+		"report":   self.queryReport,
+		"schedule": self.querySchedule,
 		"help": services.StaticHandler("" +
 			"status: get status\n" +
 			"party [zone] temp [duration (1h)]: sets heating to temp for duration\n" +
-			"holiday duration: sets holiday mode for this duration\n"),
+			"party cancel [zone]: cancel party mode\n" +
+			"holiday duration: sets holiday mode for this duration\n" +
+			"holiday cancel: cancel holiday mode\n" +
+			"profile [name|default] [until]: get or switch schedule profile\n" +
+			"report [today|yesterday|YYYY-MM-DD]: daily heating runtime report\n" +
+			"schedule get zone: get zone schedule\n" +
+			"schedule set zone days hh:mm-hh:mm temp: set a schedule slot\n" +
+			"schedule remove zone days [hh:mm-hh:mm]: remove a schedule slot or days\n"),
 	}
 }
 
@@ -514,11 +1094,11 @@ func parseParty(value string) (err error, zone string, temp float64, duration ti
 		err = errors.New("Invalid temperature")
 		return
 	}
-	if temp < MinimumTemperature {
+	if temp < schedule.MinimumTemperature {
 		err = errors.New("Below minimum temperature")
 		return
 	}
-	if temp > MaximumTemperature {
+	if temp > schedule.MaximumTemperature {
 		err = errors.New("Above maximum temperature")
 		return
 	}
@@ -533,12 +1113,27 @@ func parseParty(value string) (err error, zone string, temp float64, duration ti
 }
 
 func (self *Service) queryParty(q services.Question) string {
+	if vs := strings.Fields(q.Args); len(vs) > 0 && vs[0] == "cancel" {
+		zone := "all"
+		if len(vs) > 1 {
+			ps := strings.SplitN(vs[1], ".", 2)
+			zone = ps[len(ps)-1] // drop "thermostat."
+		}
+		if err := self.cancelParty(zone); err != nil {
+			return fmt.Sprint(err)
+		}
+		self.Check(true)
+		self.Save()
+		return fmt.Sprintf("Cancelled party for %s", zone)
+	}
+
 	err, zone, temp, duration := parseParty(q.Args)
 	if err == nil {
 		now := Clock()
 		err = self.setParty(zone, temp, duration, now)
 		if err == nil {
 			self.Check(true)
+			self.Save()
 			return fmt.Sprintf("Set %s to %v°C for %s", zone, temp, util.FriendlyDuration(duration))
 		}
 	}
@@ -549,11 +1144,93 @@ func (self *Service) queryHoliday(q services.Question) string {
 	if len(q.Args) == 0 {
 		return "Duration required"
 	}
+	if q.Args == "cancel" {
+		if self.Holiday.IsZero() {
+			return "Not on holiday"
+		}
+		self.Holiday = time.Time{}
+		self.Check(true)
+		self.Save()
+		return "Holiday cancelled"
+	}
 	until, err := util.ParseRelative(Clock(), q.Args)
 	if err != nil {
 		return fmt.Sprint(err)
 	}
 
 	self.Holiday = until
+	self.Save()
 	return fmt.Sprintf("Holiday until %s", until.Format(time.ANSIC))
 }
+
+func (self *Service) profileStatus() string {
+	if self.Profile == "" {
+		return "Profile: default"
+	}
+	msg := fmt.Sprintf("Profile: %s", self.Profile)
+	if !self.ProfileUntil.IsZero() {
+		msg += fmt.Sprintf(" until %s", self.ProfileUntil.Format(time.ANSIC))
+	}
+	return msg
+}
+
+func (self *Service) profileJson() map[string]interface{} {
+	data := map[string]interface{}{
+		"name":      "default",
+		"available": self.Profiles(),
+	}
+	if self.Profile != "" {
+		data["name"] = self.Profile
+	}
+	if !self.ProfileUntil.IsZero() {
+		data["until"] = self.ProfileUntil.Format(time.RFC3339)
+	}
+	return data
+}
+
+func parseUntil(now time.Time, s string) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", s, now.Location()); err == nil {
+		return t, nil
+	}
+	return util.ParseRelative(now, s)
+}
+
+func (self *Service) queryProfile(q services.Question) services.Answer {
+	vs := strings.Fields(q.Args)
+	if len(vs) == 0 {
+		text := self.profileStatus()
+		if profiles := self.Profiles(); len(profiles) > 0 {
+			text += fmt.Sprintf("\nAvailable: %s", strings.Join(profiles, ", "))
+		}
+		return services.Answer{Text: text, Json: self.profileJson()}
+	}
+
+	name := vs[0]
+	if name == "default" {
+		self.setProfile("", time.Time{})
+		self.Check(true)
+		return services.Answer{Text: "Switched to default profile", Json: self.profileJson()}
+	}
+	found := false
+	for _, profile := range self.Profiles() {
+		found = found || profile == name
+	}
+	if !found {
+		return services.Answer{Text: fmt.Sprintf("Profile %s not found", name)}
+	}
+	var until time.Time
+	if len(vs) > 1 {
+		var err error
+		until, err = parseUntil(Clock(), strings.Join(vs[1:], " "))
+		if err != nil {
+			return services.Answer{Text: fmt.Sprint(err)}
+		}
+	}
+	self.setProfile(name, until)
+	self.Check(true)
+	text := fmt.Sprintf("Switched to %s", name)
+	if !until.IsZero() {
+		text += fmt.Sprintf(" until %s", until.Format(time.ANSIC))
+	}
+	return services.Answer{Text: text, Json: self.profileJson()}
+}
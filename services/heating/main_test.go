@@ -3,6 +3,10 @@ package heating
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
 	"testing"
 	"time"
 
@@ -49,6 +53,10 @@ zones:
       Monday-Friday:
         - 07:30-08:10: 18.0
         - 17:30-22:20: 18.0
+    profiles:
+      wfh:
+        All:
+          - 08:00-22:00: 19.0
 minimum: 10.0
 unoccupied: 5.0
 `
@@ -59,6 +67,8 @@ var (
 )
 
 func SetupTests() {
+	stateFile = ""
+	reportFile = ""
 	services.Config = config.ExampleConfig
 	yaml.Unmarshal([]byte(configYaml), &testConfig)
 	services.Config.Heating = testConfig
@@ -96,6 +106,8 @@ func TestOnOff(t *testing.T) {
 
 	service.Heartbeat()
 	assert.True(t, service.State)
+	// thermostat target, command (repeated, devicestate not covering the
+	// boiler) and heating status
 	assert.Equal(t, 3, len(em.Events))
 	em.Events = em.Events[:0]
 
@@ -253,7 +265,7 @@ func ExampleQueryStatusJson() {
 	s, _ := json.Marshal(data)
 	fmt.Println(string(s))
 	// Output:
-	// {"changed":"2014-01-04T16:00:00Z","devices":{"hallway":{"at":"2014-01-04T16:00:00Z","rate":0,"target":18,"temp":10.1}},"heating":true}
+	// {"changed":"2014-01-04T16:00:00Z","devices":{"hallway":{"at":"2014-01-04T16:00:00Z","rate":0,"target":18,"temp":10.1}},"heating":true,"reason":"hallway calling for heat (10.1°C, target 18.0°C)"}
 }
 
 var testQueries = []struct {
@@ -314,215 +326,561 @@ func TestQueries(t *testing.T) {
 	}
 }
 
-var testScheduleTable = []struct {
-	t    time.Time
-	temp float64
-}{
-	{
-		time.Date(2014, 1, 6, 8, 0, 0, 0, time.UTC), // Monday 8am
-		18.0,
-	},
-	{
-		time.Date(2014, 1, 6, 8, 10, 0, 0, time.UTC), // Monday 8:10am
-		14.0,
-	},
-	{
-		time.Date(2014, 1, 6, 17, 20, 0, 0, time.UTC), // Monday 5:29pm
-		14.0,
-	},
-	{
-		time.Date(2014, 1, 6, 17, 30, 0, 0, time.UTC), // Monday 5:30pm
-		18.0,
-	},
-	{
-		time.Date(2014, 1, 6, 22, 19, 0, 0, time.UTC), // Monday 10:19pm
-		18.0,
-	},
-	{
-		time.Date(2014, 1, 10, 8, 0, 0, 0, time.UTC), // Friday 8am
-		18.0,
-	},
-	{
-		time.Date(2014, 1, 10, 8, 10, 0, 0, time.UTC), // Friday 8:10am
-		14.0,
-	},
-	{
-		time.Date(2014, 1, 4, 8, 0, 0, 0, time.UTC), // Saturday 8am
-		0.0,
-	},
-	{
-		time.Date(2014, 1, 4, 16, 0, 0, 0, time.UTC), // Saturday 4pm
-		18.0,
-	},
+func TestPreheat(t *testing.T) {
+	SetupTests()
+	service.MaxPreheat = time.Hour
+	zone := service.Zones["hallway"]
+	zone.Warmup.All = 6.0 / 3600 // 6°C/hr
+	// quick in the cold, but the outside reading is stale by 07:05
+	zone.Warmup.Bands = map[int]float64{0: 60.0 / 3600}
+	fire(pubsub.NewEvent("temp", pubsub.Fields{"device": "temp.garden", "temp": 2.0, "timestamp": "2014-01-06 05:00:00.000"}))
+
+	// Monday, 40 minutes before the 07:30 schedule
+	fire(pubsub.NewEvent("temp", pubsub.Fields{"device": "temp.hallway", "temp": 15.0, "timestamp": "2014-01-06 06:50:00.000"}))
+	assert.False(t, service.State)
+	assert.Nil(t, service.Preheat(zone, Clock()))
+
+	// 30 minutes needed to warm 3°C
+	fire(pubsub.NewEvent("temp", pubsub.Fields{"device": "temp.hallway", "temp": 15.0, "timestamp": "2014-01-06 07:05:00.000"}))
+	assert.True(t, service.State)
+	assert.Equal(t, 18.0, service.Target(zone, Clock()))
+	assert.Contains(t, service.Status(Clock()), "preheating for 07:30 (18.0°C)")
+
+	// beyond the maximum lead
+	service.MaxPreheat = 20 * time.Minute
+	assert.Nil(t, service.Preheat(zone, Clock()))
 }
 
-var scheduleConf = `
-Weekends:
-- 10:20-22:50: 18.0
-Monday,Tue-Thu,Fri:
-- 07:30-08:10: 18.0
-- 08:10-17:30: 14.0
-Weekdays:
-- 17:30-22:20: 18.0
-`
+func TestPreheatLearn(t *testing.T) {
+	SetupTests()
+	fire(pubsub.NewEvent("temp", pubsub.Fields{"device": "temp.garden", "temp": 2.0, "timestamp": "2014-01-04 16:00:00.000"}))
+	fire(evColder)
+	assert.True(t, service.State)
+	// heating on: rises 1°C in 10 minutes
+	fire(pubsub.NewEvent("temp", pubsub.Fields{"device": "temp.hallway", "temp": 5.0, "timestamp": "2014-01-04 16:10:00.000"}))
+	zone := service.Zones["hallway"]
+	assert.InDelta(t, 1.0/600, zone.Warmup.All, 1e-9)
+	assert.InDelta(t, 1.0/600, zone.Warmup.Bands[0], 1e-9)
+
+	cold := -6.0
+	assert.Equal(t, zone.Warmup.All, zone.Warmup.Rate(&cold))
+
+	// readings that fall while heating are learnt too
+	fire(pubsub.NewEvent("temp", pubsub.Fields{"device": "temp.hallway", "temp": 4.9, "timestamp": "2014-01-04 16:20:00.000"}))
+	assert.InDelta(t, 0.9/600-0.01/600, zone.Warmup.All, 1e-9)
+}
 
-func TestSchedule(t *testing.T) {
-	var schedule config.ScheduleConf
-	yaml.Unmarshal([]byte(scheduleConf), &schedule)
-	s, err := NewSchedule(schedule)
-	require.Nil(t, err)
-	for _, tt := range testScheduleTable {
-		t.Run(tt.t.Format(time.RFC3339), func(t *testing.T) {
-			assert.Equal(t, tt.temp, s.Target(tt.t, 0))
-		})
+func TestPreheatLearnHeaters(t *testing.T) {
+	SetupTests()
+	zone := service.Zones["hallway"]
+	zone.Heaters = []string{"heater.hallway"}
+	fire(evColder)
+	// boiler off, the zone heater on
+	assert.False(t, service.State)
+	assert.True(t, zone.Demand)
+	fire(pubsub.NewEvent("temp", pubsub.Fields{"device": "temp.hallway", "temp": 5.0, "timestamp": "2014-01-04 16:10:00.000"}))
+	assert.InDelta(t, 1.0/600, zone.Warmup.All, 1e-9)
+}
+
+func TestHysteresis(t *testing.T) {
+	SetupTests()
+	zone := service.Zones["hallway"]
+	zone.Hysteresis = config.HysteresisConf{On: 0.2, Off: 0.3}
+
+	temp := func(temp float64, ts string) {
+		fire(pubsub.NewEvent("temp", pubsub.Fields{"device": "temp.hallway", "temp": temp, "timestamp": ts}))
 	}
+	// within on hysteresis, stays off
+	temp(17.9, "2014-01-04 16:00:00.000")
+	assert.False(t, service.State)
+	temp(17.7, "2014-01-04 16:01:00.000")
+	assert.True(t, service.State)
+	// above target, within off hysteresis, stays on
+	temp(18.2, "2014-01-04 16:02:00.000")
+	assert.True(t, service.State)
+	temp(18.3, "2014-01-04 16:03:00.000")
+	assert.False(t, service.State)
+	assert.Equal(t, "no zones calling for heat", service.Reason)
 }
 
-func TestScheduleBST(t *testing.T) {
-	var schedule config.ScheduleConf
-	yaml.Unmarshal([]byte(scheduleConf), &schedule)
-	s, err := NewSchedule(schedule)
-	require.Nil(t, err)
-	bst := time.FixedZone("BST", 3600)
-	for _, tt := range testScheduleTable {
-		bt := time.Date(tt.t.Year(), tt.t.Month(), tt.t.Day(), tt.t.Hour(), tt.t.Minute(), tt.t.Second(), tt.t.Nanosecond(), bst)
-		assert.Equal(t, tt.temp, s.Target(bt, 0))
+func TestMinimumCycle(t *testing.T) {
+	SetupTests()
+	service.MinOn = 5 * time.Minute
+	service.MinOff = 10 * time.Minute
+
+	temp := func(temp float64, ts string) {
+		fire(pubsub.NewEvent("temp", pubsub.Fields{"device": "temp.hallway", "temp": temp, "timestamp": ts}))
 	}
+	temp(17.0, "2014-01-04 16:00:00.000")
+	assert.True(t, service.State)
+	// held on
+	temp(19.0, "2014-01-04 16:02:00.000")
+	assert.True(t, service.State)
+	assert.Equal(t, "minimum on time (3m remaining)", service.Reason)
+	temp(19.0, "2014-01-04 16:05:00.000")
+	assert.False(t, service.State)
+	// held off
+	temp(17.0, "2014-01-04 16:06:00.000")
+	assert.False(t, service.State)
+	assert.Equal(t, "minimum off time (9m remaining)", service.Reason)
+	temp(17.0, "2014-01-04 16:15:00.000")
+	assert.True(t, service.State)
+	assert.Equal(t, "hallway calling for heat (17.0°C, target 18.0°C)", service.Reason)
 }
 
-var testScheduleWithoutWeekendsTable = []struct {
-	t    time.Time
-	temp float64
-}{
-	{
-		time.Date(2014, 1, 3, 7, 59, 0, 0, time.UTC), // Friday 7:59am
-		0.0,
-	},
-	{
-		time.Date(2014, 1, 3, 7, 59, 0, 0, time.UTC), // Friday 7:59am
-		0.0,
-	},
-	{
-		time.Date(2014, 1, 3, 8, 0, 0, 0, time.UTC), // Friday 8am
-		17.0,
-	},
-	{
-		time.Date(2014, 1, 3, 17, 59, 0, 0, time.UTC), // Friday 5:59pm
-		17.0,
-	},
-	{
-		time.Date(2014, 1, 3, 18, 0, 0, 0, time.UTC), // Friday 6pm
-		0.0,
-	},
-	{
-		time.Date(2014, 1, 4, 8, 0, 0, 0, time.UTC), // Saturday 8am
-		0.0,
-	},
-	{
-		time.Date(2014, 1, 5, 8, 0, 0, 0, time.UTC), // Sunday 8am
-		0.0,
-	},
-	{
-		time.Date(2014, 1, 6, 8, 0, 0, 0, time.UTC), // Monday 8am
-		17.0,
-	},
+func TestPartyCancel(t *testing.T) {
+	SetupTests()
+	fire(evOff)
+	assert.Equal(t, "Set hallway to 20°C for 30 minutes", service.queryParty(services.Question{Verb: "party", Args: "hallway 20"}))
+	assert.True(t, service.State)
+	assert.Equal(t, "Cancelled party for hallway", service.queryParty(services.Question{Verb: "party", Args: "cancel hallway"}))
+	assert.Equal(t, 10.0, service.Target(service.Zones["hallway"], Clock()))
+	assert.Equal(t, "Zone not found", service.queryParty(services.Question{Verb: "party", Args: "cancel attic"}))
 }
 
-func TestScheduleWithoutWeekends(t *testing.T) {
-	conf := `
-Weekdays:
-- 8:00-18:00: 17
-`
-	var schedule config.ScheduleConf
-	yaml.Unmarshal([]byte(conf), &schedule)
-	s, err := NewSchedule(schedule)
-	require.Nil(t, err)
-	for _, tt := range testScheduleWithoutWeekendsTable {
-		t.Run(tt.t.Format(time.RFC3339), func(t *testing.T) {
-			assert.Equal(t, tt.temp, s.Target(tt.t, 0))
-		})
+func TestHolidayCancel(t *testing.T) {
+	SetupTests()
+	assert.Equal(t, "Not on holiday", service.queryHoliday(services.Question{Verb: "holiday", Args: "cancel"}))
+	service.queryHoliday(services.Question{Verb: "holiday", Args: "1d"})
+	assert.False(t, service.Holiday.IsZero())
+	assert.Equal(t, "Holiday cancelled", service.queryHoliday(services.Question{Verb: "holiday", Args: "cancel"}))
+	assert.True(t, service.Holiday.IsZero())
+}
+
+func TestPersistence(t *testing.T) {
+	SetupTests()
+	dir, err := ioutil.TempDir("", "heating")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	stateFile = path.Join(dir, "heating.state")
+
+	fire(evOff)
+	service.queryParty(services.Question{Verb: "party", Args: "hallway 20 1h"})
+	service.queryHoliday(services.Question{Verb: "holiday", Args: "1d"})
+	assert.True(t, service.State)
+
+	// restart
+	restarted := &Service{Publisher: em}
+	restarted.Init()
+	assert.True(t, restarted.State)
+	assert.Equal(t, service.StateChanged.Unix(), restarted.StateChanged.Unix())
+	assert.Equal(t, service.Holiday.Unix(), restarted.Holiday.Unix())
+	zone := restarted.Zones["hallway"]
+	assert.Equal(t, 20.0, zone.PartyTemp)
+	assert.Equal(t, evOff.Timestamp.Add(time.Hour).Unix(), zone.PartyUntil.Unix())
+}
+
+func TestWindowDrop(t *testing.T) {
+	SetupTests()
+	service.Window = config.WindowConf{Drop: 0.2, Suspend: config.Duration{Duration: 20 * time.Minute}}
+
+	temp := func(temp float64, ts string) {
+		fire(pubsub.NewEvent("temp", pubsub.Fields{"device": "temp.hallway", "temp": temp, "timestamp": ts}))
 	}
+	temp(17.0, "2014-01-04 16:00:00.000")
+	assert.True(t, service.State)
+	em.Events = nil
+	// 1°C drop in 2 minutes
+	temp(16.0, "2014-01-04 16:02:00.000")
+	assert.False(t, service.State)
+	zone := service.Zones["hallway"]
+	assert.True(t, zone.Window)
+	assert.Equal(t, "window", em.Events[0].Topic)
+	assert.Equal(t, "open", em.Events[0].Command())
+	assert.Contains(t, service.Status(Clock()), "window open until 16:22")
+
+	temp(16.0, "2014-01-04 16:10:00.000")
+	assert.False(t, service.State)
+	// resumes after suspension
+	temp(16.0, "2014-01-04 16:22:00.000")
+	assert.False(t, zone.Window)
+	assert.True(t, service.State)
 }
 
-func TestScheduleEmpty(t *testing.T) {
-	conf := `{}`
-	var schedule config.ScheduleConf
-	yaml.Unmarshal([]byte(conf), &schedule)
-	s, err := NewSchedule(schedule)
-	require.Nil(t, err)
-	assert.Equal(t, 1.0, s.Target(time.Date(2014, 1, 3, 7, 59, 0, 0, time.UTC), 1))
-}
-
-func TestScheduleAll(t *testing.T) {
-	conf := `
-All:
-- 0:00-24:00: 10`
-	var schedule config.ScheduleConf
-	yaml.Unmarshal([]byte(conf), &schedule)
-	s, err := NewSchedule(schedule)
-	require.Nil(t, err)
-	assert.Equal(t, 10.0, s.Target(time.Date(2014, 1, 3, 7, 59, 0, 0, time.UTC), 0))
-}
-
-func TestScheduleOverlap(t *testing.T) {
-	conf := `
-All:
-- 08:00-09:00: 15
-- 00:00-24:00: 10
-Fri:
-- 08:30-08:35: 20
-`
-	var schedule config.ScheduleConf
-	yaml.Unmarshal([]byte(conf), &schedule)
-	s, err := NewSchedule(schedule)
-	require.Nil(t, err)
-	assert.Equal(t, 10.0, s.Target(time.Date(2014, 1, 3, 7, 59, 0, 0, time.UTC), 0))
-	assert.Equal(t, 15.0, s.Target(time.Date(2014, 1, 3, 8, 0, 0, 0, time.UTC), 0))
-	assert.Equal(t, 15.0, s.Target(time.Date(2014, 1, 2, 8, 30, 0, 0, time.UTC), 0)) // Thursdau
-	assert.Equal(t, 20.0, s.Target(time.Date(2014, 1, 3, 8, 30, 0, 0, time.UTC), 0)) // Friday
-	assert.Equal(t, 15.0, s.Target(time.Date(2014, 1, 3, 8, 35, 0, 0, time.UTC), 0))
-	assert.Equal(t, 10.0, s.Target(time.Date(2014, 1, 3, 9, 0, 0, 0, time.UTC), 0))
-}
-
-func TestScheduleSpanningMidnight(t *testing.T) {
-	conf := `
-Fri:
-- 00:00-24:00: 10
-- 23:00-01:00: 18
-Sat:
-- 00:00-24:00: 10
-`
-	var schedule config.ScheduleConf
-	yaml.Unmarshal([]byte(conf), &schedule)
-	s, err := NewSchedule(schedule)
-	require.Nil(t, err)
-	assert.Equal(t, 10.0, s.Target(time.Date(2014, 1, 3, 22, 59, 0, 0, time.UTC), 0))
-	assert.Equal(t, 18.0, s.Target(time.Date(2014, 1, 3, 23, 0, 0, 0, time.UTC), 0))
-	assert.Equal(t, 18.0, s.Target(time.Date(2014, 1, 4, 0, 0, 0, 0, time.UTC), 0))
-	assert.Equal(t, 18.0, s.Target(time.Date(2014, 1, 4, 0, 59, 0, 0, time.UTC), 0))
-	assert.Equal(t, 10.0, s.Target(time.Date(2014, 1, 4, 1, 0, 0, 0, time.UTC), 0))
-}
-
-var testScheduleParseErrorTable = []string{
-	"Monkeys: ['8:00-9:00': 17]",
-	"Monkeys: ['8:00-9': 17]",
-	"Monkeys: ['8:00-': 17]",
-	"Monkeys: ['8:00': 17]",
-	"Monday: ['8:': 17]",
-	"Monday: [':00': 17]",
-	"Monday: [':': 17]",
-	"Monday: ['0:00-1:00': -1]",
-	"Monday: ['0:00-1:00': 60]",
-}
-
-func TestScheduleParseError(t *testing.T) {
-	for _, conf := range testScheduleParseErrorTable {
-		t.Run(conf, func(t *testing.T) {
-			var schedule config.ScheduleConf
-			yaml.Unmarshal([]byte(conf), &schedule)
-			s, err := NewSchedule(schedule)
-			assert.Error(t, err)
-			assert.Nil(t, s)
-		})
+func TestWindowDropSmoothed(t *testing.T) {
+	SetupTests()
+	service.Window = config.WindowConf{Drop: 0.2, Suspend: config.Duration{Duration: 20 * time.Minute}}
+	fire(pubsub.NewEvent("temp", pubsub.Fields{"device": "temp.hallway", "temp": 17.0, "timestamp": "2014-01-04 16:00:00.000"}))
+	// a single reading 0.22°C/min down, smoothed to under the threshold
+	fire(pubsub.NewEvent("temp", pubsub.Fields{"device": "temp.hallway", "temp": 16.78, "timestamp": "2014-01-04 16:01:00.000"}))
+	assert.False(t, service.Zones["hallway"].Window)
+	assert.True(t, service.State)
+}
+
+func TestTopics(t *testing.T) {
+	SetupTests()
+	assert.Equal(t, []string{"command", "state", "temp"}, service.Topics())
+	service.Contacts = map[string]*Zone{"door.hallway": service.Zones["hallway"]}
+	assert.Equal(t, []string{"command", "door", "state", "temp"}, service.Topics())
+}
+
+func TestWindowContact(t *testing.T) {
+	SetupTests()
+	zone := service.Zones["hallway"]
+	zone.Contact = "door.hallway"
+	service.Contacts = map[string]*Zone{"door.hallway": zone}
+
+	fire(evCold)
+	assert.True(t, service.State)
+	fire(pubsub.NewEvent("door", pubsub.Fields{"device": "door.hallway", "command": "on", "timestamp": "2014-01-04 16:01:00.000"}))
+	assert.False(t, service.State)
+	assert.True(t, zone.Window)
+	assert.True(t, zone.WindowUntil.IsZero())
+	fire(pubsub.NewEvent("door", pubsub.Fields{"device": "door.hallway", "command": "off", "timestamp": "2014-01-04 16:03:00.000"}))
+	assert.True(t, service.State)
+	assert.False(t, zone.Window)
+}
+
+func outsideTemp(temp float64, ts string) {
+	fire(pubsub.NewEvent("temp", pubsub.Fields{"device": "temp.garden", "temp": temp, "timestamp": ts}))
+}
+
+func TestWeatherCompensation(t *testing.T) {
+	SetupTests()
+	service.Compensation = config.CompensationConf{Reference: 10, Factor: 0.1, Max: 1}
+	zone := service.Zones["hallway"]
+	fire(evCold)
+
+	outsideTemp(0.0, "2014-01-04 16:00:00.000")
+	assert.Equal(t, 19.0, service.Target(zone, Clock()))
+	outsideTemp(15.0, "2014-01-04 16:00:00.000")
+	assert.Equal(t, 17.5, service.Target(zone, Clock()))
+	outsideTemp(-20.0, "2014-01-04 16:00:00.000")
+	assert.Equal(t, 19.0, service.Target(zone, Clock()))
+
+	// minimum setback not compensated
+	setClock(time.Date(2014, 1, 4, 23, 0, 0, 0, time.UTC))
+	assert.Equal(t, 10.0, service.Target(zone, Clock()))
+
+	// stale outside temperature ignored
+	setClock(time.Date(2014, 1, 4, 18, 0, 0, 0, time.UTC))
+	assert.Equal(t, 18.0, service.Target(zone, Clock()))
+}
+
+func TestSummerMode(t *testing.T) {
+	SetupTests()
+	summer := 16.0
+	service.Compensation = config.CompensationConf{Summer: &summer}
+	outsideTemp(18.0, "2014-01-04 16:00:00.000")
+	fire(evCold)
+	assert.False(t, service.State)
+	assert.Equal(t, "summer mode (outside 18.0°C)", service.Reason)
+
+	// party overrides
+	service.queryParty(services.Question{Verb: "party", Args: "hallway 20"})
+	assert.True(t, service.State)
+}
+
+func TestFrostProtection(t *testing.T) {
+	SetupTests()
+	frost := 0.0
+	service.Compensation = config.CompensationConf{Frost: &frost}
+	fire(evEmpty)
+	fire(pubsub.NewEvent("temp", pubsub.Fields{"device": "temp.hallway", "temp": 7.0, "timestamp": "2014-01-04 16:00:00.000"}))
+	assert.False(t, service.State)
+	outsideTemp(-2.0, "2014-01-04 16:00:00.000")
+	assert.True(t, service.State)
+	assert.Equal(t, 10.0, service.Target(service.Zones["hallway"], Clock()))
+	assert.Contains(t, service.Status(Clock()), "Outside: -2.0°C (frost protection)")
+}
+
+func TestFaultFallbackSensor(t *testing.T) {
+	SetupTests()
+	zone := service.Zones["hallway"]
+	zone.Fallback = config.FallbackConf{Sensor: "temp.hall2"}
+	service.Fallbacks = map[string]*Zone{"temp.hall2": zone}
+
+	fire(evCold)
+	assert.True(t, service.State)
+	fire(pubsub.NewEvent("temp", pubsub.Fields{"device": "temp.hall2", "temp": 19.0, "timestamp": "2014-01-04 16:04:00.000"}))
+	em.Events = nil
+	setClock(time.Date(2014, 1, 4, 16, 7, 0, 0, time.UTC))
+	service.Check(false)
+	// hallway sensor stale - fallback sensor is warm
+	assert.True(t, zone.Fault)
+	assert.False(t, service.State)
+	fault := em.Events[0]
+	assert.Equal(t, "heating_fault", fault.Topic)
+	assert.Equal(t, "fault", fault.StringField("state"))
+	assert.Equal(t, "sensor temp.hall2", fault.StringField("fallback"))
+
+	// recovers
+	em.Events = nil
+	fire(pubsub.NewEvent("temp", pubsub.Fields{"device": "temp.hallway", "temp": 19.0, "timestamp": "2014-01-04 16:08:00.000"}))
+	assert.False(t, zone.Fault)
+	assert.Equal(t, "ok", em.Events[0].StringField("state"))
+}
+
+func TestFaultDutyCycle(t *testing.T) {
+	SetupTests()
+	zone := service.Zones["hallway"]
+	zone.Fallback = config.FallbackConf{Mode: "duty", Duty: 0.5}
+
+	fire(evCold)
+	at := time.Date(2014, 1, 4, 16, 10, 0, 0, time.UTC)
+	setClock(at)
+	service.Check(false)
+	assert.True(t, zone.Fault)
+	assert.True(t, service.State)
+	assert.Contains(t, service.Status(at), "FAULT: stale sensor (fallback: duty 50%)")
+	setClock(at.Add(16 * time.Minute))
+	service.Check(false)
+	assert.False(t, service.State)
+	setClock(at.Add(31 * time.Minute))
+	service.Check(false)
+	assert.True(t, service.State)
+}
+
+func TestFaultTrv(t *testing.T) {
+	SetupTests()
+	zone := service.Zones["hallway"]
+	zone.Fallback = config.FallbackConf{Mode: "trv"}
+
+	fire(evCold)
+	at := time.Date(2014, 1, 4, 16, 10, 0, 0, time.UTC)
+	setClock(at)
+	service.Check(false)
+	assert.True(t, service.State)
+	assert.Contains(t, service.Status(at), "FAULT: stale sensor (fallback: trv, duty 50%)")
+	// bounded by the duty cycle
+	setClock(at.Add(16 * time.Minute))
+	service.Check(false)
+	assert.False(t, service.State)
+	// outside of heating periods
+	setClock(time.Date(2014, 1, 4, 23, 0, 0, 0, time.UTC))
+	service.Check(false)
+	assert.False(t, service.State)
+}
+
+func TestFaultNoReading(t *testing.T) {
+	SetupTests()
+	zone := service.Zones["hallway"]
+	zone.At = time.Time{}
+	at := time.Date(2014, 1, 4, 16, 0, 0, 0, time.UTC)
+	service.started = at
+	em.Events = nil
+	setClock(at.Add(5 * time.Minute))
+	service.Check(false)
+	assert.False(t, zone.Fault)
+	setClock(at.Add(6 * time.Minute))
+	service.Check(false)
+	assert.True(t, zone.Fault)
+	assert.Contains(t, em.Events[0].StringField("message"), "no reading since")
+}
+
+func TestLearnDuty(t *testing.T) {
+	SetupTests()
+	fire(evCold)
+	service.Heartbeat()
+	assert.InDelta(t, 0.01, service.Zones["hallway"].Duty, 1e-9)
+}
+
+func TestProfile(t *testing.T) {
+	SetupTests()
+	zone := service.Zones["hallway"]
+	fire(evOff)
+	assert.Equal(t, 10.0, service.Target(zone, Clock()))
+
+	answer := service.queryProfile(services.Question{Verb: "profile"})
+	assert.Equal(t, "Profile: default\nAvailable: wfh", answer.Text)
+
+	answer = service.queryProfile(services.Question{Verb: "profile", Args: "xyz"})
+	assert.Equal(t, "Profile xyz not found", answer.Text)
+
+	answer = service.queryProfile(services.Question{Verb: "profile", Args: "wfh 1h"})
+	assert.Equal(t, "Switched to wfh until Sat Jan  4 11:19:00 2014", answer.Text)
+	assert.Equal(t, 19.0, service.Target(zone, Clock()))
+	assert.True(t, service.State)
+	assert.Contains(t, service.Status(Clock()), "Profile: wfh until Sat Jan  4 11:19:00 2014")
+
+	// expires
+	setClock(evOff.Timestamp.Add(time.Hour))
+	service.Check(false)
+	assert.Equal(t, "", service.Profile)
+	assert.Equal(t, 18.0, service.Target(zone, Clock()))
+
+	service.queryProfile(services.Question{Verb: "profile", Args: "wfh"})
+	assert.Equal(t, "wfh", service.Profile)
+	answer = service.queryProfile(services.Question{Verb: "profile", Args: "default"})
+	assert.Equal(t, "Switched to default profile", answer.Text)
+	assert.Equal(t, "", service.Profile)
+}
+
+func commands(events []*pubsub.Event) map[string]string {
+	ret := map[string]string{}
+	for _, ev := range events {
+		if ev.Topic == "command" {
+			ret[ev.Device()] = ev.Command()
+		}
 	}
+	return ret
+}
+
+func TestZoneHeaters(t *testing.T) {
+	SetupTests()
+	zone := service.Zones["hallway"]
+	zone.Heaters = []string{"heater.hallway"}
+	em.Events = nil
+
+	fire(evCold)
+	// zone heater on, boiler untouched
+	assert.False(t, service.State)
+	assert.Equal(t, map[string]string{"heater.hallway": "on"}, commands(em.Events))
+	assert.Equal(t, "no zones calling for heat", service.Reason)
+
+	em.Events = nil
+	fire(evHot)
+	assert.Equal(t, map[string]string{"heater.hallway": "off"}, commands(em.Events))
+}
+
+func TestZoneValvesTrvs(t *testing.T) {
+	SetupTests()
+	zone := service.Zones["hallway"]
+	zone.Valves = []string{"valve.upstairs"}
+	zone.Trvs = []string{"trv.hallway"}
+	em.Events = nil
+
+	fire(evCold)
+	assert.True(t, service.State)
+	assert.Equal(t, map[string]string{"heater.boiler": "on", "valve.upstairs": "on"}, commands(em.Events))
+
+	em.Events = nil
+	service.Heartbeat()
+	var trv *pubsub.Event
+	for _, ev := range em.Events {
+		if ev.Topic == "thermostat" && ev.Device() == "trv.hallway" {
+			trv = ev
+		}
+	}
+	require.NotNil(t, trv)
+	assert.Equal(t, 18.0, trv.Fields["target"])
+	// repeated, without devicestate
+	assert.Equal(t, map[string]string{"heater.boiler": "on", "valve.upstairs": "on"}, commands(em.Events))
+	em.Events = nil
+	service.Heartbeat()
+	targets := 0
+	for _, ev := range em.Events {
+		if ev.Topic == "thermostat" {
+			targets++
+		}
+	}
+	assert.Equal(t, 2, targets)
+
+	em.Events = nil
+	fire(evHot)
+	assert.Equal(t, map[string]string{"heater.boiler": "off", "valve.upstairs": "off"}, commands(em.Events))
+}
+
+func TestReconciledNotRepeated(t *testing.T) {
+	SetupTests()
+	// copy, as the example config is shared
+	conf := *services.Config
+	conf.Devices = map[string]config.DeviceConf{}
+	for id, dev := range services.Config.Devices {
+		conf.Devices[id] = dev
+	}
+	conf.Devices["heater.boiler"] = config.DeviceConf{Id: "heater.boiler", Source: "homeeasy.00123456"}
+	conf.Devices["valve.upstairs"] = config.DeviceConf{Id: "valve.upstairs", Source: "homeeasy.00123457"}
+	conf.Devices["trv.hallway"] = config.DeviceConf{Id: "trv.hallway", Source: "energenie.00097a"}
+	conf.Devicestate = config.DevicestateConf{
+		Protocols: map[string]config.DevicestateProtocolConf{
+			"homeeasy":  {Reconcile: config.Duration{Duration: time.Minute}},
+			"energenie": {Reconcile: config.Duration{Duration: time.Minute}, Unacknowledged: true},
+		},
+	}
+	services.Config = &conf
+	defer func() { services.Config = config.ExampleConfig }()
+	zone := service.Zones["hallway"]
+	zone.Valves = []string{"valve.upstairs"}
+	zone.Trvs = []string{"trv.hallway"}
+
+	fire(evCold)
+	assert.True(t, service.State)
+	service.Heartbeat() // targets emitted
+	em.Events = nil
+	service.Heartbeat()
+	// devicestate re-issues commands and targets, including thermostat.hallway
+	// by its trv's protocol
+	assert.Empty(t, commands(em.Events))
+	for _, ev := range em.Events {
+		assert.NotEqual(t, "thermostat", ev.Topic)
+	}
+}
+
+func TestReport(t *testing.T) {
+	SetupTests()
+	fire(evCold)
+	assert.True(t, service.State)
+
+	at := evCold.Timestamp
+	service.accumulate(at)
+	service.accumulate(at.Add(time.Minute))
+	service.accumulate(at.Add(2 * time.Minute))
+	// gaps aren't counted
+	service.accumulate(at.Add(time.Hour))
+
+	report := service.Report
+	assert.Equal(t, "2014-01-04", report.Date)
+	assert.Equal(t, 2.0, report.BoilerMinutes)
+	assert.Equal(t, 2.0, report.Zones["hallway"].DemandMinutes)
+	assert.InDelta(t, 15.8, report.Zones["hallway"].DegreeMinutes, 0.001)
+
+	setClock(at.Add(time.Hour))
+	answer := service.queryReport(services.Question{Verb: "report"})
+	assert.Equal(t, "Heating report 2014-01-04\nBoiler: 2 mins\nhallway: demand 2 mins, 15.8°C·mins below target", answer.Text)
+
+	// day complete
+	em.Events = nil
+	service.accumulate(time.Date(2014, 1, 5, 0, 0, 30, 0, time.UTC))
+	require.Equal(t, 1, len(em.Events))
+	ev := em.Events[0]
+	assert.Equal(t, "heating_report", ev.Topic)
+	assert.Equal(t, "2014-01-04", ev.Fields["date"])
+	assert.Equal(t, 2.0, ev.Fields["boiler_minutes"])
+	assert.Equal(t, "2014-01-05", service.Report.Date)
+
+	setClock(time.Date(2014, 1, 5, 9, 0, 0, 0, time.UTC))
+	answer = service.queryReport(services.Question{Verb: "report", Args: "yesterday"})
+	assert.Equal(t, 2.0, answer.Json.(pubsub.Fields)["boiler_minutes"])
+	answer = service.queryReport(services.Question{Verb: "report", Args: "2013-12-25"})
+	assert.Equal(t, "No heating report for 2013-12-25", answer.Text)
+}
+
+func TestScheduleEdit(t *testing.T) {
+	SetupTests()
+	services.RawConfig = []byte("# comment\nheating:\n" + strings.Replace(configYaml, "\n", "\n  ", -1))
+	answer := service.querySchedule(services.Question{Verb: "schedule", Args: "get hallway"})
+	assert.Equal(t, "hallway schedule:\nMonday-Friday:\n- 07:30-08:10: 18\n- 17:30-22:20: 18\nSaturday,Sunday:\n- 10:20-22:50: 18", answer.Text)
+
+	em.Events = nil
+	answer = service.querySchedule(services.Question{Verb: "schedule", Args: "set hallway Saturday,Sunday 08:00-10:20 16.5"})
+	assert.Equal(t, "Set hallway Saturday,Sunday 08:00-10:20 to 16.5°C", answer.Text)
+	require.NotEmpty(t, em.Events)
+	ev := em.Events[0]
+	assert.Equal(t, "config", ev.Topic)
+	assert.True(t, ev.Retained)
+	conf, err := config.OpenRaw(ev.Raw)
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]float64{{"08:00-10:20": 16.5}, {"10:20-22:50": 18}}, conf.Heating.Zones["hallway"].Schedule["Saturday,Sunday"])
+	assert.Contains(t, string(ev.Raw), "# comment\n")
+	assert.Contains(t, string(ev.Raw), "      profiles:\n        wfh:\n          All:\n            - 08:00-22:00: 19.0\n")
+	// applied immediately
+	assert.Equal(t, 16.5, service.Zones["hallway"].Schedule.Target(time.Date(2014, 1, 4, 9, 0, 0, 0, time.UTC), 0))
+
+	answer = service.querySchedule(services.Question{Verb: "schedule", Args: "set hallway Saturday,Sunday 08:00-10:20 40"})
+	assert.Equal(t, "Temperature 40.0 outside range 1.0 <= t <= 25.0", answer.Text)
+	answer = service.querySchedule(services.Question{Verb: "schedule", Args: "remove hallway Weekends"})
+	assert.Equal(t, "Weekends not in schedule", answer.Text)
+
+	em.Events = nil
+	answer = service.querySchedule(services.Question{Verb: "schedule", Args: "remove hallway Monday-Friday 07:30-08:10"})
+	assert.Equal(t, "Removed hallway Monday-Friday 07:30-08:10", answer.Text)
+	conf, err = config.OpenRaw(em.Events[0].Raw)
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]float64{{"17:30-22:20": 18}}, conf.Heating.Zones["hallway"].Schedule["Monday-Friday"])
+	// made on top of the earlier edit, not yet received back as the config
+	assert.Equal(t, []map[string]float64{{"08:00-10:20": 16.5}, {"10:20-22:50": 18}}, conf.Heating.Zones["hallway"].Schedule["Saturday,Sunday"])
+
+	answer = service.querySchedule(services.Question{Verb: "schedule", Args: "get attic"})
+	assert.Equal(t, "Zone attic not found", answer.Text)
 }
@@ -0,0 +1,250 @@
+package heating
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/barnybug/gohome/config"
+	"github.com/barnybug/gohome/pubsub"
+	"github.com/barnybug/gohome/services"
+)
+
+// File the daily heating reports are persisted to. Empty disables
+// persistence.
+var reportFile = config.ConfigPath("heating.reports")
+
+// Number of days of reports kept.
+const reportDays = 90
+
+// Longest gap between heartbeats accumulated, so time the service was down
+// is not counted.
+const maxReportGap = 5 * time.Minute
+
+const reportDate = "2006-01-02"
+
+type ZoneReport struct {
+	DemandMinutes float64 `json:"demand_minutes"` // minutes calling for heat
+	DegreeMinutes float64 `json:"degree_minutes"` // °C below target x minutes
+}
+
+type DayReport struct {
+	Date          string                 `json:"date"`
+	BoilerMinutes float64                `json:"boiler_minutes"`
+	Zones         map[string]*ZoneReport `json:"zones"`
+	OutsideMin    *float64               `json:"outside_min,omitempty"`
+	OutsideMax    *float64               `json:"outside_max,omitempty"`
+	OutsideTotal  float64                `json:"outside_total"` // °C x minutes
+	OutsideMins   float64                `json:"outside_minutes"`
+}
+
+func NewDayReport(date string) *DayReport {
+	return &DayReport{Date: date, Zones: map[string]*ZoneReport{}}
+}
+
+// OutsideMean returns the mean outside temperature over the day.
+func (self *DayReport) OutsideMean() (float64, bool) {
+	if self.OutsideMins == 0 {
+		return 0, false
+	}
+	return self.OutsideTotal / self.OutsideMins, true
+}
+
+func (self *DayReport) Fields() pubsub.Fields {
+	zones := map[string]interface{}{}
+	for name, zone := range self.Zones {
+		zones[name] = map[string]interface{}{
+			"demand_minutes": zone.DemandMinutes,
+			"degree_minutes": zone.DegreeMinutes,
+		}
+	}
+	fields := pubsub.Fields{
+		"date":           self.Date,
+		"boiler_minutes": self.BoilerMinutes,
+		"zones":          zones,
+	}
+	if mean, ok := self.OutsideMean(); ok {
+		fields["outside_mean"] = mean
+		fields["outside_min"] = *self.OutsideMin
+		fields["outside_max"] = *self.OutsideMax
+	}
+	return fields
+}
+
+func (self *DayReport) String() string {
+	msg := fmt.Sprintf("Heating report %s\nBoiler: %.0f mins", self.Date, self.BoilerMinutes)
+	var names []string
+	for name := range self.Zones {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		zone := self.Zones[name]
+		msg += fmt.Sprintf("\n%s: demand %.0f mins, %.1f°C·mins below target", name, zone.DemandMinutes, zone.DegreeMinutes)
+	}
+	if mean, ok := self.OutsideMean(); ok {
+		msg += fmt.Sprintf("\nOutside: mean %.1f°C (%.1f°C to %.1f°C)", mean, *self.OutsideMin, *self.OutsideMax)
+	}
+	return msg
+}
+
+// accumulate adds the time since the last heartbeat to today's report,
+// emitting a heating_report event for the previous day once it's complete.
+func (self *Service) accumulate(now time.Time) {
+	date := now.Format(reportDate)
+	if self.Report == nil {
+		self.Report = NewDayReport(date)
+	} else if self.Report.Date != date {
+		self.finishReport()
+		self.Report = NewDayReport(date)
+	}
+
+	last := self.ReportAt
+	self.ReportAt = now
+	if last.IsZero() || now.Sub(last) > maxReportGap || !now.After(last) {
+		return
+	}
+	mins := now.Sub(last).Minutes()
+	report := self.Report
+	if self.State {
+		report.BoilerMinutes += mins
+	}
+	for name, zone := range self.Zones {
+		zr, ok := report.Zones[name]
+		if !ok {
+			zr = &ZoneReport{}
+			report.Zones[name] = zr
+		}
+		if zone.Demand {
+			zr.DemandMinutes += mins
+		}
+		if temp, ok := zone.Reading(now); ok {
+			if below := self.Target(zone, now) - temp; below > 0 {
+				zr.DegreeMinutes += below * mins
+			}
+		}
+	}
+	if outside, ok := self.outsideTemp(now); ok {
+		report.OutsideTotal += outside * mins
+		report.OutsideMins += mins
+		if report.OutsideMin == nil || outside < *report.OutsideMin {
+			report.OutsideMin = &outside
+		}
+		if report.OutsideMax == nil || outside > *report.OutsideMax {
+			report.OutsideMax = &outside
+		}
+	}
+	if now.Minute() == 0 {
+		// save hourly
+		self.SaveReports()
+	}
+}
+
+func (self *Service) finishReport() {
+	report := self.Report
+	if self.Reports == nil {
+		self.Reports = map[string]*DayReport{}
+	}
+	self.Reports[report.Date] = report
+	// expire old reports
+	var dates []string
+	for date := range self.Reports {
+		dates = append(dates, date)
+	}
+	sort.Strings(dates)
+	for len(dates) > reportDays {
+		delete(self.Reports, dates[0])
+		dates = dates[1:]
+	}
+
+	ev := pubsub.NewEvent("heating_report", report.Fields())
+	self.Publisher.Emit(ev)
+	log.Printf("Heating report %s: boiler %.0f mins", report.Date, report.BoilerMinutes)
+	self.SaveReports()
+}
+
+type persistedReports struct {
+	Today *DayReport            `json:"today"`
+	At    time.Time             `json:"at"`
+	Days  map[string]*DayReport `json:"days"`
+}
+
+// SaveReports saves the daily reports.
+func (self *Service) SaveReports() {
+	if reportFile == "" {
+		return
+	}
+	data, err := json.Marshal(persistedReports{
+		Today: self.Report,
+		At:    self.ReportAt,
+		Days:  self.Reports,
+	})
+	if err != nil {
+		log.Println("Saving heating reports failed:", err)
+		return
+	}
+	// write atomically
+	tmp := reportFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		log.Println("Saving heating reports failed:", err)
+		return
+	}
+	if err := os.Rename(tmp, reportFile); err != nil {
+		log.Println("Saving heating reports failed:", err)
+	}
+}
+
+// RestoreReports restores the daily reports saved previously.
+func (self *Service) RestoreReports() {
+	if reportFile == "" {
+		return
+	}
+	data, err := ioutil.ReadFile(reportFile)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		log.Println("Restoring heating reports failed:", err)
+		return
+	}
+	var reports persistedReports
+	if err := json.Unmarshal(data, &reports); err != nil {
+		log.Println("Restoring heating reports failed:", err)
+		return
+	}
+	self.Report = reports.Today
+	self.ReportAt = reports.At
+	self.Reports = reports.Days
+}
+
+func (self *Service) lookupReport(date string) *DayReport {
+	if self.Report != nil && self.Report.Date == date {
+		return self.Report
+	}
+	return self.Reports[date]
+}
+
+func (self *Service) queryReport(q services.Question) services.Answer {
+	now := Clock()
+	date := now.Format(reportDate)
+	switch arg := strings.TrimSpace(q.Args); arg {
+	case "", "today":
+	case "yesterday":
+		date = now.AddDate(0, 0, -1).Format(reportDate)
+	default:
+		t, err := time.ParseInLocation(reportDate, arg, now.Location())
+		if err != nil {
+			return services.Answer{Text: "Date should be today, yesterday or YYYY-MM-DD"}
+		}
+		date = t.Format(reportDate)
+	}
+	report := self.lookupReport(date)
+	if report == nil {
+		return services.Answer{Text: fmt.Sprintf("No heating report for %s", date)}
+	}
+	return services.Answer{Text: report.String(), Json: report.Fields()}
+}
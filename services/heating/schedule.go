@@ -0,0 +1,95 @@
+package heating
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/barnybug/gohome/config"
+	"github.com/barnybug/gohome/lib/schedule"
+	"github.com/barnybug/gohome/services"
+)
+
+// editSchedule edits a zone schedule in the retained config, on top of any
+// edit still pending, and applies it immediately.
+func (self *Service) editSchedule(name string, edit func(config.ScheduleConf) (config.ScheduleConf, error)) (config.ScheduleConf, error) {
+	zone, ok := self.Zones[name]
+	if !ok {
+		return nil, fmt.Errorf("Zone %s not found", name)
+	}
+	var conf config.ScheduleConf
+	err := services.EditConfig(self.Publisher, func(raw []byte) ([]byte, error) {
+		current, err := config.OpenRaw(raw)
+		if err != nil {
+			return nil, err
+		}
+		zoneConf, ok := current.Heating.Zones[name]
+		if !ok {
+			return nil, fmt.Errorf("Zone %s not found", name)
+		}
+		if conf, err = edit(zoneConf.Schedule); err != nil {
+			return nil, err
+		}
+		return schedule.Replace(raw, name, conf)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	zone.Schedule, _ = schedule.New(conf)
+	self.Check(true)
+	return conf, nil
+}
+
+func scheduleText(name string, conf config.ScheduleConf) string {
+	out, _ := yaml.Marshal(conf)
+	return fmt.Sprintf("%s schedule:\n%s", name, strings.TrimRight(string(out), "\n"))
+}
+
+func (self *Service) querySchedule(q services.Question) services.Answer {
+	usage := services.Answer{Text: "Usage: schedule get zone | set zone days hh:mm-hh:mm temp | remove zone days [hh:mm-hh:mm]"}
+	vs := strings.Fields(q.Args)
+	if len(vs) < 2 {
+		return usage
+	}
+	verb, name := vs[0], vs[1]
+	zoneConf, ok := services.Config.Heating.Zones[name]
+	if !ok {
+		return services.Answer{Text: fmt.Sprintf("Zone %s not found", name)}
+	}
+
+	var edit func(config.ScheduleConf) (config.ScheduleConf, error)
+	var text string
+	switch {
+	case verb == "get" && len(vs) == 2:
+		return services.Answer{Text: scheduleText(name, zoneConf.Schedule), Json: zoneConf.Schedule}
+	case verb == "set" && len(vs) == 5:
+		temp, err := strconv.ParseFloat(vs[4], 64)
+		if err != nil {
+			return services.Answer{Text: fmt.Sprintf("Invalid temperature: %s", vs[4])}
+		}
+		edit = func(conf config.ScheduleConf) (config.ScheduleConf, error) {
+			return schedule.Set(conf, vs[2], vs[3], temp), nil
+		}
+		text = fmt.Sprintf("Set %s %s %s to %.1f°C", name, vs[2], vs[3], temp)
+	case verb == "remove" && (len(vs) == 3 || len(vs) == 4):
+		at := ""
+		if len(vs) == 4 {
+			at = vs[3]
+		}
+		edit = func(conf config.ScheduleConf) (config.ScheduleConf, error) {
+			return schedule.Remove(conf, vs[2], at)
+		}
+		text = strings.TrimSpace(fmt.Sprintf("Removed %s %s %s", name, vs[2], at))
+	default:
+		return usage
+	}
+
+	conf, err := self.editSchedule(name, edit)
+	if err != nil {
+		return services.Answer{Text: fmt.Sprint(err)}
+	}
+	return services.Answer{Text: text, Json: conf}
+}
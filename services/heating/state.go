@@ -0,0 +1,109 @@
+package heating
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"github.com/barnybug/gohome/config"
+)
+
+// File the heating state is persisted to, so overrides and holiday mode
+// survive restarts. Empty disables persistence.
+var stateFile = config.ConfigPath("heating.state")
+
+type zoneState struct {
+	PartyTemp  float64     `json:"party_temp,omitempty"`
+	PartyUntil time.Time   `json:"party_until,omitempty"`
+	Warmup     WarmupRates `json:"warmup"`
+	Duty       float64     `json:"duty"`
+}
+
+type persistedState struct {
+	State        bool                 `json:"state"`
+	StateChanged time.Time            `json:"state_changed"`
+	Holiday      time.Time            `json:"holiday,omitempty"`
+	Profile      string               `json:"profile,omitempty"`
+	ProfileUntil time.Time            `json:"profile_until,omitempty"`
+	Zones        map[string]zoneState `json:"zones"`
+}
+
+// Save the heating state.
+func (self *Service) Save() {
+	if stateFile == "" {
+		return
+	}
+	state := persistedState{
+		State:        self.State,
+		StateChanged: self.StateChanged,
+		Holiday:      self.Holiday,
+		Profile:      self.Profile,
+		ProfileUntil: self.ProfileUntil,
+		Zones:        map[string]zoneState{},
+	}
+	for name, zone := range self.Zones {
+		state.Zones[name] = zoneState{
+			PartyTemp:  zone.PartyTemp,
+			PartyUntil: zone.PartyUntil,
+			Warmup:     zone.Warmup,
+			Duty:       zone.Duty,
+		}
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		log.Println("Saving heating state failed:", err)
+		return
+	}
+	// write atomically
+	tmp := stateFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		log.Println("Saving heating state failed:", err)
+		return
+	}
+	if err := os.Rename(tmp, stateFile); err != nil {
+		log.Println("Saving heating state failed:", err)
+	}
+}
+
+// Restore the heating state saved previously.
+func (self *Service) Restore() {
+	if stateFile == "" {
+		return
+	}
+	data, err := ioutil.ReadFile(stateFile)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		log.Println("Restoring heating state failed:", err)
+		return
+	}
+	var state persistedState
+	if err := json.Unmarshal(data, &state); err != nil {
+		log.Println("Restoring heating state failed:", err)
+		return
+	}
+
+	self.State = state.State
+	self.StateChanged = state.StateChanged
+	now := Clock()
+	self.Holiday = state.Holiday
+	if state.ProfileUntil.IsZero() || state.ProfileUntil.After(now) {
+		self.Profile = state.Profile
+		self.ProfileUntil = state.ProfileUntil
+	}
+	for name, zs := range state.Zones {
+		zone, ok := self.Zones[name]
+		if !ok {
+			continue
+		}
+		if zs.PartyUntil.After(now) {
+			zone.PartyTemp = zs.PartyTemp
+			zone.PartyUntil = zs.PartyUntil
+		}
+		zone.Warmup = zs.Warmup
+		zone.Duty = zs.Duty
+	}
+	log.Println("Restored heating state")
+}
@@ -0,0 +1,44 @@
+package services
+
+import (
+	"log"
+	"sync"
+
+	"github.com/barnybug/gohome/config"
+	"github.com/barnybug/gohome/lib/intent"
+)
+
+// matcher for the current config, rebuilt when the config changes.
+var intents struct {
+	sync.Mutex
+	config  *config.Config
+	matcher *intent.Matcher
+}
+
+// MatchIntent matches voice or chat text to an intent, returning nil if not
+// understood.
+func MatchIntent(text string) *intent.Match {
+	intents.Lock()
+	defer intents.Unlock()
+	if intents.config != Config {
+		matcher, err := intent.New(Config)
+		if err != nil {
+			log.Println("Error in intents:", err)
+		}
+		intents.config, intents.matcher = Config, matcher
+	}
+	if intents.matcher == nil {
+		return nil
+	}
+	return intents.matcher.Match(text)
+}
+
+// TextQuery returns the query for chat text: the query of the intent
+// matched, otherwise the text as is (eg "heating/status").
+func TextQuery(text string) string {
+	if match := MatchIntent(text); match != nil {
+		log.Printf("Intent %s: %s", match.Intent, match.Query)
+		return match.Query
+	}
+	return text
+}
@@ -120,7 +120,7 @@ func (self *Service) Run() error {
 				}
 
 				log.Println("Query:", v.Text)
-				services.SendQuery(v.Text, "jabber", v.Remote, "alert")
+				services.SendQuery(services.TextQuery(v.Text), "jabber", v.Remote, "alert")
 			case xmpp.Presence:
 				// ignore self
 				if !IsSelf(v.From) {
@@ -1,6 +1,7 @@
 package services
 
 import (
+	"errors"
 	"strings"
 	"sync"
 
@@ -14,8 +15,29 @@ type Question struct {
 }
 
 type Answer struct {
-	Text string
-	Json interface{}
+	Text  string
+	Json  interface{}
+	Error error // sent as the error field, with error_code for answerErrors
+}
+
+// Errors answers are sent with a code for, so callers can tell them apart.
+var answerErrors = map[string]error{
+	"device_not_found":    ErrDeviceNotFound,
+	"device_ambiguous":    ErrDeviceAmbiguous,
+	"automaton_not_found": ErrAutomatonNotFound,
+	"state_not_found":     ErrStateNotFound,
+}
+
+// AnswerError returns the error of an answer: the error sent by code, an
+// error of the message otherwise, or nil if none.
+func AnswerError(ev *pubsub.Event) error {
+	if err, ok := answerErrors[ev.StringField("error_code")]; ok {
+		return err
+	}
+	if msg := ev.StringField("error"); msg != "" {
+		return errors.New(msg)
+	}
+	return nil
 }
 
 type QueryHandler func(q Question) Answer
@@ -46,6 +68,14 @@ func sendAnswer(request *pubsub.Event, source string, answer Answer) {
 	if answer.Json != nil {
 		fields["json"] = answer.Json
 	}
+	if answer.Error != nil {
+		fields["error"] = answer.Error.Error()
+		for code, err := range answerErrors {
+			if err == answer.Error {
+				fields["error_code"] = code
+			}
+		}
+	}
 
 	remote := request.StringField("remote")
 	if remote != "" {
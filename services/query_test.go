@@ -45,3 +45,24 @@ func ExampleQuerySubscriber() {
 	// 1
 	// squiggle
 }
+
+func ExampleQuerySubscriber_error() {
+	query := pubsub.NewEvent("query", pubsub.Fields{"query": "fail"})
+	Subscriber = &dummy.Subscriber{Events: []*pubsub.Event{query}}
+	em := dummy.Publisher{}
+	Publisher = &em
+	mock := MockService{
+		queryHandlers: map[string]QueryHandler{"fail": func(Question) Answer {
+			return Answer{Text: "it broke", Error: ErrDeviceNotFound}
+		}},
+	}
+	enabled = []Service{&mock}
+	QuerySubscriber()
+	fmt.Println(em.Events[0].StringField("message"))
+	fmt.Println(em.Events[0].StringField("error"))
+	fmt.Println(AnswerError(em.Events[0]) == ErrDeviceNotFound)
+	// Output:
+	// it broke
+	// device not found
+	// true
+}
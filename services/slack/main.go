@@ -97,7 +97,7 @@ Loop:
 				}
 				// send the message as a query
 				log.Println("Querying:", event.Text)
-				ch := services.QueryChannel(event.Text, time.Duration(5)*time.Second)
+				ch := services.QueryChannel(services.TextQuery(event.Text), time.Duration(5)*time.Second)
 
 				gotResponse := false
 				for ev := range ch {
@@ -66,7 +66,7 @@ func (self *Service) Run() error {
 		for _, msg := range *msgs {
 			if msg.Status == "REC UNREAD" {
 				fmt.Printf("Message from %s: %s\n", msg.Telephone, msg.Body)
-				services.SendQuery(msg.Body, "sms", msg.Telephone, "alert")
+				services.SendQuery(services.TextQuery(msg.Body), "sms", msg.Telephone, "alert")
 			}
 			// delete - any unread have been read
 			modem.DeleteMessage(msg.Index)
@@ -90,7 +90,7 @@ func (self *Service) Run() error {
 				msg, err := modem.GetMessage(p.Index)
 				if err == nil {
 					fmt.Printf("Message from %s: %s\n", msg.Telephone, msg.Body)
-					services.SendQuery(msg.Body, "sms", msg.Telephone, "alert")
+					services.SendQuery(services.TextQuery(msg.Body), "sms", msg.Telephone, "alert")
 					modem.DeleteMessage(p.Index)
 				}
 			}
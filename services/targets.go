@@ -0,0 +1,211 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/barnybug/gohome/config"
+	"github.com/barnybug/gohome/pubsub"
+	"github.com/barnybug/gohome/util"
+)
+
+var ErrDeviceNotFound = errors.New("device not found")
+var ErrDeviceAmbiguous = errors.New("device is ambiguous")
+var ErrAutomatonNotFound = errors.New("automaton not found")
+var ErrStateNotFound = errors.New("automaton state not found")
+
+// Protocols sent over the rfxtrx transceiver, which collide if sent together.
+var rfProtocols = []string{"homeeasy", "x10", "byronsx"}
+
+func splitTarget(target string) (kind, value string, ok bool) {
+	ps := strings.SplitN(target, ":", 2)
+	if len(ps) != 2 {
+		return "", "", false
+	}
+	switch ps[0] {
+	case "group", "location", "cap":
+		return ps[0], ps[1], true
+	}
+	return "", "", false
+}
+
+// IsTarget returns true if name is a group:, location: or cap: target
+// rather than a single device.
+func IsTarget(name string) bool {
+	_, _, ok := splitTarget(name)
+	return ok
+}
+
+func matchTarget(kind, value string, dev config.DeviceConf) bool {
+	switch kind {
+	case "group":
+		return strings.EqualFold(dev.Group, value)
+	case "location":
+		return strings.EqualFold(dev.Location, value)
+	case "cap":
+		// device type (the id prefix) is treated as an implicit cap
+		return dev.Cap[value] || dev.Prefix() == value
+	}
+	return false
+}
+
+// ResolveTarget resolves a command target to device ids. A target is one of:
+//
+// group:<group> - all controllable devices in the group
+//
+// location:<location> - all controllable devices in the location
+//
+// cap:<cap> - all controllable devices with the cap, or of that type
+//
+// otherwise the target is matched as a single device by MatchDevices.
+// Ambiguous single device matches are returned along with ErrDeviceAmbiguous.
+func ResolveTarget(target string) ([]string, error) {
+	kind, value, ok := splitTarget(target)
+	if !ok {
+		matches := MatchDevices(target)
+		if len(matches) == 0 {
+			return nil, ErrDeviceNotFound
+		}
+		if len(matches) > 1 {
+			sort.Strings(matches)
+			return matches, ErrDeviceAmbiguous
+		}
+		return matches, nil
+	}
+
+	matches := []string{}
+	for id, dev := range Config.Devices {
+		if dev.IsControllable() && matchTarget(kind, value, dev) {
+			matches = append(matches, id)
+		}
+	}
+	if len(matches) == 0 {
+		return nil, ErrDeviceNotFound
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+// SplitCommand splits "target command key=value..." text into the target and
+// the command arguments. The target is either quoted, or the longest run of
+// words resolving to devices, so may contain spaces, eg: location:Living Room
+// off level=50. The command follows, and any further arguments must be
+// key=value. ErrDeviceNotFound is returned, along with the split, if the
+// target doesn't resolve.
+func SplitCommand(text string) (string, []string, error) {
+	args := util.SplitArgs(text)
+	if len(args) == 0 {
+		return "", nil, errors.New("target required")
+	}
+	n := 1
+	if !quotedTarget(text) {
+		for i := len(args); i > 1; i-- {
+			if _, err := ResolveTarget(strings.Join(args[:i], " ")); err != ErrDeviceNotFound {
+				n = i
+				break
+			}
+		}
+	}
+	target, args := strings.Join(args[:n], " "), args[n:]
+	for i, arg := range args {
+		if i > 0 && !strings.Contains(arg, "=") {
+			return "", nil, fmt.Errorf("unexpected argument: %s", arg)
+		}
+	}
+	if _, err := ResolveTarget(target); err == ErrDeviceNotFound {
+		return target, args, err
+	}
+	return target, args, nil
+}
+
+// quotedTarget returns true if the first word of text is quoted.
+func quotedTarget(text string) bool {
+	text = strings.TrimSpace(text)
+	if i := strings.IndexAny(text, " \t"); i != -1 {
+		text = text[:i]
+	}
+	return strings.ContainsAny(text, `"'`)
+}
+
+// QueryDevices returns the devices a switch query controls. ok is false for
+// other queries, which aren't limited to devices.
+func QueryDevices(query string) (devices []string, ok bool, err error) {
+	ps := strings.SplitN(query, " ", 2)
+	if len(ps) < 2 || splitLast(strings.ToLower(ps[0]), "/") != "switch" {
+		return nil, false, nil
+	}
+	target, _, err := SplitCommand(ps[1])
+	if err != nil {
+		return nil, true, err
+	}
+	devices, err = ResolveTarget(target)
+	return devices, true, err
+}
+
+// FanOut resolves the target of a command event into a command per device.
+func FanOut(ev *pubsub.Event) ([]*pubsub.Event, error) {
+	devices, err := ResolveTarget(ev.Device())
+	if err != nil {
+		return nil, err
+	}
+	var evs []*pubsub.Event
+	for _, device := range devices {
+		fields := pubsub.Fields{}
+		for k, v := range ev.Fields {
+			fields[k] = v
+		}
+		fields["device"] = device
+		evs = append(evs, pubsub.NewEvent(ev.Topic, fields))
+	}
+	return evs, nil
+}
+
+func isRF(device string) bool {
+	for _, protocol := range rfProtocols {
+		if _, ok := Config.LookupDeviceProtocol(device, protocol); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// EmitCommands emits commands, spacing out those sent by rf by the
+// general.stagger interval to avoid collisions.
+func EmitCommands(evs []*pubsub.Event) {
+	stagger := Config.General.Stagger.Duration
+	var delay time.Duration
+	for _, ev := range evs {
+		if stagger == 0 || !isRF(ev.Device()) {
+			Publisher.Emit(ev)
+			continue
+		}
+		if delay == 0 {
+			Publisher.Emit(ev)
+		} else {
+			ev := ev
+			time.AfterFunc(delay, func() {
+				ev.Timestamp = time.Now().UTC()
+				Publisher.Emit(ev)
+			})
+		}
+		delay += stagger
+	}
+}
+
+// EmitCommand emits a command, fanning it out to each device if addressed
+// to a group:, location: or cap: target.
+func EmitCommand(ev *pubsub.Event) error {
+	if !IsTarget(ev.Device()) {
+		Publisher.Emit(ev)
+		return nil
+	}
+	evs, err := FanOut(ev)
+	if err != nil {
+		return err
+	}
+	EmitCommands(evs)
+	return nil
+}
@@ -0,0 +1,123 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/barnybug/gohome/config"
+	"github.com/barnybug/gohome/pubsub"
+	"github.com/barnybug/gohome/pubsub/dummy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveTarget(t *testing.T) {
+	assert := assert.New(t)
+	Config = config.ExampleConfig
+
+	devices, err := ResolveTarget("group:Downstairs")
+	assert.NoError(err)
+	assert.Equal([]string{"light.glowworm", "light.kitchen"}, devices)
+
+	devices, err = ResolveTarget("cap:dimmer")
+	assert.NoError(err)
+	assert.Equal([]string{"light.glowworm"}, devices)
+
+	devices, err = ResolveTarget("cap:light")
+	assert.NoError(err)
+	assert.Equal([]string{"light.glowworm", "light.kitchen"}, devices)
+
+	_, err = ResolveTarget("location:Living Room")
+	assert.Equal(ErrDeviceNotFound, err)
+
+	devices, err = ResolveTarget("kitchen")
+	assert.NoError(err)
+	assert.Equal([]string{"light.kitchen"}, devices)
+
+	_, err = ResolveTarget("nonexistent")
+	assert.Equal(ErrDeviceNotFound, err)
+}
+
+func TestMatchTargetLocation(t *testing.T) {
+	dev := config.DeviceConf{Location: "Living Room"}
+	assert.True(t, matchTarget("location", "living room", dev))
+	assert.False(t, matchTarget("location", "Living_Room", dev))
+	assert.False(t, matchTarget("location", "Living", dev))
+}
+
+func TestSplitCommand(t *testing.T) {
+	conf := *config.ExampleConfig
+	conf.Devices = map[string]config.DeviceConf{}
+	for id, dev := range config.ExampleConfig.Devices {
+		conf.Devices[id] = dev
+	}
+	conf.Devices["light.lamp"] = config.DeviceConf{Id: "light.lamp", Location: "Living Room", Cap: map[string]bool{"light": true}}
+	Config = &conf
+	defer func() { Config = config.ExampleConfig }()
+
+	for _, tt := range []struct {
+		text   string
+		target string
+		args   []string
+		err    string
+	}{
+		{text: "light.kitchen on level=50", target: "light.kitchen", args: []string{"on", "level=50"}},
+		{text: "light.kitchen", target: "light.kitchen", args: []string{}},
+		{text: "kitchen level=50", target: "kitchen", args: []string{"level=50"}},
+		{text: "location:Living Room off", target: "location:Living Room", args: []string{"off"}},
+		{text: `location:"Living Room" off transition=2`, target: "location:Living Room", args: []string{"off", "transition=2"}},
+		{text: `"location:Living Room" off`, target: "location:Living Room", args: []string{"off"}},
+		{text: "light.kitchen on 50", err: "unexpected argument: 50"},
+		{text: "kitchen lights off now", err: "unexpected argument: off"},
+		{text: "light.hall on 50", err: "unexpected argument: 50"},
+		{text: "light.hall on", target: "light.hall", args: []string{"on"}, err: ErrDeviceNotFound.Error()},
+		{text: "location:Living off", target: "location:Living", args: []string{"off"}, err: ErrDeviceNotFound.Error()},
+		{text: "", err: "target required"},
+	} {
+		target, args, err := SplitCommand(tt.text)
+		if tt.err != "" {
+			assert.EqualError(t, err, tt.err, tt.text)
+		} else {
+			assert.NoError(t, err, tt.text)
+		}
+		assert.Equal(t, tt.target, target, tt.text)
+		assert.Equal(t, tt.args, args, tt.text)
+	}
+}
+
+func TestQueryDevices(t *testing.T) {
+	Config = config.ExampleConfig
+	devices, ok, err := QueryDevices("switch group:Downstairs off")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"light.glowworm", "light.kitchen"}, devices)
+
+	devices, ok, err = QueryDevices("automata/switch kitchen on level=50")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"light.kitchen"}, devices)
+
+	_, ok, err = QueryDevices("switch nonexistent on")
+	assert.Equal(t, ErrDeviceNotFound, err)
+	assert.True(t, ok)
+
+	_, ok, err = QueryDevices("heating/party living 21")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestEmitCommand(t *testing.T) {
+	assert := assert.New(t)
+	Config = config.ExampleConfig
+	pub := &dummy.Publisher{}
+	Publisher = pub
+
+	ev := pubsub.NewCommand("group:downstairs", "off")
+	ev.SetField("level", 10)
+	assert.NoError(EmitCommand(ev))
+	assert.Equal(2, len(pub.Events))
+	assert.Equal("light.glowworm", pub.Events[0].Device())
+	assert.Equal("off", pub.Events[0].Command())
+	assert.Equal(10, pub.Events[0].Fields["level"])
+	assert.Equal("light.kitchen", pub.Events[1].Device())
+
+	assert.Equal(ErrDeviceNotFound, EmitCommand(pubsub.NewCommand("group:upstairs", "off")))
+}
@@ -2,6 +2,7 @@
 // Supports:
 // - on
 // - off
+// - dimmer, colour temperature and colour (lights)
 // - power readings (Sonoff POW)
 package tasmota
 
@@ -11,6 +12,7 @@ import (
 	"log"
 	"strings"
 
+	"github.com/barnybug/gohome/lib/light"
 	"github.com/barnybug/gohome/pubsub"
 	"github.com/barnybug/gohome/pubsub/mqtt"
 	"github.com/barnybug/gohome/services"
@@ -30,12 +32,60 @@ func handleCommand(ev *pubsub.Event) {
 	}
 	log.Printf("Setting device %s to %s\n", dev, command)
 	topic := fmt.Sprintf("tasmota/cmnd/%s/power", ident)
-	token := mqtt.Client.Publish(topic, 1, false, command)
+	payload := command
+	if device := services.Config.Devices[dev]; light.IsLight(device) && command == "on" {
+		// send light settings and power in one go
+		lc, err := light.Parse(ev)
+		if err != nil {
+			log.Println("Light command invalid:", err)
+			return
+		}
+		topic = fmt.Sprintf("tasmota/cmnd/%s/backlog", ident)
+		payload = lightBacklog(lc.Restrict(light.DeviceCaps(device)))
+	}
+	token := mqtt.Client.Publish(topic, 1, false, payload)
 	if token.Wait() && token.Error() != nil {
 		log.Println("Failed to publish message:", token.Error())
 	}
 }
 
+// Tasmota colour temperature range in mireds
+const (
+	minCT = 153
+	maxCT = 500
+)
+
+// lightBacklog translates a light command into a tasmota Backlog command.
+func lightBacklog(lc light.Command) string {
+	var cmds []string
+	if lc.Transition != 0 {
+		// Speed is in 0.5s steps, 1-40
+		speed := int(lc.Transition.Seconds() * 2)
+		if speed < 1 {
+			speed = 1
+		} else if speed > 40 {
+			speed = 40
+		}
+		cmds = append(cmds, "Fade 1", fmt.Sprintf("Speed %d", speed))
+	}
+	if lc.Colour != nil {
+		cmds = append(cmds, "Color "+strings.TrimPrefix(lc.Colour.Hex(), "#"))
+	} else if lc.Temp != 0 {
+		ct := light.KelvinToMired(lc.Temp)
+		if ct < minCT {
+			ct = minCT
+		} else if ct > maxCT {
+			ct = maxCT
+		}
+		cmds = append(cmds, fmt.Sprintf("CT %d", ct))
+	}
+	if lc.Level != nil {
+		cmds = append(cmds, fmt.Sprintf("Dimmer %d", *lc.Level))
+	}
+	cmds = append(cmds, "Power on")
+	return strings.Join(cmds, "; ")
+}
+
 type Energy struct {
 	TotalStartTime string
 	Total          float64
@@ -77,7 +77,7 @@ func (self *Service) Run() error {
 
 			if services.Config.Telegram.Chat_id == update.Message.Chat.ID {
 				remote := fmt.Sprint(update.Message.MessageID)
-				text := rewriteTelegramCommands(update.Message.Text)
+				text := services.TextQuery(rewriteTelegramCommands(update.Message.Text))
 				services.SendQuery(text, "telegram", remote, "alert")
 			} else {
 				text := fmt.Sprintf("This is chat %d, configure this in gohome telgram->chat_id.", update.Message.Chat.ID)
@@ -1,6 +1,7 @@
 // Service for monitoring devices to ensure they're still alive and emitting
 // events. Watches a given list of device ids, and alerts if an event has not
-// been seen from a device in a configurable time period.
+// been seen from a device in a configurable time period. Also alerts on
+// heating_fault events from the heating service.
 package watchdog
 
 import (
@@ -86,6 +87,10 @@ func checkEvent(ev *pubsub.Event) {
 	if ignoreTopics(ev.Topic) {
 		return
 	}
+	if ev.Topic == "heating_fault" {
+		heatingFault(ev)
+		return
+	}
 	device := ev.Device()
 	if device != "" {
 		mappedDevice(ev)
@@ -95,6 +100,16 @@ func checkEvent(ev *pubsub.Event) {
 	}
 }
 
+func heatingFault(ev *pubsub.Event) {
+	message := ev.StringField("message")
+	if ev.StringField("state") == "fault" {
+		message = fmt.Sprintf("🔥 Heating fault: %s (fallback: %s)", message, ev.StringField("fallback"))
+	} else {
+		message = fmt.Sprintf("🔥 Heating fault cleared: %s", message)
+	}
+	sendAlert(message)
+}
+
 func mappedDevice(ev *pubsub.Event) {
 	if _, ok := unmapped[ev.Source()]; ok {
 		delete(unmapped, ev.Source())
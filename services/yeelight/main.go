@@ -2,12 +2,11 @@
 package yeelight
 
 import (
-	"encoding/hex"
 	"fmt"
 	"log"
-	"regexp"
 	"time"
 
+	"github.com/barnybug/gohome/lib/light"
 	"github.com/barnybug/gohome/pubsub"
 	"github.com/barnybug/gohome/services"
 	"github.com/edgard/yeelight"
@@ -22,7 +21,8 @@ func (self *Service) ID() string {
 	return "yeelight"
 }
 
-var reHexCode = regexp.MustCompile(`^#[0-9a-f]{6}$`)
+// Default transition time
+const defaultDuration = 500 * time.Millisecond
 
 func (self *Service) handleCommand(ev *pubsub.Event) {
 	dev := ev.Device()
@@ -30,46 +30,45 @@ func (self *Service) handleCommand(ev *pubsub.Event) {
 	if !ok {
 		return // command not for us
 	}
-	command := ev.Command()
-	if command != "off" && command != "on" {
-		log.Println("Command not recognised:", command)
+	command, err := light.Parse(ev)
+	if err != nil {
+		log.Printf("Command not recognised: %s (%s)", ev.Command(), err)
 		return
 	}
-	if light, ok := self.lights[ident]; ok {
-		log.Printf("Setting device %s to %s\n", dev, command)
-		duration := 500
-		if _, ok := ev.Fields["duration"]; ok {
-			duration = int(ev.IntField("duration"))
+	command = command.Restrict(light.DeviceCaps(services.Config.Devices[dev]))
+	if yl, ok := self.lights[ident]; ok {
+		log.Printf("Setting device %s to %s\n", dev, ev.Command())
+		duration := defaultDuration
+		if command.Transition != 0 {
+			duration = command.Transition
+		}
+		// yeelight minimum duration is 30ms
+		ms := int(duration / time.Millisecond)
+		if ms < 30 {
+			ms = 30
 		}
 
-		switch ev.Command() {
-		case "on":
-			light.PowerOn(duration)
-			level := int(ev.IntField("level"))
-			if level != 0 {
-				light.SetBrightness(level, duration)
+		if command.On {
+			yl.PowerOn(ms)
+			if command.Level != nil && *command.Level != 0 {
+				yl.SetBrightness(*command.Level, ms)
 			}
-			colour := ev.StringField("colour")
-			if reHexCode.MatchString(colour) {
-				decoded, _ := hex.DecodeString(colour[1:])
-				red := int(decoded[0])
-				green := int(decoded[1])
-				blue := int(decoded[2])
-				light.SetRGB(red, green, blue, duration)
+			if command.Colour != nil {
+				red, green, blue := command.Colour.Bytes()
+				yl.SetRGB(red, green, blue, ms)
 			}
-			temp := int(ev.IntField("temp"))
-			if temp != 0 {
-				light.SetTemp(temp, duration)
+			if command.Temp != 0 {
+				yl.SetTemp(command.Temp, ms)
 			}
-		case "off":
-			light.PowerOff(duration)
+		} else {
+			yl.PowerOff(ms)
 		}
-		light.Update()
+		yl.Update()
 		fields := pubsub.Fields{
 			"device":  dev,
-			"command": command,
-			"level":   light.Bright,
-			"temp":    light.ColorTemp,
+			"command": ev.Command(),
+			"level":   yl.Bright,
+			"temp":    yl.ColorTemp,
 		}
 		ev := pubsub.NewEvent("ack", fields)
 		services.Publisher.Emit(ev)
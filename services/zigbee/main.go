@@ -8,6 +8,7 @@ import (
 	"regexp"
 	"strings"
 
+	"github.com/barnybug/gohome/lib/light"
 	"github.com/barnybug/gohome/pubsub/mqtt"
 
 	"github.com/barnybug/gohome/pubsub"
@@ -137,36 +138,43 @@ func (self *Service) handleCommand(ev *pubsub.Event) {
 		return // command not for us
 	}
 	device := services.Config.Devices[ev.Device()]
-	command := ev.Command()
-	if command != "off" && command != "on" {
-		log.Println("Command not recognised:", command)
+	command, err := light.Parse(ev)
+	if err != nil {
+		log.Printf("Command not recognised: %s (%s)", ev.Command(), err)
 		return
 	}
-	log.Printf("Setting device %s to %s\n", ev.Device(), command)
+	caps := light.DeviceCaps(device)
+	command = command.Restrict(caps)
+	log.Printf("Setting device %s to %s\n", ev.Device(), ev.Command())
 
 	// translate to zigbee2mqtt message
 	topic := fmt.Sprintf("zigbee2mqtt/%s/set", id)
 	body := map[string]interface{}{}
-	body["state"] = strings.ToUpper(command)
-	if ev.IsSet("level") {
-		body["brightness"] = PercentageToDim(int(ev.IntField("level")))
-	}
-	temp := ev.IntField("temp")
-	if temp > 0 {
-		if device.Cap["colourtemp"] {
-			mirek := int(1_000_000 / temp)
-			body["color_temp"] = mirek
+	if command.On {
+		body["state"] = "ON"
+	} else {
+		body["state"] = "OFF"
+	}
+	if command.Level != nil {
+		body["brightness"] = PercentageToDim(*command.Level)
+	}
+	if command.Temp != 0 {
+		if caps.ColourTemp && caps.Declared {
+			body["color_temp"] = light.KelvinToMired(command.Temp)
 		} else {
 			// emulate colour temperature with x/y/dim
-			x, y, dim := KelvinToColorXYDim(int(temp))
+			x, y, dim := light.KelvinToColorXYDim(command.Temp)
 			body["color"] = map[string]interface{}{"x": x, "y": y}
-			if !ev.IsSet("level") {
+			if command.Level == nil {
 				body["brightness"] = dim
 			}
 		}
 	}
-	if ev.IsSet("colour") {
-		body["color"] = map[string]interface{}{"hex": ev.StringField("colour")}
+	if command.Colour != nil {
+		body["color"] = map[string]interface{}{"hex": command.Colour.Hex()}
+	}
+	if command.Transition != 0 {
+		body["transition"] = command.Transition.Seconds()
 	}
 	payload, _ := json.Marshal(body)
 	log.Println("Sending", topic, string(payload))
@@ -38,3 +38,36 @@ func ParseArgs(args []string) (string, map[string]interface{}) {
 	}
 	return command, fields
 }
+
+// SplitArgs splits s on spaces, keeping quoted ("..." or '...') parts
+// together, eg: `location:"Living Room" off` is [location:Living Room off].
+func SplitArgs(s string) []string {
+	args := []string{}
+	var arg strings.Builder
+	var quote rune
+	inArg := false
+	for _, r := range s {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			arg.WriteRune(r)
+		case r == '"' || r == '\'':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args
+}
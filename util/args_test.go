@@ -11,3 +11,11 @@ func TestParseArgs(t *testing.T) {
 	assert.Equal(t, command, "on")
 	assert.Equal(t, params, map[string]interface{}{"a": "b", "b": float64(1)})
 }
+
+func TestSplitArgs(t *testing.T) {
+	assert.Equal(t, []string{"light.kitchen", "on", "level=50"}, SplitArgs("light.kitchen  on level=50"))
+	assert.Equal(t, []string{"location:Living Room", "off"}, SplitArgs(`location:"Living Room" off`))
+	assert.Equal(t, []string{"location:Living Room", "off"}, SplitArgs(`'location:Living Room' off`))
+	assert.Equal(t, []string{""}, SplitArgs(`""`))
+	assert.Equal(t, []string{}, SplitArgs(" "))
+}